@@ -0,0 +1,139 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"onionbox/onion_buffer"
+)
+
+// adminTokenEnv is the environment variable the admin token can be set in.
+// It's not a flag so it doesn't show up in the process list.
+const adminTokenEnv = "ONIONBOX_ADMIN_TOKEN"
+
+// minAdminTokenLen is the shortest admin token accepted from adminTokenEnv.
+const minAdminTokenLen = 32
+
+// adminHandler serves the admin API. It's only reachable through the
+// -admin-onion service, never on the onion service links are shared on.
+// Every request needs the admin token in the X-Onionbox-Admin-Token header.
+// The token stands in for v3 client authorization, which neither bine's
+// ADD_ONION nor the embedded Tor supports (Tor added it in 0.4.6).
+func (ob *onionbox) adminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/buffers", ob.listBuffers)
+	mux.HandleFunc("/buffers/", ob.destroyBuffer)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !validAdminToken(r, ob.adminToken) {
+			ob.httpError(w, r, "Invalid token.", http.StatusUnauthorized)
+			return
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
+
+// loadAdminToken sets the admin token from adminTokenEnv, or creates one
+// if it's unset, reporting whether it was created.
+func (ob *onionbox) loadAdminToken() (created bool, err error) {
+	if token := os.Getenv(adminTokenEnv); token != "" {
+		if len(token) < minAdminTokenLen {
+			return false, fmt.Errorf("$%s must be at least %d characters long", adminTokenEnv, minAdminTokenLen)
+		}
+		ob.adminToken = token
+		return false, nil
+	}
+	token, err := createToken()
+	if err != nil {
+		return false, fmt.Errorf("creating admin token: %v", err)
+	}
+	ob.adminToken = token
+	return true, nil
+}
+
+// validAdminToken reports whether the request carries the admin token in
+// the X-Onionbox-Admin-Token header.
+func validAdminToken(r *http.Request, adminToken string) bool {
+	token := r.Header.Get("X-Onionbox-Admin-Token")
+	if token == "" || adminToken == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(token), []byte(adminToken)) == 1
+}
+
+// adminBuffer is a buffer as listed by the admin API, without its bytes
+// or secrets.
+type adminBuffer struct {
+	Name           string    `json:"name"`
+	DisplayName    string    `json:"display_name"`
+	Size           int64     `json:"size"`
+	Encrypted      bool      `json:"encrypted"`
+	Downloads      int       `json:"downloads"`
+	DownloadLimit  int       `json:"download_limit"`
+	Quarantined    bool      `json:"quarantined"`
+	CreatedAt      time.Time `json:"created_at"`
+	ExpiresAt      time.Time `json:"expires_at"`
+	LastAccessedAt time.Time `json:"last_accessed_at"`
+}
+
+// listBuffers writes every buffer in the store as JSON.
+func (ob *onionbox) listBuffers(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		ob.httpError(w, r, "Invalid HTTP Method.", http.StatusMethodNotAllowed)
+		return
+	}
+	buffers := []adminBuffer{}
+	for _, oBuffer := range ob.store.List() {
+		size, err := oBuffer.Size()
+		if err != nil {
+			ob.errorf("Error getting size of %s: %v", oBuffer.CurrentName(), err)
+		}
+		quarantined := oBuffer.IsQuarantined()
+		oBuffer.Lock()
+		buffers = append(buffers, adminBuffer{
+			Name:           oBuffer.Name,
+			DisplayName:    oBuffer.DisplayName,
+			Size:           size,
+			Encrypted:      oBuffer.Encrypted,
+			Downloads:      oBuffer.Downloads,
+			DownloadLimit:  oBuffer.DownloadLimit,
+			Quarantined:    quarantined,
+			CreatedAt:      oBuffer.CreatedAt,
+			ExpiresAt:      oBuffer.ExpiresAt,
+			LastAccessedAt: oBuffer.LastAccessedAt,
+		})
+		oBuffer.Unlock()
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(buffers); err != nil {
+		ob.errorf("Error writing to client: %v", err)
+	}
+}
+
+// destroyBuffer wipes the buffer named by a DELETE /buffers/<name> request.
+func (ob *onionbox) destroyBuffer(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		ob.httpError(w, r, "Invalid HTTP Method.", http.StatusMethodNotAllowed)
+		return
+	}
+	oBuffer := ob.store.Get(strings.TrimPrefix(r.URL.Path, "/buffers/"))
+	if oBuffer == nil {
+		ob.httpError(w, r, "File not found", http.StatusNotFound)
+		return
+	}
+	if err := ob.store.Destroy(oBuffer); err != nil {
+		if err == onion_buffer.ErrNotFound {
+			ob.httpError(w, r, "File not found", http.StatusNotFound)
+			return
+		}
+		ob.errorf("Error deleting onion file from store: %v", err)
+		ob.httpError(w, r, "Error deleting file.", http.StatusInternalServerError)
+		return
+	}
+	ob.logf("Destroyed %s through the admin API", oBuffer.CurrentName())
+	w.WriteHeader(http.StatusNoContent)
+}
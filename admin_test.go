@@ -0,0 +1,90 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestAdminRoutes(t *testing.T) {
+	ob := newTestOnionbox(t)
+	ob.adminToken = "admin-token"
+	public, admin := ob.handler(), ob.adminHandler()
+	for _, tc := range []struct {
+		name     string
+		h        http.Handler
+		method   string
+		target   string
+		token    string
+		wantCode int
+	}{
+		{"list on the admin listener", admin, http.MethodGet, "/buffers", "admin-token", http.StatusOK},
+		{"list without token", admin, http.MethodGet, "/buffers", "", http.StatusUnauthorized},
+		{"list with wrong token", admin, http.MethodGet, "/buffers", "guess", http.StatusUnauthorized},
+		{"list on the public listener", public, http.MethodGet, "/buffers", "admin-token", http.StatusNotFound},
+		{"delete on the public listener", public, http.MethodDelete, "/buffers/%s", "admin-token", http.StatusNotFound},
+		{"delete without token", admin, http.MethodDelete, "/buffers/%s", "", http.StatusUnauthorized},
+		{"delete with the wrong method", admin, http.MethodGet, "/buffers/%s", "admin-token", http.StatusMethodNotAllowed},
+		{"delete on the admin listener", admin, http.MethodDelete, "/buffers/%s", "admin-token", http.StatusNoContent},
+		{"delete missing", admin, http.MethodDelete, "/buffers/missing", "admin-token", http.StatusNotFound},
+		{"upload page on the admin listener", admin, http.MethodGet, "/", "admin-token", http.StatusNotFound},
+	} {
+		oBuffer := uploadFiles(t, ob, []testFile{{"a.txt", "hello"}}, nil)
+		r := httptest.NewRequest(tc.method, strings.Replace(tc.target, "%s", oBuffer.Name, 1), nil)
+		if tc.token != "" {
+			r.Header.Set("X-Onionbox-Admin-Token", tc.token)
+		}
+		w := serve(tc.h, r)
+		if w.Code != tc.wantCode {
+			t.Errorf("%s: got %d, want %d", tc.name, w.Code, tc.wantCode)
+		}
+		// Only an authorized delete on the admin listener destroys it
+		if got, want := ob.store.Exists(oBuffer.Name), w.Code != http.StatusNoContent; got != want {
+			t.Errorf("%s: stored %t, want %t", tc.name, got, want)
+		}
+		if tc.target == "/buffers" && w.Code == http.StatusOK {
+			var buffers []adminBuffer
+			if err := json.Unmarshal(w.Body.Bytes(), &buffers); err != nil || len(buffers) == 0 {
+				t.Errorf("%s: listed %d buffers, %v", tc.name, len(buffers), err)
+			}
+		}
+	}
+	// Without a token set nothing gets in
+	ob.adminToken = ""
+	r := httptest.NewRequest(http.MethodGet, "/buffers", nil)
+	r.Header.Set("X-Onionbox-Admin-Token", "")
+	if w := serve(ob.adminHandler(), r); w.Code != http.StatusUnauthorized {
+		t.Errorf("no admin token: got %d, want 401", w.Code)
+	}
+}
+
+func TestLoadAdminToken(t *testing.T) {
+	for _, tc := range []struct {
+		name        string
+		env         string
+		wantCreated bool
+		wantErr     bool
+	}{
+		{"created", "", true, false},
+		{"from the environment", strings.Repeat("t", minAdminTokenLen), false, false},
+		{"too short", "short", false, true},
+	} {
+		t.Setenv(adminTokenEnv, tc.env)
+		ob := newTestOnionbox(t)
+		created, err := ob.loadAdminToken()
+		if (err != nil) != tc.wantErr || created != tc.wantCreated {
+			t.Errorf("%s: got created %t, %v", tc.name, created, err)
+		}
+		if err != nil {
+			continue
+		}
+		if tc.env != "" && ob.adminToken != tc.env {
+			t.Errorf("%s: got token %q, want the environment's", tc.name, ob.adminToken)
+		}
+		if len(ob.adminToken) < minAdminTokenLen {
+			t.Errorf("%s: token %q too short", tc.name, ob.adminToken)
+		}
+	}
+}
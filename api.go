@@ -0,0 +1,344 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"onionbox/onion_buffer"
+)
+
+// api routes requests of the form /api/buffer/<name>/<action>.
+func (ob *onionbox) api(w http.ResponseWriter, r *http.Request) {
+	path := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/buffer/"), "/")
+	parts := strings.Split(path, "/")
+	if len(parts) != 2 {
+		ob.httpError(w, r, "404 page not found", http.StatusNotFound)
+		return
+	}
+	oBuffer := ob.store.Get(parts[0])
+	if oBuffer == nil {
+		ob.httpError(w, r, "File not found", http.StatusNotFound)
+		return
+	}
+	if ob.reapIfExpired(w, r, oBuffer) {
+		return
+	}
+	switch parts[1] {
+	case "append":
+		ob.appendFiles(w, r, oBuffer)
+	case "receipts":
+		ob.listReceipts(w, r, oBuffer)
+	case "manifest":
+		if !ob.refuseQuarantined(w, r, oBuffer) {
+			ob.manifest(w, r, oBuffer)
+		}
+	case "rotate":
+		ob.rotate(w, r, oBuffer)
+	case "verify":
+		if !ob.refuseQuarantined(w, r, oBuffer) {
+			ob.verify(w, r, oBuffer)
+		}
+	case "contents":
+		if !ob.refuseQuarantined(w, r, oBuffer) {
+			ob.contents(w, r, oBuffer)
+		}
+	default:
+		ob.httpError(w, r, "404 page not found", http.StatusNotFound)
+	}
+}
+
+// appendFiles adds the uploaded files to an existing buffer's zip.
+func (ob *onionbox) appendFiles(w http.ResponseWriter, r *http.Request, oBuffer *onion_buffer.OnionBuffer) {
+	if r.Method != http.MethodPost {
+		ob.httpError(w, r, "Invalid HTTP Method.", http.StatusMethodNotAllowed)
+		return
+	}
+	if !validToken(r, oBuffer) {
+		ob.httpError(w, r, "Invalid token.", http.StatusUnauthorized)
+		return
+	}
+	if !oBuffer.Appendable() {
+		ob.httpError(w, r, "Files can only be appended to unencrypted in-memory buffers that have not been downloaded.", http.StatusConflict)
+		return
+	}
+	// Appends are admitted like uploads
+	release, ok := ob.acquireUpload(w, r)
+	if !ok {
+		return
+	}
+	defer release()
+	if !isMultipart(r) {
+		ob.httpError(w, r, fmt.Sprintf(multipartRequired, ob.uploadField), http.StatusUnsupportedMediaType)
+		return
+	}
+	// Cap the size of the request body
+	r.Body = http.MaxBytesReader(w, r.Body, ob.maxMemory<<20)
+	mpReader, err := r.MultipartReader()
+	if err != nil {
+		ob.errorf("Error reading multipart form: %v", err)
+		ob.httpError(w, r, "Malformed upload form.", http.StatusBadRequest)
+		return
+	}
+	// Read the files before taking the buffer's lock, a slow client
+	// mustn't hold it
+	extra := new(bytes.Buffer)
+	// Append copies the files, don't leave them behind
+	defer func() { wipe(extra.Bytes()) }()
+	budget := &budgetWriter{ob: ob, w: extra}
+	defer budget.release()
+	zWriter := zip.NewWriter(budget)
+	form := make(url.Values)
+	if _, err := ob.writeFilesToBuffers(zWriter, mpReader, form); err != nil {
+		if e, ok := err.(badUploadError); ok {
+			ob.httpError(w, r, e.Error(), http.StatusBadRequest)
+			return
+		}
+		if err == errMemBudget {
+			ob.refuseMemBudget(w, r, budget.reserved)
+			return
+		}
+		ob.errorf("Error writing files to zip: %v", err)
+		ob.httpError(w, r, "Error appending files.", http.StatusInternalServerError)
+		return
+	}
+	if err := zWriter.Close(); err != nil {
+		if err == errMemBudget {
+			ob.refuseMemBudget(w, r, budget.reserved)
+			return
+		}
+		ob.errorf("Error closing zip writer: %v", err)
+		ob.httpError(w, r, "Error appending files.", http.StatusInternalServerError)
+		return
+	}
+	// The merged zip is built while the old one is still held
+	size, err := oBuffer.Size()
+	if err != nil {
+		ob.errorf("Error getting size of %s: %v", oBuffer.CurrentName(), err)
+		ob.httpError(w, r, "Error appending files.", http.StatusInternalServerError)
+		return
+	}
+	if !budget.reserve(size) {
+		ob.refuseMemBudget(w, r, size+int64(extra.Len()))
+		return
+	}
+	if err := oBuffer.Append(extra.Bytes(), ob.maxEntries); err != nil {
+		switch err {
+		case onion_buffer.ErrNotAppendable:
+			ob.httpError(w, r, "Files can only be appended to unencrypted in-memory buffers that have not been downloaded.", http.StatusConflict)
+			return
+		case onion_buffer.ErrTooManyEntries:
+			ob.httpError(w, r, fmt.Sprintf("Too many files, at most %d are allowed.", ob.maxEntries), http.StatusBadRequest)
+			return
+		}
+		ob.errorf("Error appending files to %s: %v", oBuffer.CurrentName(), err)
+		ob.httpError(w, r, "Error appending files.", http.StatusInternalServerError)
+		return
+	}
+	ob.signChecksum(oBuffer)
+	if _, err := w.Write([]byte("Files appended.")); err != nil {
+		ob.errorf("Error writing to client: %v", err)
+	}
+}
+
+// listReceipts writes the buffer's download receipts as JSON.
+func (ob *onionbox) listReceipts(w http.ResponseWriter, r *http.Request, oBuffer *onion_buffer.OnionBuffer) {
+	if r.Method != http.MethodGet {
+		ob.httpError(w, r, "Invalid HTTP Method.", http.StatusMethodNotAllowed)
+		return
+	}
+	if !validToken(r, oBuffer) {
+		ob.httpError(w, r, "Invalid token.", http.StatusUnauthorized)
+		return
+	}
+	oBuffer.Lock()
+	receipts := append([]onion_buffer.Receipt{}, oBuffer.Receipts...)
+	oBuffer.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(receipts); err != nil {
+		ob.errorf("Error writing to client: %v", err)
+	}
+}
+
+// manifest writes the chunk offsets and hashes of the served bytes as JSON.
+func (ob *onionbox) manifest(w http.ResponseWriter, r *http.Request, oBuffer *onion_buffer.OnionBuffer) {
+	if r.Method != http.MethodGet {
+		ob.httpError(w, r, "Invalid HTTP Method.", http.StatusMethodNotAllowed)
+		return
+	}
+	// The served bytes of encrypted buffers only exist once decrypted
+	if oBuffer.Encrypted {
+		ob.httpError(w, r, "Manifests aren't available for encrypted buffers.", http.StatusConflict)
+		return
+	}
+	size, err := oBuffer.Size()
+	if err != nil {
+		ob.errorf("Error getting size of %s: %v", oBuffer.CurrentName(), err)
+		ob.httpError(w, r, "Error getting manifest.", http.StatusInternalServerError)
+		return
+	}
+	oBuffer.Lock()
+	chunks := append([]onion_buffer.ChunkHash{}, oBuffer.Manifest...)
+	oBuffer.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(struct {
+		Name      string                   `json:"name"`
+		Size      int64                    `json:"size"`
+		ChunkSize int                      `json:"chunk_size"`
+		Chunks    []onion_buffer.ChunkHash `json:"chunks"`
+	}{oBuffer.CurrentName(), size, onion_buffer.ManifestChunkSize, chunks})
+	if err != nil {
+		ob.errorf("Error writing to client: %v", err)
+	}
+}
+
+// rotate gives the buffer a new random name, the old link stops working.
+func (ob *onionbox) rotate(w http.ResponseWriter, r *http.Request, oBuffer *onion_buffer.OnionBuffer) {
+	if r.Method != http.MethodPost {
+		ob.httpError(w, r, "Invalid HTTP Method.", http.StatusMethodNotAllowed)
+		return
+	}
+	if !validToken(r, oBuffer) {
+		ob.httpError(w, r, "Invalid token.", http.StatusUnauthorized)
+		return
+	}
+	name := ob.newBufferName()
+	if err := ob.store.Rename(oBuffer, name); err != nil {
+		// A burn-after-read link that was read has nothing left to protect
+		if err == onion_buffer.ErrBurned {
+			ob.httpError(w, r, "Burn after read links can only be rotated before they are downloaded.", http.StatusConflict)
+			return
+		}
+		ob.errorf("Error renaming buffer: %v", err)
+		ob.httpError(w, r, "Error rotating link.", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(struct {
+		Name string `json:"name"`
+		URL  string `json:"url"`
+	}{name, ob.shareURL(r, name)})
+	if err != nil {
+		ob.errorf("Error writing to client: %v", err)
+	}
+}
+
+// verify checks the buffer's stored bytes against its checksum without
+// serving them or counting a download. For encrypted buffers that's the
+// ciphertext.
+func (ob *onionbox) verify(w http.ResponseWriter, r *http.Request, oBuffer *onion_buffer.OnionBuffer) {
+	if r.Method != http.MethodGet {
+		ob.httpError(w, r, "Invalid HTTP Method.", http.StatusMethodNotAllowed)
+		return
+	}
+	valid, err := oBuffer.ValidateChecksum()
+	if err != nil {
+		ob.errorf("Error validating checksum: %v", err)
+		ob.httpError(w, r, "Error validating checksum.", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(struct {
+		Valid bool `json:"valid"`
+	}{valid})
+	if err != nil {
+		ob.errorf("Error writing to client: %v", err)
+	}
+}
+
+// contentEntry is a file in a buffer as listed by the contents action.
+type contentEntry struct {
+	Name string `json:"name"`
+	Size uint64 `json:"size"`
+}
+
+// contents lists the names and sizes of the files in the buffer without
+// counting a download. Encrypted buffers need their password in the
+// X-Onionbox-Password header.
+func (ob *onionbox) contents(w http.ResponseWriter, r *http.Request, oBuffer *onion_buffer.OnionBuffer) {
+	if r.Method != http.MethodGet {
+		ob.httpError(w, r, "Invalid HTTP Method.", http.StatusMethodNotAllowed)
+		return
+	}
+	// Keep DestroyAll from wiping the buffer while it's read
+	oBuffer.BeginDownload()
+	defer oBuffer.EndDownload()
+	var entries []contentEntry
+	switch {
+	// Unzipped buffers hold a single file
+	case oBuffer.RawName != "":
+		size, err := oBuffer.Size()
+		if err != nil {
+			ob.errorf("Error getting size of %s: %v", oBuffer.CurrentName(), err)
+			ob.httpError(w, r, "Error listing contents.", http.StatusInternalServerError)
+			return
+		}
+		entries = append(entries, contentEntry{oBuffer.RawName, uint64(size)})
+	default:
+		var plain *onion_buffer.DecryptReader
+		if oBuffer.Encrypted {
+			if oBuffer.IsLocked() {
+				ob.errorf("Too many failed password attempts for %s", oBuffer.CurrentName())
+				ob.httpError(w, r, "Too many failed attempts, please try again later.", http.StatusTooManyRequests)
+				return
+			}
+			pass := r.Header.Get("X-Onionbox-Password")
+			if len(pass) > ob.maxPassLen {
+				ob.httpError(w, r, fmt.Sprintf("Password too long, at most %d bytes are allowed.", ob.maxPassLen), http.StatusBadRequest)
+				return
+			}
+			var err error
+			plain, err = oBuffer.NewDecryptReader(pass)
+			if err == onion_buffer.ErrSizeMismatch {
+				ob.errorf("Error decrypting buffer: %v", err)
+				ob.httpError(w, r, "Error listing contents.", http.StatusInternalServerError)
+				return
+			}
+			if err != nil {
+				oBuffer.FailedAttempt(ob.maxAttempts)
+				ob.errorf("Error decrypting buffer: %v", err)
+				ob.httpError(w, r, "Invalid password.", http.StatusUnauthorized)
+				return
+			}
+			oBuffer.ResetAttempts()
+			// Only the segments holding the zip's directory are decrypted
+			defer plain.Close()
+		}
+		zReader, closeZip, err := openZip(oBuffer, plain)
+		if err != nil {
+			ob.errorf("Error opening zip of %s: %v", oBuffer.CurrentName(), err)
+			ob.httpError(w, r, "Error listing contents.", http.StatusInternalServerError)
+			return
+		}
+		defer closeZip()
+		for _, f := range zReader.File {
+			entries = append(entries, contentEntry{f.Name, f.UncompressedSize64})
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(struct {
+		Name    string         `json:"name"`
+		Entries []contentEntry `json:"entries"`
+	}{oBuffer.CurrentName(), entries})
+	if err != nil {
+		ob.errorf("Error writing to client: %v", err)
+	}
+}
+
+// validToken reports whether the request carries the buffer's owner token,
+// either in the X-Onionbox-Token header or the token query parameter.
+func validToken(r *http.Request, oBuffer *onion_buffer.OnionBuffer) bool {
+	token := r.Header.Get("X-Onionbox-Token")
+	if token == "" {
+		token = r.URL.Query().Get("token")
+	}
+	if token == "" || oBuffer.Token == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(token), []byte(oBuffer.Token)) == 1
+}
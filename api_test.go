@@ -0,0 +1,305 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"onionbox/onion_buffer"
+)
+
+// newAppendRequest builds an append of files to the named buffer.
+func newAppendRequest(t *testing.T, name, token string, files []testFile) *http.Request {
+	t.Helper()
+	r := newUploadRequest(t, "files", files, nil)
+	r.URL.Path = "/api/buffer/" + name + "/append"
+	r.Header.Set("X-Onionbox-Token", token)
+	return r
+}
+
+func TestAppend(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		form      map[string]string
+		download  bool
+		badToken  bool
+		files     int
+		wantCode  int
+		wantFiles int
+	}{
+		{"append", nil, false, false, 1, http.StatusOK, 2},
+		{"invalid token", nil, false, true, 1, http.StatusUnauthorized, 1},
+		{"downloaded", nil, true, false, 1, http.StatusConflict, 1},
+		{"encrypted", map[string]string{"password_enabled": "on", "password": "secret"}, false, false, 1, http.StatusConflict, 1},
+		{"too many files", nil, false, false, 3, http.StatusBadRequest, 1},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ob := newTestOnionbox(t)
+			ob.maxEntries = 3
+			oBuffer := uploadFiles(t, ob, []testFile{{"a.txt", "hello"}}, tc.form)
+			h := ob.handler()
+			if tc.download {
+				request(h, http.MethodGet, "/"+oBuffer.Name)
+			}
+			token := oBuffer.Token
+			if tc.badToken {
+				token = "0123456789abcdef0123456789abcdef"
+			}
+			files := []testFile{{"b.txt", "world"}, {"c.txt", "!"}, {"d.txt", "?"}}[:tc.files]
+			if w := serve(h, newAppendRequest(t, oBuffer.Name, token, files)); w.Code != tc.wantCode {
+				t.Fatalf("got %d, want %d: %s", w.Code, tc.wantCode, w.Body)
+			}
+			if oBuffer.Encrypted {
+				return
+			}
+			if valid, err := oBuffer.ValidateChecksum(); err != nil || !valid {
+				t.Errorf("checksum doesn't match the zip: %v", err)
+			}
+			oBuffer.Lock()
+			got := unzip(t, oBuffer.Bytes)
+			oBuffer.Unlock()
+			if len(got) != tc.wantFiles || got["a.txt"] != "hello" {
+				t.Errorf("got %v, want %d files", got, tc.wantFiles)
+			}
+			if tc.wantFiles == 2 && got["b.txt"] != "world" {
+				t.Errorf("appended b.txt holds %q", got["b.txt"])
+			}
+		})
+	}
+}
+
+func TestReceipts(t *testing.T) {
+	ob := newTestOnionbox(t)
+	ob.receipts = true
+	ob.receiptKey = []byte("0123456789abcdef0123456789abcdef")
+	oBuffer := uploadFiles(t, ob, []testFile{{"a.txt", "hello"}}, nil)
+	h := ob.handler()
+	for i := 0; i < 3; i++ {
+		request(h, http.MethodGet, "/"+oBuffer.Name)
+	}
+	target := "/api/buffer/" + oBuffer.Name + "/receipts"
+	if w := request(h, http.MethodGet, target); w.Code != http.StatusUnauthorized {
+		t.Errorf("without token: got %d, want 401", w.Code)
+	}
+	w := request(h, http.MethodGet, target+"?token="+oBuffer.Token)
+	if w.Code != http.StatusOK {
+		t.Fatalf("got %d: %s", w.Code, w.Body)
+	}
+	var receipts []onion_buffer.Receipt
+	if err := json.Unmarshal(w.Body.Bytes(), &receipts); err != nil {
+		t.Fatal(err)
+	}
+	// One receipt per download, each signed with the server key
+	if len(receipts) != 3 {
+		t.Fatalf("got %d receipts, want 3", len(receipts))
+	}
+	for i, rc := range receipts {
+		if rc.Index != i+1 || rc.Name != oBuffer.Name {
+			t.Errorf("receipt %d is %+v", i, rc)
+		}
+		if !rc.Verify(ob.receiptKey) {
+			t.Errorf("receipt %d doesn't verify", i)
+		}
+	}
+}
+
+func TestManifest(t *testing.T) {
+	ob := newTestOnionbox(t)
+	ob.noZipSingle = true
+	h := ob.handler()
+	for _, tc := range []struct {
+		name       string
+		form       map[string]string
+		size       int
+		wantCode   int
+		wantChunks int
+	}{
+		{"small", nil, 10, http.StatusOK, 1},
+		{"several chunks", nil, 2*onion_buffer.ManifestChunkSize + 100, http.StatusOK, 3},
+		{"encrypted", map[string]string{"password_enabled": "on", "password": "secret"}, 10, http.StatusConflict, 0},
+	} {
+		oBuffer := uploadFiles(t, ob, []testFile{{"a.bin", randomContent(t, tc.size)}}, tc.form)
+		w := request(h, http.MethodGet, "/api/buffer/"+oBuffer.Name+"/manifest?token="+oBuffer.Token)
+		if w.Code != tc.wantCode {
+			t.Fatalf("%s: got %d, want %d: %s", tc.name, w.Code, tc.wantCode, w.Body)
+		}
+		if w.Code != http.StatusOK {
+			continue
+		}
+		var manifest struct {
+			Size      int64                    `json:"size"`
+			ChunkSize int                      `json:"chunk_size"`
+			Chunks    []onion_buffer.ChunkHash `json:"chunks"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &manifest); err != nil {
+			t.Fatal(err)
+		}
+		if len(manifest.Chunks) != tc.wantChunks {
+			t.Fatalf("%s: got %d chunks, want %d", tc.name, len(manifest.Chunks), tc.wantChunks)
+		}
+		// The chunks cover the download back to back, each matching its hash
+		served := request(h, http.MethodGet, "/"+oBuffer.Name).Body.Bytes()
+		if manifest.Size != int64(len(served)) {
+			t.Errorf("%s: manifest size %d, served %d bytes", tc.name, manifest.Size, len(served))
+		}
+		var offset int64
+		for _, c := range manifest.Chunks {
+			if c.Offset != offset || c.Offset+int64(c.Size) > int64(len(served)) {
+				t.Fatalf("%s: chunk at %d of %d bytes doesn't fit the download", tc.name, c.Offset, c.Size)
+			}
+			sum := sha256.Sum256(served[c.Offset : c.Offset+int64(c.Size)])
+			if hex.EncodeToString(sum[:]) != c.SHA256 {
+				t.Errorf("%s: chunk at %d doesn't match the download", tc.name, c.Offset)
+			}
+			offset += int64(c.Size)
+		}
+		if offset != manifest.Size {
+			t.Errorf("%s: chunks cover %d of %d bytes", tc.name, offset, manifest.Size)
+		}
+	}
+}
+
+func TestRotate(t *testing.T) {
+	burn := map[string]string{"limit_downloads": "on", "download_limit": "1"}
+	for _, tc := range []struct {
+		name     string
+		form     map[string]string
+		method   string
+		badToken bool
+		download bool
+		wantCode int
+	}{
+		{"rotate", nil, http.MethodPost, false, false, http.StatusOK},
+		{"rotate after download", nil, http.MethodPost, false, true, http.StatusOK},
+		{"burn after read", burn, http.MethodPost, false, false, http.StatusOK},
+		{"burn after read downloaded", burn, http.MethodPost, false, true, http.StatusConflict},
+		{"invalid token", nil, http.MethodPost, true, false, http.StatusUnauthorized},
+		{"GET", nil, http.MethodGet, false, false, http.StatusMethodNotAllowed},
+	} {
+		ob := newTestOnionbox(t)
+		h := ob.handler()
+		oBuffer := uploadFiles(t, ob, []testFile{{"a.txt", "hello"}}, tc.form)
+		oldName := oBuffer.Name
+		if tc.download {
+			request(h, http.MethodGet, "/"+oldName)
+		}
+		token := oBuffer.Token
+		if tc.badToken {
+			token = "invalid"
+		}
+		w := request(h, tc.method, "/api/buffer/"+oldName+"/rotate?token="+token)
+		if w.Code != tc.wantCode {
+			t.Errorf("%s: got %d, want %d: %s", tc.name, w.Code, tc.wantCode, w.Body)
+			continue
+		}
+		if w.Code != http.StatusOK {
+			continue
+		}
+		var result struct {
+			Name string `json:"name"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &result); err != nil {
+			t.Fatal(err)
+		}
+		if result.Name == oldName {
+			t.Fatalf("%s: name wasn't changed", tc.name)
+		}
+		if w := request(h, http.MethodGet, "/"+oldName); w.Code != http.StatusGone {
+			t.Errorf("%s: old name got %d, want 410", tc.name, w.Code)
+		}
+		if w := request(h, http.MethodGet, "/"+result.Name); unzip(t, w.Body.Bytes())["a.txt"] != "hello" {
+			t.Errorf("%s: new name got %d without the uploaded bytes", tc.name, w.Code)
+		}
+	}
+}
+
+func TestVerify(t *testing.T) {
+	encrypted := map[string]string{"password_enabled": "on", "password": "secret"}
+	for _, tc := range []struct {
+		name      string
+		form      map[string]string
+		tamper    bool
+		wantValid bool
+	}{
+		{"valid", nil, false, true},
+		{"tampered", nil, true, false},
+		{"valid encrypted", encrypted, false, true},
+		{"tampered encrypted", encrypted, true, false},
+	} {
+		ob := newTestOnionbox(t)
+		oBuffer := uploadFiles(t, ob, []testFile{{"a.txt", "hello"}}, tc.form)
+		if tc.tamper {
+			oBuffer.Lock()
+			oBuffer.Bytes[len(oBuffer.Bytes)/2] ^= 0xff
+			oBuffer.Unlock()
+		}
+		w := request(ob.handler(), http.MethodGet, "/api/buffer/"+oBuffer.Name+"/verify")
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: got %d: %s", tc.name, w.Code, w.Body)
+		}
+		var result struct {
+			Valid bool `json:"valid"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &result); err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		if result.Valid != tc.wantValid {
+			t.Errorf("%s: got valid %t, want %t", tc.name, result.Valid, tc.wantValid)
+		}
+		if n := oBuffer.DownloadCount(); n != 0 {
+			t.Errorf("%s: verifying counted %d downloads", tc.name, n)
+		}
+	}
+}
+
+func TestContents(t *testing.T) {
+	ob := newTestOnionbox(t)
+	h := ob.handler()
+	files := []testFile{{"a.txt", "hello"}, {"b.txt", "hello world"}}
+	encrypted := map[string]string{"password_enabled": "on", "password": "secret"}
+	for _, tc := range []struct {
+		name     string
+		form     map[string]string
+		pass     string
+		wantCode int
+	}{
+		{"plain", nil, "", http.StatusOK},
+		{"encrypted", encrypted, "secret", http.StatusOK},
+		{"wrong password", encrypted, "wrong", http.StatusUnauthorized},
+		{"no password", encrypted, "", http.StatusUnauthorized},
+	} {
+		oBuffer := uploadFiles(t, ob, files, tc.form)
+		r := httptest.NewRequest(http.MethodGet, "/api/buffer/"+oBuffer.Name+"/contents", nil)
+		if tc.pass != "" {
+			r.Header.Set("X-Onionbox-Password", tc.pass)
+		}
+		w := serve(h, r)
+		if w.Code != tc.wantCode {
+			t.Fatalf("%s: got %d, want %d: %s", tc.name, w.Code, tc.wantCode, w.Body)
+		}
+		if oBuffer.DownloadCount() != 0 {
+			t.Errorf("%s: listing counted as a download", tc.name)
+		}
+		if w.Code != http.StatusOK {
+			continue
+		}
+		var contents struct {
+			Name    string         `json:"name"`
+			Entries []contentEntry `json:"entries"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &contents); err != nil {
+			t.Fatal(err)
+		}
+		if len(contents.Entries) != len(files) {
+			t.Fatalf("%s: got %d entries, want %d", tc.name, len(contents.Entries), len(files))
+		}
+		for i, f := range files {
+			if want := (contentEntry{f.name, uint64(len(f.content))}); contents.Entries[i] != want {
+				t.Errorf("%s: got entry %+v, want %+v", tc.name, contents.Entries[i], want)
+			}
+		}
+	}
+}
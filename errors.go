@@ -0,0 +1,55 @@
+package main
+
+import (
+	"encoding/json"
+	"html/template"
+	"net/http"
+	"strings"
+
+	"onionbox/templates"
+)
+
+// httpError replies to the request with the error message and HTTP code.
+// Clients that accept JSON get a JSON body, browsers get an error page in
+// their language or -default-lang and everyone else gets plain text.
+func (ob *onionbox) httpError(w http.ResponseWriter, r *http.Request, msg string, code int) {
+	switch {
+	case wantsJSON(r):
+		// Errors aren't downloads, whatever was set before
+		w.Header().Del("Content-Disposition")
+		w.Header().Del("Content-Length")
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		w.WriteHeader(code)
+		_ = json.NewEncoder(w).Encode(struct {
+			Error  string `json:"error"`
+			Status int    `json:"status"`
+		}{msg, code})
+	case wantsHTML(r):
+		t, err := template.New("error").Parse(templates.ErrorHTML)
+		if err != nil {
+			http.Error(w, msg, code)
+			return
+		}
+		w.Header().Del("Content-Disposition")
+		w.Header().Del("Content-Length")
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		w.WriteHeader(code)
+		_ = t.Execute(w, templates.Page{
+			Msg:    templates.Lookup(r.Header.Get("Accept-Language"), ob.defaultLang),
+			Status: code,
+			Error:  msg,
+		})
+	default:
+		http.Error(w, msg, code)
+	}
+}
+
+func wantsJSON(r *http.Request) bool {
+	return strings.Contains(r.Header.Get("Accept"), "application/json")
+}
+
+func wantsHTML(r *http.Request) bool {
+	return strings.Contains(r.Header.Get("Accept"), "text/html")
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestHTTPError(t *testing.T) {
+	ob := newTestOnionbox(t)
+	for _, tc := range []struct {
+		accept   string
+		wantType string
+	}{
+		{"application/json", "application/json"},
+		{"text/html,application/xhtml+xml", "text/html"},
+		{"", "text/plain"},
+	} {
+		r := httptest.NewRequest(http.MethodGet, "/nosuchbuffer", nil)
+		r.Header.Set("Accept", tc.accept)
+		w := serve(ob.handler(), r)
+		if w.Code != http.StatusNotFound {
+			t.Fatalf("Accept %q: got %d, want 404", tc.accept, w.Code)
+		}
+		if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, tc.wantType) {
+			t.Errorf("Accept %q: got Content-Type %q, want %q", tc.accept, ct, tc.wantType)
+		}
+		// Browsers get a page with the status and a way back to uploading
+		if tc.wantType == "text/html" {
+			for _, want := range []string{"<h2>Error 404</h2>", "<p>File not found</p>", `<a href="/">`} {
+				if !strings.Contains(w.Body.String(), want) {
+					t.Errorf("%q not in error page: %s", want, w.Body)
+				}
+			}
+		}
+		if tc.wantType != "application/json" {
+			continue
+		}
+		var body struct {
+			Error  string `json:"error"`
+			Status int    `json:"status"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+			t.Fatalf("decoding %s: %v", w.Body, err)
+		}
+		if body.Error != "File not found" || body.Status != http.StatusNotFound {
+			t.Errorf("got %+v", body)
+		}
+	}
+}
+
+func TestHTTPErrorHeaders(t *testing.T) {
+	for _, tc := range []struct {
+		accept      string
+		defaultLang string
+		wantBody    string
+	}{
+		{"application/json", "en", `"status":404`},
+		{"text/html", "en", `<html lang="en">`},
+		{"text/html", "es", `<html lang="es">`},
+	} {
+		ob := newTestOnionbox(t)
+		ob.defaultLang = tc.defaultLang
+		r := httptest.NewRequest(http.MethodGet, "/nosuchbuffer", nil)
+		r.Header.Set("Accept", tc.accept)
+		w := httptest.NewRecorder()
+		// Left over from a download that failed before writing
+		w.Header().Set("Content-Disposition", `attachment; filename="a.zip"`)
+		w.Header().Set("Content-Length", "1234")
+		ob.httpError(w, r, "File not found", http.StatusNotFound)
+		for _, header := range []string{"Content-Disposition", "Content-Length"} {
+			if got := w.Header().Get(header); got != "" {
+				t.Errorf("%s in %s: %s kept as %q", tc.accept, tc.defaultLang, header, got)
+			}
+		}
+		if !strings.Contains(w.Body.String(), tc.wantBody) {
+			t.Errorf("%s in %s: %q not in %s", tc.accept, tc.defaultLang, tc.wantBody, w.Body)
+		}
+	}
+}
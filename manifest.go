@@ -0,0 +1,65 @@
+package main
+
+import (
+	"archive/zip"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// zipManifestName is the name of the manifest entry added with
+// -include-manifest, a number is added if an uploaded file has it.
+const zipManifestName = "onionbox-manifest"
+
+// zipEntry describes a file written to an upload's zip.
+type zipEntry struct {
+	Name string
+	Size int64
+	// SHA256 is only set with -include-manifest
+	SHA256 string
+}
+
+// writeZipManifest adds a text entry listing the uploaded files, their
+// sizes and hashes and when the upload expires. With normalize it's dated
+// zipEpoch like the files and doesn't tell when the upload happened.
+func writeZipManifest(zWriter *zip.Writer, entries []zipEntry, form url.Values, normalize bool) error {
+	taken := make(map[string]bool, len(entries))
+	for _, entry := range entries {
+		taken[entry.Name] = true
+	}
+	name := zipManifestName + ".txt"
+	for i := 1; taken[name]; i++ {
+		name = fmt.Sprintf("%s-%d.txt", zipManifestName, i)
+	}
+	var b strings.Builder
+	now := time.Now().UTC()
+	modified := now
+	if normalize {
+		modified = zipEpoch
+	} else {
+		fmt.Fprintf(&b, "Uploaded: %s\n", now.Format(time.RFC1123))
+	}
+	expires := "never"
+	if form.Get("expire") == "on" {
+		if t, err := time.ParseDuration(form.Get("expiration_time") + "m"); err == nil {
+			expires = now.Add(t).Format(time.RFC1123)
+			if normalize {
+				expires = fmt.Sprintf("%v after the upload", t)
+			}
+			if form.Get("expire_after_download") == "on" {
+				expires = fmt.Sprintf("%v after the first download", t)
+			}
+		}
+	}
+	fmt.Fprintf(&b, "Expires: %s\n\n", expires)
+	for _, entry := range entries {
+		fmt.Fprintf(&b, "%s  %12d  %s\n", entry.SHA256, entry.Size, entry.Name)
+	}
+	w, err := zWriter.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Deflate, Modified: modified})
+	if err != nil {
+		return err
+	}
+	_, err = w.Write([]byte(b.String()))
+	return err
+}
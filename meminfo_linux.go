@@ -0,0 +1,14 @@
+package main
+
+import (
+	"syscall"
+)
+
+// physicalMemory returns the total RAM of the host in bytes.
+func physicalMemory() uint64 {
+	var info syscall.Sysinfo_t
+	if err := syscall.Sysinfo(&info); err != nil {
+		return 0
+	}
+	return uint64(info.Totalram) * uint64(info.Unit)
+}
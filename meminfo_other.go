@@ -0,0 +1,9 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+// physicalMemory returns 0 where the host's RAM can't be determined.
+func physicalMemory() uint64 {
+	return 0
+}
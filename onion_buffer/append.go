@@ -0,0 +1,90 @@
+package onion_buffer
+
+import (
+	"archive/zip"
+	"bytes"
+	"errors"
+	"io"
+	"syscall"
+)
+
+// ErrNotAppendable is returned by Append for buffers whose zip can't be
+// appended to: encrypted, on disk, unzipped or already downloaded ones.
+var ErrNotAppendable = errors.New("files can only be appended to unencrypted in-memory buffers that have not been downloaded")
+
+// ErrTooManyEntries is returned by Append when the appended zip would hold
+// more than the allowed number of entries.
+var ErrTooManyEntries = errors.New("too many files")
+
+// Append adds the entries of the zip in extra to the buffer's zip, keeping
+// at most maxEntries entries if maxEntries is positive. extra is built by
+// the caller beforehand so the lock is only held while the zips are merged,
+// never while a client uploads. Downloads never see a partially written zip.
+func (of *OnionBuffer) Append(extra []byte, maxEntries int) error {
+	xReader, err := zip.NewReader(bytes.NewReader(extra), int64(len(extra)))
+	if err != nil {
+		return err
+	}
+	of.Lock()
+	defer of.Unlock()
+	if !of.appendable() {
+		return ErrNotAppendable
+	}
+	zReader, err := zip.NewReader(bytes.NewReader(of.Bytes), int64(len(of.Bytes)))
+	if err != nil {
+		return err
+	}
+	if maxEntries > 0 && len(zReader.File)+len(xReader.File) > maxEntries {
+		return ErrTooManyEntries
+	}
+	buffer := new(bytes.Buffer)
+	zWriter := zip.NewWriter(buffer)
+	// Copy the existing entries, then the new ones, without recompressing
+	for _, f := range append(zReader.File, xReader.File...) {
+		if err := copyRaw(zWriter, f); err != nil {
+			wipe(buffer.Bytes())
+			return err
+		}
+	}
+	if err := zWriter.Close(); err != nil {
+		wipe(buffer.Bytes())
+		return err
+	}
+	chksm, err := checksum(bytes.NewReader(buffer.Bytes()))
+	if err != nil {
+		wipe(buffer.Bytes())
+		return err
+	}
+	manifest, err := buildManifest(bytes.NewReader(buffer.Bytes()))
+	if err != nil {
+		wipe(buffer.Bytes())
+		return err
+	}
+	// Lock the new bytes before swapping them in, then wipe the old ones
+	// before handing their memory back
+	if err := syscall.Mlock(buffer.Bytes()); err != nil {
+		wipe(buffer.Bytes())
+		return err
+	}
+	old := of.Bytes
+	of.Bytes = buffer.Bytes()
+	of.Checksum = chksm
+	of.Manifest = manifest
+	wipe(old)
+	return syscall.Munlock(old)
+}
+
+// copyRaw copies the zip entry f to zWriter as is.
+func copyRaw(zWriter *zip.Writer, f *zip.File) error {
+	src, err := f.OpenRaw()
+	if err != nil {
+		return err
+	}
+	header := f.FileHeader
+	dst, err := zWriter.CreateRaw(&header)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(dst, src)
+	return err
+}
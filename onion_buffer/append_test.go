@@ -0,0 +1,87 @@
+package onion_buffer
+
+import (
+	"archive/zip"
+	"bytes"
+	"testing"
+)
+
+// testZip returns a zip of the named files, each holding its name.
+func testZip(t *testing.T, names ...string) []byte {
+	t.Helper()
+	buffer := new(bytes.Buffer)
+	zWriter := zip.NewWriter(buffer)
+	for _, name := range names {
+		w, err := zWriter.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write([]byte(name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := zWriter.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buffer.Bytes()
+}
+
+// zipNames returns the names of the entries of the zip in b.
+func zipNames(t *testing.T, b []byte) []string {
+	t.Helper()
+	zReader, err := zip.NewReader(bytes.NewReader(b), int64(len(b)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, f := range zReader.File {
+		names = append(names, f.Name)
+	}
+	return names
+}
+
+func TestAppend(t *testing.T) {
+	for _, tc := range []struct {
+		name       string
+		of         *OnionBuffer
+		maxEntries int
+		wantErr    error
+		wantNames  []string
+	}{
+		{"append", &OnionBuffer{}, 0, nil, []string{"a", "b", "c"}},
+		{"within the cap", &OnionBuffer{}, 3, nil, []string{"a", "b", "c"}},
+		{"over the cap", &OnionBuffer{}, 2, ErrTooManyEntries, []string{"a"}},
+		{"downloaded", &OnionBuffer{Downloads: 1}, 0, ErrNotAppendable, []string{"a"}},
+		{"encrypted", &OnionBuffer{Encrypted: true}, 0, ErrNotAppendable, []string{"a"}},
+		{"unzipped", &OnionBuffer{RawName: "a"}, 0, ErrNotAppendable, []string{"a"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			of := tc.of
+			of.Bytes = testZip(t, "a")
+			chksm, err := of.GetChecksum()
+			if err != nil {
+				t.Fatal(err)
+			}
+			of.Checksum = chksm
+			if err := of.Append(testZip(t, "b", "c"), tc.maxEntries); err != tc.wantErr {
+				t.Fatalf("got %v, want %v", err, tc.wantErr)
+			}
+			names := zipNames(t, of.Bytes)
+			if len(names) != len(tc.wantNames) {
+				t.Fatalf("got entries %v, want %v", names, tc.wantNames)
+			}
+			for i, name := range names {
+				if name != tc.wantNames[i] {
+					t.Errorf("got entries %v, want %v", names, tc.wantNames)
+				}
+			}
+			if valid, err := of.ValidateChecksum(); err != nil || !valid {
+				t.Errorf("checksum doesn't match the zip: %v", err)
+			}
+			// The manifest covers the appended zip
+			if tc.wantErr == nil && (len(of.Manifest) != 1 || int(of.Manifest[0].Size) != len(of.Bytes)) {
+				t.Errorf("manifest %v doesn't cover the %d byte zip", of.Manifest, len(of.Bytes))
+			}
+		})
+	}
+}
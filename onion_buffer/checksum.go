@@ -4,8 +4,10 @@ import (
 	"bufio"
 	"bytes"
 	"crypto/md5"
+	"crypto/subtle"
 	"encoding/hex"
 	"io"
+	"os"
 	"syscall"
 )
 
@@ -13,10 +15,24 @@ const chunkSize = 1024
 
 func (of *OnionBuffer) GetChecksum() (string, error) {
 	of.Lock()
+	defer of.Unlock()
+	if of.Path != "" {
+		f, err := os.Open(of.Path)
+		if err != nil {
+			return "", err
+		}
+		defer f.Close()
+		return checksum(f)
+	}
+	return checksum(bytes.NewReader(of.Bytes))
+}
+
+// checksum hashes src by chunk. Callers must hold the buffer's lock.
+func checksum(src io.Reader) (string, error) {
 	var count int
 	var err error
 	hash := md5.New()
-	reader := bufio.NewReader(bytes.NewReader(of.Bytes))
+	reader := bufio.NewReader(src)
 	chunk := make([]byte, chunkSize)
 	// Lock memory allotted to chunk from being used in SWAP
 	if err := syscall.Mlock(chunk); err != nil {
@@ -33,10 +49,7 @@ func (of *OnionBuffer) GetChecksum() (string, error) {
 	}
 	if err != io.EOF {
 		return "", err
-	} else {
-		err = nil
 	}
-	of.Unlock()
 	hashInBytes := hash.Sum(nil)[:16]
 	return hex.EncodeToString(hashInBytes), nil
 }
@@ -46,7 +59,8 @@ func (of *OnionBuffer) ValidateChecksum() (bool, error) {
 	if err != nil {
 		return false, err
 	}
-	if of.Checksum == chksm {
+	// Compare in constant time to avoid leaking timing information
+	if subtle.ConstantTimeCompare([]byte(of.Checksum), []byte(chksm)) == 1 {
 		return true, nil
 	}
 	return false, nil
@@ -0,0 +1,57 @@
+package onion_buffer
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"fmt"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// Cipher identifies the AEAD an encrypted buffer is sealed with.
+type Cipher byte
+
+const (
+	// AESGCM is the default, fastest on CPUs with AES instructions
+	AESGCM Cipher = iota
+	// ChaCha20Poly1305 is faster on CPUs without them, like many ARM boards
+	ChaCha20Poly1305
+)
+
+var cipherNames = map[Cipher]string{
+	AESGCM:           "aes-gcm",
+	ChaCha20Poly1305: "chacha20-poly1305",
+}
+
+func (c Cipher) String() string {
+	if name, ok := cipherNames[c]; ok {
+		return name
+	}
+	return fmt.Sprintf("cipher(%d)", byte(c))
+}
+
+// ParseCipher returns the cipher called name, as listed by -cipher.
+func ParseCipher(name string) (Cipher, error) {
+	for c, n := range cipherNames {
+		if n == name {
+			return c, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown cipher %q, use aes-gcm or chacha20-poly1305", name)
+}
+
+// newAEAD returns cipher c keyed with the passphrase.
+func newAEAD(c Cipher, passphrase string) (cipher.AEAD, error) {
+	key := []byte(createHash(passphrase))
+	switch c {
+	case AESGCM:
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, err
+		}
+		return cipher.NewGCM(block)
+	case ChaCha20Poly1305:
+		return chacha20poly1305.New(key)
+	}
+	return nil, fmt.Errorf("unknown %v", c)
+}
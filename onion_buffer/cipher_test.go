@@ -0,0 +1,60 @@
+package onion_buffer
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestCiphers(t *testing.T) {
+	data := randomBytes(t, 2*SegmentSize+7)
+	for _, tc := range []struct {
+		cipher Cipher
+		other  Cipher
+	}{
+		{AESGCM, ChaCha20Poly1305},
+		{ChaCha20Poly1305, AESGCM},
+	} {
+		ciphertext, err := Encrypt(data, "secret", tc.cipher)
+		if err != nil {
+			t.Fatalf("%v: %v", tc.cipher, err)
+		}
+		plaintext, err := Decrypt(ciphertext, "secret", tc.cipher)
+		if err != nil || !bytes.Equal(plaintext, data) {
+			t.Errorf("%v: round trip failed: %v", tc.cipher, err)
+		}
+		// Buffers decrypt with the cipher they were sealed with
+		oBuffer := &OnionBuffer{Bytes: ciphertext, Encrypted: true, PlainSize: int64(len(data)), Cipher: tc.cipher}
+		if plaintext, err := oBuffer.Decrypt("secret"); err != nil || !bytes.Equal(plaintext, data) {
+			t.Errorf("%v: buffer round trip failed: %v", tc.cipher, err)
+		}
+		if _, err := Decrypt(ciphertext, "secret", tc.other); err == nil {
+			t.Errorf("%v ciphertext decrypted with %v", tc.cipher, tc.other)
+		}
+		oBuffer.Cipher = tc.other
+		if _, err := oBuffer.Decrypt("secret"); err == nil {
+			t.Errorf("%v buffer decrypted with %v", tc.cipher, tc.other)
+		}
+	}
+}
+
+func TestParseCipher(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		want    Cipher
+		wantErr bool
+	}{
+		{"aes-gcm", AESGCM, false},
+		{"chacha20-poly1305", ChaCha20Poly1305, false},
+		{"AES-GCM", 0, true},
+		{"rot13", 0, true},
+		{"", 0, true},
+	} {
+		c, err := ParseCipher(tc.name)
+		if (err != nil) != tc.wantErr {
+			t.Fatalf("%q: got %v, want error %t", tc.name, err, tc.wantErr)
+		}
+		if err == nil && (c != tc.want || c.String() != tc.name) {
+			t.Errorf("%q: got %v, want %v", tc.name, c, tc.want)
+		}
+	}
+}
@@ -0,0 +1,42 @@
+package onion_buffer
+
+import (
+	"bytes"
+	"compress/gzip"
+	"syscall"
+)
+
+// Compress gzips the in-memory bytes if that makes them smaller. WriteTo
+// and Size keep dealing in the uncompressed bytes. The checksum must be
+// recomputed afterwards since it covers the stored bytes.
+func (of *OnionBuffer) Compress() error {
+	of.Lock()
+	defer of.Unlock()
+	var compressed bytes.Buffer
+	gzWriter, err := gzip.NewWriterLevel(&compressed, gzip.BestCompression)
+	if err != nil {
+		return err
+	}
+	if _, err := gzWriter.Write(of.Bytes); err != nil {
+		return err
+	}
+	if err := gzWriter.Close(); err != nil {
+		return err
+	}
+	// Already compressed content only gets bigger
+	if compressed.Len() >= len(of.Bytes) {
+		wipe(compressed.Bytes())
+		return nil
+	}
+	// Keep the compressed bytes out of swap like the ones they replace
+	if err := syscall.Mlock(compressed.Bytes()); err != nil {
+		wipe(compressed.Bytes())
+		return err
+	}
+	old := of.Bytes
+	of.RawSize = int64(len(old))
+	of.Bytes = compressed.Bytes()
+	of.Compressed = true
+	wipe(old)
+	return syscall.Munlock(old)
+}
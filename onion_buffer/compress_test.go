@@ -0,0 +1,43 @@
+package onion_buffer
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestCompress(t *testing.T) {
+	for _, tc := range []struct {
+		name           string
+		data           []byte
+		wantCompressed bool
+	}{
+		{"text", []byte(strings.Repeat("the quick brown fox jumps over the lazy dog\n", 1000)), true},
+		{"random", randomBytes(t, 4096), false},
+		{"empty", []byte{}, false},
+	} {
+		data := append([]byte(nil), tc.data...)
+		oBuffer := &OnionBuffer{Name: "a", Bytes: data}
+		if err := oBuffer.Compress(); err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		if oBuffer.Compressed != tc.wantCompressed {
+			t.Errorf("%s: got compressed %t, want %t", tc.name, oBuffer.Compressed, tc.wantCompressed)
+		}
+		if tc.wantCompressed && len(oBuffer.Bytes) >= len(tc.data) {
+			t.Errorf("%s: stored %d bytes for %d", tc.name, len(oBuffer.Bytes), len(tc.data))
+		}
+		// Downloads and sizes see the original bytes either way
+		size, err := oBuffer.Size()
+		if err != nil || size != int64(len(tc.data)) {
+			t.Errorf("%s: got size %d, %v, want %d", tc.name, size, err, len(tc.data))
+		}
+		var served bytes.Buffer
+		if _, err := oBuffer.WriteTo(&served); err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		if !bytes.Equal(served.Bytes(), tc.data) {
+			t.Errorf("%s: served bytes don't match the original", tc.name)
+		}
+	}
+}
@@ -1,25 +1,267 @@
 package onion_buffer
 
 import (
-	"crypto/aes"
+	"bytes"
 	"crypto/cipher"
+	"errors"
+	"io"
+	"sync"
+	"syscall"
 )
 
-func Decrypt(data []byte, passphrase string) ([]byte, error) {
-	key := []byte(createHash(passphrase))
-	block, err := aes.NewCipher(key)
-	if err != nil {
+// gcmOverhead is the size of the tag sealed onto every segment.
+const gcmOverhead = 16
+
+var errShortCiphertext = errors.New("ciphertext too short")
+
+// ErrSizeMismatch is returned when an encrypted buffer doesn't decrypt to
+// the size its plaintext had when it was encrypted.
+var ErrSizeMismatch = errors.New("plaintext size doesn't match the size at encryption")
+
+// ValidPlainSize reports whether the encrypted buffer's ciphertext is the
+// right length for the plaintext size recorded at encryption.
+func (of *OnionBuffer) ValidPlainSize() bool {
+	return int64(PlainSize(len(of.Bytes))) == of.PlainSize
+}
+
+// Decrypt returns the whole plaintext of the encrypted buffer, failing
+// with ErrSizeMismatch if it isn't the size recorded at encryption.
+func (of *OnionBuffer) Decrypt(passphrase string) ([]byte, error) {
+	var plaintext bytes.Buffer
+	if of.PlainSize > 0 {
+		plaintext.Grow(int(of.PlainSize))
+	}
+	if _, err := of.DecryptTo(&plaintext, passphrase); err != nil {
 		return nil, err
 	}
-	gcm, err := cipher.NewGCM(block)
+	return plaintext.Bytes(), nil
+}
+
+// DecryptTo writes the plaintext of the encrypted buffer to w, writing
+// no more than the size recorded at encryption.
+func (of *OnionBuffer) DecryptTo(w io.Writer, passphrase string) (int64, error) {
+	if !of.ValidPlainSize() {
+		return 0, ErrSizeMismatch
+	}
+	n, err := DecryptTo(&sizedWriter{w: w, left: of.PlainSize}, of.Bytes, passphrase, of.Cipher)
+	if err == nil && n != of.PlainSize {
+		err = ErrSizeMismatch
+	}
+	return n, err
+}
+
+// DecryptReader reads the plaintext of an encrypted buffer at any offset,
+// opening only the segments that are read. A single segment is held
+// decrypted at a time, it's wiped once a read moves on to another one
+// and by Close, so readers like zip.Reader never need the whole plaintext.
+type DecryptReader struct {
+	mu     sync.Mutex
+	aead   cipher.AEAD
+	prefix []byte
+	data   []byte
+	size   int64
+	// segment holds the plaintext of the segment numbered index
+	segment []byte
+	plain   []byte
+	index   int
+}
+
+// NewDecryptReader returns a reader of the encrypted buffer's plaintext.
+// Like Decrypt it fails with ErrSizeMismatch if the ciphertext doesn't
+// match the recorded plaintext size, and on a wrong passphrase, which it
+// finds by opening the first segment.
+func (of *OnionBuffer) NewDecryptReader(passphrase string) (*DecryptReader, error) {
+	if !of.ValidPlainSize() {
+		return nil, ErrSizeMismatch
+	}
+	aead, err := newAEAD(of.Cipher, passphrase)
 	if err != nil {
 		return nil, err
 	}
-	nonceSize := gcm.NonceSize()
-	nonce, ciphertext := data[:nonceSize], data[nonceSize:]
-	plaintext, err := gcm.Open(nil, nonce, ciphertext, nil)
+	if len(of.Bytes) < noncePrefixSize+aead.Overhead() {
+		return nil, errShortCiphertext
+	}
+	d := &DecryptReader{
+		aead:    aead,
+		prefix:  of.Bytes[:noncePrefixSize],
+		data:    of.Bytes[noncePrefixSize:],
+		size:    of.PlainSize,
+		segment: make([]byte, SegmentSize),
+		index:   -1,
+	}
+	// Keep the decrypted segment out of swap
+	syscall.Mlock(d.segment)
+	if err := d.open(0); err != nil {
+		d.Close()
+		return nil, err
+	}
+	return d, nil
+}
+
+// Size returns the plaintext size.
+func (d *DecryptReader) Size() int64 {
+	return d.size
+}
+
+// ReadAt reads the plaintext at off, decrypting the segments it spans.
+func (d *DecryptReader) ReadAt(p []byte, off int64) (int, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if off < 0 {
+		return 0, errors.New("negative offset")
+	}
+	var n int
+	for n < len(p) {
+		if off >= d.size {
+			return n, io.EOF
+		}
+		if err := d.open(int(off / SegmentSize)); err != nil {
+			return n, err
+		}
+		copied := copy(p[n:], d.plain[off%SegmentSize:])
+		n += copied
+		off += int64(copied)
+	}
+	return n, nil
+}
+
+// open decrypts segment i into d.segment unless it's already there,
+// wiping the segment held before.
+func (d *DecryptReader) open(i int) error {
+	if i == d.index {
+		return nil
+	}
+	wipe(d.segment)
+	d.index = -1
+	sealedSize := SegmentSize + gcmOverhead
+	segments := (len(d.data) + sealedSize - 1) / sealedSize
+	if segments == 0 {
+		segments = 1
+	}
+	if i >= segments {
+		return io.EOF
+	}
+	end := (i + 1) * sealedSize
+	if end > len(d.data) {
+		end = len(d.data)
+	}
+	plain, err := d.aead.Open(d.segment[:0], segmentNonce(d.prefix, uint32(i), i == segments-1), d.data[i*sealedSize:end], nil)
 	if err != nil {
+		return err
+	}
+	d.plain, d.index = plain, i
+	return nil
+}
+
+// Close wipes the segment held decrypted.
+func (d *DecryptReader) Close() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	wipe(d.segment)
+	syscall.Munlock(d.segment)
+	d.plain, d.index = nil, -1
+	return nil
+}
+
+// sizedWriter fails writes that go past left bytes.
+type sizedWriter struct {
+	w    io.Writer
+	left int64
+}
+
+func (s *sizedWriter) Write(p []byte) (int, error) {
+	if int64(len(p)) > s.left {
+		return 0, ErrSizeMismatch
+	}
+	n, err := s.w.Write(p)
+	s.left -= int64(n)
+	return n, err
+}
+
+// Decrypt returns the whole plaintext of data sealed with cipher c.
+func Decrypt(data []byte, passphrase string, c Cipher) ([]byte, error) {
+	var plaintext bytes.Buffer
+	if size := PlainSize(len(data)); size > 0 {
+		plaintext.Grow(size)
+	}
+	if _, err := DecryptTo(&plaintext, data, passphrase, c); err != nil {
 		return nil, err
 	}
-	return plaintext, nil
+	return plaintext.Bytes(), nil
+}
+
+// DecryptTo writes the plaintext of data to w one segment at a time, so
+// it's never held in memory as a whole. Every segment is authenticated
+// before it's written and wiped afterwards, which means a wrong
+// passphrase fails before anything is written.
+func DecryptTo(w io.Writer, data []byte, passphrase string, c Cipher) (int64, error) {
+	gcm, err := newAEAD(c, passphrase)
+	if err != nil {
+		return 0, err
+	}
+	if len(data) < noncePrefixSize+gcm.Overhead() {
+		return 0, errShortCiphertext
+	}
+	prefix, data := data[:noncePrefixSize], data[noncePrefixSize:]
+	// Keep the decrypted segments out of swap
+	segment := make([]byte, SegmentSize)
+	if err := syscall.Mlock(segment); err == nil {
+		defer syscall.Munlock(segment)
+	}
+	defer wipe(segment)
+	var written int64
+	for i := uint32(0); ; i++ {
+		sealed, rest, last := nextSegment(data)
+		plaintext, err := gcm.Open(segment[:0], segmentNonce(prefix, i, last), sealed, nil)
+		if err != nil {
+			return written, err
+		}
+		n, err := w.Write(plaintext)
+		written += int64(n)
+		wipe(plaintext)
+		if err != nil || last {
+			return written, err
+		}
+		data = rest
+	}
+}
+
+// CheckPassphrase returns an error if passphrase doesn't decrypt data,
+// opening only its first segment.
+func CheckPassphrase(data []byte, passphrase string, c Cipher) error {
+	gcm, err := newAEAD(c, passphrase)
+	if err != nil {
+		return err
+	}
+	if len(data) < noncePrefixSize+gcm.Overhead() {
+		return errShortCiphertext
+	}
+	sealed, _, last := nextSegment(data[noncePrefixSize:])
+	plaintext, err := gcm.Open(nil, segmentNonce(data[:noncePrefixSize], 0, last), sealed, nil)
+	wipe(plaintext)
+	return err
+}
+
+// nextSegment splits the first sealed segment off data.
+func nextSegment(data []byte) (sealed, rest []byte, last bool) {
+	if len(data) <= SegmentSize+gcmOverhead {
+		return data, nil, true
+	}
+	return data[:SegmentSize+gcmOverhead], data[SegmentSize+gcmOverhead:], false
+}
+
+// PlainSize returns the plaintext length of an encrypted buffer of n bytes.
+func PlainSize(n int) int {
+	n -= noncePrefixSize
+	segments := (n + SegmentSize + gcmOverhead - 1) / (SegmentSize + gcmOverhead)
+	if segments == 0 {
+		segments = 1
+	}
+	return n - segments*gcmOverhead
+}
+
+func wipe(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
 }
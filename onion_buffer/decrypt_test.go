@@ -0,0 +1,152 @@
+package onion_buffer
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"testing"
+)
+
+// segmentWriter records the plaintext and the largest single write.
+type segmentWriter struct {
+	bytes.Buffer
+	maxWrite int
+}
+
+func (w *segmentWriter) Write(p []byte) (int, error) {
+	if len(p) > w.maxWrite {
+		w.maxWrite = len(p)
+	}
+	return w.Buffer.Write(p)
+}
+
+func randomBytes(t *testing.T, n int) []byte {
+	t.Helper()
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestDecryptTo(t *testing.T) {
+	for _, size := range []int{0, 1, SegmentSize - 1, SegmentSize, SegmentSize + 1, 3*SegmentSize + 5} {
+		data := randomBytes(t, size)
+		ciphertext, err := Encrypt(data, "secret", AESGCM)
+		if err != nil {
+			t.Fatal(err)
+		}
+		whole, err := Decrypt(ciphertext, "secret", AESGCM)
+		if err != nil {
+			t.Fatalf("%d bytes: Decrypt: %v", size, err)
+		}
+		var w segmentWriter
+		n, err := DecryptTo(&w, ciphertext, "secret", AESGCM)
+		if err != nil {
+			t.Fatalf("%d bytes: DecryptTo: %v", size, err)
+		}
+		if n != int64(size) || !bytes.Equal(w.Bytes(), whole) || !bytes.Equal(whole, data) {
+			t.Errorf("%d bytes: streamed %d bytes that don't match the one-shot decrypt", size, n)
+		}
+		// The plaintext is never written in pieces larger than a segment
+		if w.maxWrite > SegmentSize {
+			t.Errorf("%d bytes: wrote %d bytes at once", size, w.maxWrite)
+		}
+		// A wrong passphrase fails before anything is written
+		var wrong segmentWriter
+		if _, err := DecryptTo(&wrong, ciphertext, "wrong", AESGCM); err == nil || wrong.Len() != 0 {
+			t.Errorf("%d bytes: wrong passphrase wrote %d bytes, got %v", size, wrong.Len(), err)
+		}
+	}
+}
+
+func TestDecryptSizeMismatch(t *testing.T) {
+	data := randomBytes(t, 2*SegmentSize+3)
+	for _, tc := range []struct {
+		name         string
+		tamper       func(of *OnionBuffer)
+		wantErr      bool
+		wantMismatch bool
+	}{
+		{"intact", func(of *OnionBuffer) {}, false, false},
+		{"recorded size too large", func(of *OnionBuffer) { of.PlainSize++ }, true, true},
+		{"recorded size too small", func(of *OnionBuffer) { of.PlainSize-- }, true, true},
+		{"appended bytes", func(of *OnionBuffer) { of.Bytes = append(of.Bytes, make([]byte, 10)...) }, true, true},
+		{"truncated", func(of *OnionBuffer) { of.Bytes = of.Bytes[:len(of.Bytes)-SegmentSize] }, true, true},
+		{"flipped bit", func(of *OnionBuffer) { of.Bytes[len(of.Bytes)-1] ^= 1 }, true, false},
+	} {
+		ciphertext, err := Encrypt(data, "secret", AESGCM)
+		if err != nil {
+			t.Fatal(err)
+		}
+		oBuffer := &OnionBuffer{Bytes: ciphertext, Encrypted: true, PlainSize: int64(len(data))}
+		tc.tamper(oBuffer)
+		var w bytes.Buffer
+		_, err = oBuffer.DecryptTo(&w, "secret")
+		if (err != nil) != tc.wantErr {
+			t.Fatalf("%s: got %v, want error %t", tc.name, err, tc.wantErr)
+		}
+		if tc.wantMismatch && err != ErrSizeMismatch {
+			t.Errorf("%s: got %v, want ErrSizeMismatch", tc.name, err)
+		}
+		if !tc.wantErr && !bytes.Equal(w.Bytes(), data) {
+			t.Errorf("%s: plaintext doesn't match", tc.name)
+		}
+		// Nothing past the recorded size is ever written
+		if int64(w.Len()) > oBuffer.PlainSize {
+			t.Errorf("%s: wrote %d bytes, %d recorded", tc.name, w.Len(), oBuffer.PlainSize)
+		}
+		if _, err := oBuffer.Decrypt("secret"); (err != nil) != tc.wantErr {
+			t.Errorf("%s: Decrypt got %v, want error %t", tc.name, err, tc.wantErr)
+		}
+	}
+}
+
+func TestDecryptReader(t *testing.T) {
+	data := randomBytes(t, 3*SegmentSize+5)
+	ciphertext, err := Encrypt(data, "secret", ChaCha20Poly1305)
+	if err != nil {
+		t.Fatal(err)
+	}
+	oBuffer := &OnionBuffer{Bytes: ciphertext, Encrypted: true, Cipher: ChaCha20Poly1305, PlainSize: int64(len(data))}
+	if _, err := oBuffer.NewDecryptReader("wrong"); err == nil {
+		t.Error("wrong passphrase: got no error")
+	}
+	d, err := oBuffer.NewDecryptReader("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		name    string
+		off     int64
+		n       int
+		wantN   int
+		wantEOF bool
+	}{
+		{"start", 0, 100, 100, false},
+		{"across segments", SegmentSize - 10, 20, 20, false},
+		{"back to the start", 5, 10, 10, false},
+		{"several segments", 10, 2*SegmentSize + 7, 2*SegmentSize + 7, false},
+		{"last segment", 3 * SegmentSize, 5, 5, false},
+		{"past the end", 3*SegmentSize + 1, 10, 4, true},
+		{"at the end", int64(len(data)), 1, 0, true},
+	} {
+		p := make([]byte, tc.n)
+		n, err := d.ReadAt(p, tc.off)
+		if n != tc.wantN || (err == io.EOF) != tc.wantEOF || (err != nil && err != io.EOF) {
+			t.Errorf("%s: got %d bytes and %v, want %d bytes, EOF %t", tc.name, n, err, tc.wantN, tc.wantEOF)
+		}
+		if !bytes.Equal(p[:n], data[tc.off:tc.off+int64(n)]) {
+			t.Errorf("%s: plaintext doesn't match", tc.name)
+		}
+	}
+	// Closing wipes the segment held decrypted
+	d.Close()
+	if !bytes.Equal(d.segment, make([]byte, SegmentSize)) {
+		t.Error("segment not wiped on Close")
+	}
+	oBuffer.PlainSize++
+	if _, err := oBuffer.NewDecryptReader("secret"); err != ErrSizeMismatch {
+		t.Errorf("size mismatch: got %v, want ErrSizeMismatch", err)
+	}
+}
@@ -0,0 +1,79 @@
+package onion_buffer
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"os"
+)
+
+// Size returns the number of bytes served, whether they're stored in
+// memory, compressed or on disk.
+func (of *OnionBuffer) Size() (int64, error) {
+	if of.Compressed {
+		return of.RawSize, nil
+	}
+	if of.Path == "" {
+		return int64(len(of.Bytes)), nil
+	}
+	info, err := os.Stat(of.Path)
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
+
+// WriteTo copies the stored bytes to w, streaming them from disk if
+// the buffer is disk-backed and decompressing them if it's compressed.
+func (of *OnionBuffer) WriteTo(w io.Writer) (int64, error) {
+	if of.Compressed {
+		gzReader, err := gzip.NewReader(bytes.NewReader(of.Bytes))
+		if err != nil {
+			return 0, err
+		}
+		defer gzReader.Close()
+		return io.Copy(w, gzReader)
+	}
+	if of.Path == "" {
+		return io.Copy(w, bytes.NewReader(of.Bytes))
+	}
+	f, err := os.Open(of.Path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	return io.Copy(w, f)
+}
+
+// WipeFile overwrites the file with zeros, syncs it and removes it.
+func WipeFile(path string) error {
+	f, err := os.OpenFile(path, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	zeros := make([]byte, chunkSize)
+	for remaining := info.Size(); remaining > 0; {
+		n := int64(len(zeros))
+		if remaining < n {
+			n = remaining
+		}
+		if _, err := f.Write(zeros[:n]); err != nil {
+			f.Close()
+			return err
+		}
+		remaining -= n
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Remove(path)
+}
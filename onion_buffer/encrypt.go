@@ -1,22 +1,54 @@
 package onion_buffer
 
 import (
-	"crypto/aes"
-	"crypto/cipher"
 	"crypto/rand"
+	"encoding/binary"
 	"io"
 )
 
-func Encrypt(data []byte, passphrase string) ([]byte, error) {
-	block, _ := aes.NewCipher([]byte(createHash(passphrase)))
-	gcm, err := cipher.NewGCM(block)
+// SegmentSize is the plaintext size of each separately sealed segment,
+// so buffers can be decrypted without holding the whole plaintext.
+const SegmentSize = 64 << 10
+
+// noncePrefixSize is the random part of each segment's nonce, the rest
+// is the segment counter and a flag marking the last segment.
+const noncePrefixSize = 7
+
+// Encrypt seals data with cipher c in SegmentSize segments, prefixed by
+// the random part of their nonces.
+func Encrypt(data []byte, passphrase string, c Cipher) ([]byte, error) {
+	gcm, err := newAEAD(c, passphrase)
 	if err != nil {
 		return nil, err
 	}
-	nonce := make([]byte, gcm.NonceSize())
-	if _, err = io.ReadFull(rand.Reader, nonce); err != nil {
+	segments := (len(data) + SegmentSize - 1) / SegmentSize
+	if segments == 0 {
+		segments = 1
+	}
+	ciphertext := make([]byte, noncePrefixSize, noncePrefixSize+len(data)+segments*gcm.Overhead())
+	if _, err = io.ReadFull(rand.Reader, ciphertext); err != nil {
 		return nil, err
 	}
-	ciphertext := gcm.Seal(nonce, nonce, data, nil)
+	prefix := ciphertext[:noncePrefixSize:noncePrefixSize]
+	for i := 0; i < segments; i++ {
+		end := (i + 1) * SegmentSize
+		if end > len(data) {
+			end = len(data)
+		}
+		nonce := segmentNonce(prefix, uint32(i), i == segments-1)
+		ciphertext = gcm.Seal(ciphertext, nonce, data[i*SegmentSize:end], nil)
+	}
 	return ciphertext, nil
 }
+
+// segmentNonce returns the nonce of the i-th segment. Flagging the last
+// segment keeps a truncated buffer from decrypting.
+func segmentNonce(prefix []byte, i uint32, last bool) []byte {
+	nonce := make([]byte, noncePrefixSize+5)
+	copy(nonce, prefix)
+	binary.BigEndian.PutUint32(nonce[noncePrefixSize:], i)
+	if last {
+		nonce[len(nonce)-1] = 1
+	}
+	return nonce
+}
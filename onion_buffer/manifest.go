@@ -0,0 +1,56 @@
+package onion_buffer
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"os"
+)
+
+// ManifestChunkSize is the size of the chunks listed in a manifest.
+const ManifestChunkSize = 1 << 20
+
+// ChunkHash is the hash of one chunk of the served bytes, so clients
+// resuming a download can verify what they already have.
+type ChunkHash struct {
+	Offset int64  `json:"offset"`
+	Size   int    `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// BuildManifest hashes the stored bytes in ManifestChunkSize chunks.
+func (of *OnionBuffer) BuildManifest() ([]ChunkHash, error) {
+	of.Lock()
+	defer of.Unlock()
+	if of.Path != "" {
+		f, err := os.Open(of.Path)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		return buildManifest(f)
+	}
+	return buildManifest(bytes.NewReader(of.Bytes))
+}
+
+// buildManifest hashes src by chunk. Callers must hold the buffer's lock.
+func buildManifest(src io.Reader) ([]ChunkHash, error) {
+	var manifest []ChunkHash
+	var offset int64
+	chunk := make([]byte, ManifestChunkSize)
+	for {
+		n, err := io.ReadFull(src, chunk)
+		if n > 0 {
+			sum := sha256.Sum256(chunk[:n])
+			manifest = append(manifest, ChunkHash{Offset: offset, Size: n, SHA256: hex.EncodeToString(sum[:])})
+			offset += int64(n)
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return manifest, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
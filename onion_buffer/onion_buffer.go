@@ -1,11 +1,8 @@
 package onion_buffer
 
 import (
-	"archive/zip"
-	"bufio"
-	"bytes"
-	"io"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 )
@@ -13,53 +10,252 @@ import (
 // OnionBuffer struct
 type OnionBuffer struct {
 	sync.Mutex
-	Name             string
+	Name             string // Changed by rotation once stored, read it through CurrentName
+	Token            string
+	DisplayName      string
+	RawName          string
+	FileName         string
+	ContentType      string
 	Bytes            []byte
+	Path             string
 	Checksum         string
+	Signature        string
+	Manifest         []ChunkHash
 	Encrypted        bool
+	Cipher           Cipher
+	Compressed       bool // Bytes hold RawSize bytes gzipped
+	RawSize          int64
+	PlainSize        int64 // Size of the zip encrypted buffers decrypt to
+	PasswordHint     string
 	Downloads        int
 	DownloadLimit    int
 	DownloadsLimited bool
+	BytesServed      int64
+	ByteQuota        int64
+	ConfirmDownload  bool
+	Inline           bool
+	FailedAttempts   int
+	LockedUntil      time.Time
+	Receipts         []Receipt
 	CreatedAt        time.Time
+	LastAccessedAt   time.Time
 	ExpiresAt        time.Time
+	ExpireAfter      time.Duration // Sets ExpiresAt on the first download
+	inFlight         int32
+	destroyed        bool
+	quarantined      bool
+	// serving is held for a whole download when downloads are serialized
+	serving sync.Mutex
 }
 
+// Destroy wipes the buffer's bytes and file. Destroying it again is a no-op.
 func (of *OnionBuffer) Destroy() error {
 	of.Lock()
-	var err error
-	buffer := bytes.NewBuffer(of.Bytes)
-	zWriter := zip.NewWriter(buffer)
-	reader := bufio.NewReader(bytes.NewReader(of.Bytes))
-	chunk := make([]byte, 1)
-	// Lock memory allotted to chunk from being used in SWAP
-	if err := syscall.Mlock(chunk); err != nil {
+	defer of.Unlock()
+	if of.destroyed {
+		return nil
+	}
+	// Overwrite the bytes before handing the memory back
+	wipe(of.Bytes)
+	if err := syscall.Munlock(of.Bytes); err != nil {
 		return err
 	}
-	bufFile, _ := zWriter.Create(of.Name)
-	for {
-		if _, err = reader.Read(chunk); err != nil {
-			break
-		}
-		_, err := bufFile.Write([]byte("0"))
-		if err != nil {
+	of.Bytes = nil
+	of.Manifest = nil
+	// Wipe and remove the zip if it's stored on disk
+	if of.Path != "" {
+		if err := WipeFile(of.Path); err != nil {
 			return err
 		}
+		of.Path = ""
 	}
-	if err != io.EOF {
-		return err
-	} else {
-		err = nil
+	of.destroyed = true
+	return nil
+}
+
+// AddBytesServed counts bytes written to clients towards the quota.
+func (of *OnionBuffer) AddBytesServed(n int64) {
+	atomic.AddInt64(&of.BytesServed, n)
+}
+
+// QuotaExceeded reports whether the buffer has served its byte quota.
+func (of *OnionBuffer) QuotaExceeded() bool {
+	of.Lock()
+	defer of.Unlock()
+	return of.ByteQuota > 0 && atomic.LoadInt64(&of.BytesServed) >= of.ByteQuota
+}
+
+// ClaimDownload counts a download if the download limit allows another
+// and returns the new count. Checking and counting under one lock keeps
+// concurrent downloads from both taking the last one.
+func (of *OnionBuffer) ClaimDownload() (n int, ok bool) {
+	of.Lock()
+	defer of.Unlock()
+	if of.limitReached() {
+		return of.Downloads, false
 	}
-	if err := syscall.Munlock(of.Bytes); err != nil {
-		return err
+	of.Downloads++
+	return of.Downloads, true
+}
+
+// LimitReached reports whether the buffer was downloaded as often as its
+// download limit allows.
+func (of *OnionBuffer) LimitReached() bool {
+	of.Lock()
+	defer of.Unlock()
+	return of.limitReached()
+}
+
+func (of *OnionBuffer) limitReached() bool {
+	return of.DownloadLimit > 0 && of.Downloads >= of.DownloadLimit
+}
+
+// CurrentName returns the buffer's name, which rotating its link changes.
+func (of *OnionBuffer) CurrentName() string {
+	of.Lock()
+	defer of.Unlock()
+	return of.Name
+}
+
+// DownloadCount returns how often the buffer was downloaded.
+func (of *OnionBuffer) DownloadCount() int {
+	of.Lock()
+	defer of.Unlock()
+	return of.Downloads
+}
+
+// Expiry returns when the buffer expires, zero if it never does.
+func (of *OnionBuffer) Expiry() time.Time {
+	of.Lock()
+	defer of.Unlock()
+	return of.ExpiresAt
+}
+
+// BeginDownload marks a download of the buffer as in flight and returns
+// how many are now in flight.
+func (of *OnionBuffer) BeginDownload() int {
+	return int(atomic.AddInt32(&of.inFlight, 1))
+}
+
+// InFlight returns how many downloads of the buffer are in flight.
+func (of *OnionBuffer) InFlight() int {
+	return int(atomic.LoadInt32(&of.inFlight))
+}
+
+// EndDownload marks an in-flight download as done.
+func (of *OnionBuffer) EndDownload() {
+	atomic.AddInt32(&of.inFlight, -1)
+}
+
+// LockServing waits for other serialized downloads of the buffer to
+// finish and keeps new ones waiting until UnlockServing.
+func (of *OnionBuffer) LockServing() {
+	of.serving.Lock()
+}
+
+// UnlockServing lets the next serialized download of the buffer proceed.
+func (of *OnionBuffer) UnlockServing() {
+	of.serving.Unlock()
+}
+
+// waitInFlight waits for in-flight downloads to finish, giving up at deadline.
+func (of *OnionBuffer) waitInFlight(deadline time.Time) bool {
+	for atomic.LoadInt32(&of.inFlight) > 0 {
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return true
+}
+
+// StartExpiry starts the expiration countdown of buffers that expire after
+// their first download. Only the first call sets ExpiresAt.
+func (of *OnionBuffer) StartExpiry() {
+	of.Lock()
+	defer of.Unlock()
+	if of.ExpireAfter > 0 && of.ExpiresAt.IsZero() {
+		of.ExpiresAt = time.Now().Add(of.ExpireAfter)
 	}
+}
+
+// Appendable reports whether files can still be appended to the buffer.
+// Append checks again under the same lock it appends with.
+func (of *OnionBuffer) Appendable() bool {
+	of.Lock()
+	defer of.Unlock()
+	return of.appendable()
+}
+
+func (of *OnionBuffer) appendable() bool {
+	return !of.destroyed && !of.Encrypted && of.Path == "" && of.RawName == "" && of.Downloads == 0
+}
+
+// Touch records now as the last time the buffer was downloaded.
+func (of *OnionBuffer) Touch() {
+	of.Lock()
+	of.LastAccessedAt = time.Now()
 	of.Unlock()
-	return nil
+}
+
+// LastAccess returns when the buffer was last downloaded, zero if never.
+func (of *OnionBuffer) LastAccess() time.Time {
+	of.Lock()
+	defer of.Unlock()
+	return of.LastAccessedAt
 }
 
 func (of *OnionBuffer) IsExpired() bool {
-	if of.ExpiresAt.After(time.Now()) {
+	of.Lock()
+	defer of.Unlock()
+	// Buffers without an expiration never expire
+	if of.ExpiresAt.IsZero() || of.ExpiresAt.After(time.Now()) {
 		return false
 	}
 	return true
 }
+
+// FailedAttempt records a wrong password. Once maxAttempts is reached the
+// buffer is locked out, doubling the lockout with every further failure.
+func (of *OnionBuffer) FailedAttempt(maxAttempts int) {
+	of.Lock()
+	defer of.Unlock()
+	of.FailedAttempts++
+	if maxAttempts <= 0 || of.FailedAttempts < maxAttempts {
+		return
+	}
+	shift := uint(of.FailedAttempts - maxAttempts)
+	if shift > 10 {
+		shift = 10
+	}
+	of.LockedUntil = time.Now().Add(time.Minute << shift)
+}
+
+// ResetAttempts clears the failed attempts after a successful decrypt.
+func (of *OnionBuffer) ResetAttempts() {
+	of.Lock()
+	of.FailedAttempts = 0
+	of.LockedUntil = time.Time{}
+	of.Unlock()
+}
+
+// Quarantine keeps the buffer from being downloaded again, for when its
+// bytes no longer match its checksum.
+func (of *OnionBuffer) Quarantine() {
+	of.Lock()
+	of.quarantined = true
+	of.Unlock()
+}
+
+// IsQuarantined reports whether the buffer was quarantined.
+func (of *OnionBuffer) IsQuarantined() bool {
+	of.Lock()
+	defer of.Unlock()
+	return of.quarantined
+}
+
+func (of *OnionBuffer) IsLocked() bool {
+	of.Lock()
+	defer of.Unlock()
+	return of.LockedUntil.After(time.Now())
+}
@@ -0,0 +1,129 @@
+package onion_buffer
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestFailedAttempt(t *testing.T) {
+	for _, tc := range []struct {
+		name        string
+		maxAttempts int
+		failures    int
+		wantLocked  bool
+		wantLockout time.Duration
+	}{
+		{"disabled", 0, 10, false, 0},
+		{"below the limit", 5, 4, false, 0},
+		{"at the limit", 5, 5, true, time.Minute},
+		{"past the limit", 5, 7, true, 4 * time.Minute},
+		{"capped", 1, 30, true, 1024 * time.Minute},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			of := &OnionBuffer{}
+			for i := 0; i < tc.failures; i++ {
+				of.FailedAttempt(tc.maxAttempts)
+			}
+			if of.IsLocked() != tc.wantLocked {
+				t.Fatalf("got locked %t, want %t", of.IsLocked(), tc.wantLocked)
+			}
+			if !tc.wantLocked {
+				return
+			}
+			// The lockout doubles with every failure past the limit
+			lockout := time.Until(of.LockedUntil)
+			if lockout > tc.wantLockout || lockout < tc.wantLockout-time.Second {
+				t.Errorf("got a %v lockout, want %v", lockout, tc.wantLockout)
+			}
+			of.ResetAttempts()
+			if of.IsLocked() || of.FailedAttempts != 0 {
+				t.Errorf("still locked after a successful decrypt")
+			}
+		})
+	}
+}
+
+func TestDestroy(t *testing.T) {
+	for _, tc := range []struct {
+		name         string
+		freeOSMemory bool
+		onDisk       bool
+	}{
+		{"memory", false, false},
+		{"free OS memory", true, false},
+		{"disk", false, true},
+	} {
+		store := NewStore()
+		store.FreeOSMemory = tc.freeOSMemory
+		data := []byte("onionbox destroy test")
+		oBuffer := &OnionBuffer{Name: "a", Bytes: data, Manifest: []ChunkHash{{Size: len(data)}}}
+		if tc.onDisk {
+			f, err := ioutil.TempFile(t.TempDir(), "onionbox-")
+			if err != nil {
+				t.Fatal(err)
+			}
+			f.Write(data)
+			f.Close()
+			oBuffer.Path = f.Name()
+		}
+		if err := store.Add(oBuffer); err != nil {
+			t.Fatal(err)
+		}
+		path := oBuffer.Path
+		if err := store.Destroy(oBuffer); err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		if oBuffer.Bytes != nil || oBuffer.Manifest != nil || oBuffer.Path != "" {
+			t.Errorf("%s: references kept after Destroy", tc.name)
+		}
+		// The memory was overwritten before it was let go
+		if !bytes.Equal(data, make([]byte, len(data))) {
+			t.Errorf("%s: bytes not wiped: %q", tc.name, data)
+		}
+		if path != "" {
+			if _, err := os.Stat(path); !os.IsNotExist(err) {
+				t.Errorf("%s: %s not removed: %v", tc.name, path, err)
+			}
+		}
+		// Destroying it again is a no-op
+		if err := oBuffer.Destroy(); err != nil {
+			t.Errorf("%s: second Destroy: %v", tc.name, err)
+		}
+	}
+}
+
+func TestStartExpiry(t *testing.T) {
+	for _, tc := range []struct {
+		name        string
+		expireAfter time.Duration
+		wantSet     bool
+	}{
+		{"on first download", time.Hour, true},
+		{"not expiring", 0, false},
+	} {
+		oBuffer := &OnionBuffer{ExpireAfter: tc.expireAfter}
+		// Concurrent first downloads all start the same countdown
+		var wg sync.WaitGroup
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				oBuffer.StartExpiry()
+			}()
+		}
+		wg.Wait()
+		first := oBuffer.Expiry()
+		if first.IsZero() == tc.wantSet {
+			t.Fatalf("%s: got expiry %v", tc.name, first)
+		}
+		time.Sleep(time.Millisecond)
+		oBuffer.StartExpiry()
+		if !oBuffer.Expiry().Equal(first) {
+			t.Errorf("%s: later download moved the expiry from %v to %v", tc.name, first, oBuffer.Expiry())
+		}
+	}
+}
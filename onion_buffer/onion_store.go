@@ -1,83 +1,251 @@
 package onion_buffer
 
 import (
+	"errors"
+	"fmt"
+	"runtime/debug"
+	"strings"
+	"sync"
 	"syscall"
+	"time"
 )
 
+// ErrNotFound is returned by Destroy for buffers that aren't in the store,
+// such as ones another request already destroyed.
+var ErrNotFound = errors.New("buffer not found in store")
+
+// ErrClosed is returned by Add once DestroyAll has been called, so nothing
+// added while shutting down outlives the wipe.
+var ErrClosed = errors.New("store is shutting down")
+
+// ErrBurned is returned by Rename for burn-after-read buffers that were
+// already downloaded, their link has nothing left to protect.
+var ErrBurned = errors.New("burn after read buffer was already downloaded")
+
+// destroyTimeout bounds how long DestroyAll waits for in-flight downloads.
+const destroyTimeout = 5 * time.Second
+
 type OnionStore struct {
+	// mu guards BufferFiles and Tombstones
+	mu          sync.RWMutex
 	BufferFiles []*OnionBuffer
+	// Tombstones map names of renamed buffers to when the buffer was due to
+	// expire at the time, zero if never
+	Tombstones map[string]time.Time
+	// FreeOSMemory returns destroyed buffers' memory to the OS right away
+	FreeOSMemory bool
+	// closed is set by DestroyAll, guarded by mu
+	closed bool
+	// reserved counts bytes promised to uploads that aren't stored yet,
+	// guarded by mu
+	reserved int64
 }
 
 func (store *OnionStore) Add(oBuffer *OnionBuffer) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	if store.closed {
+		return ErrClosed
+	}
 	oBuffer.Lock()
-	store.BufferFiles = append(store.BufferFiles, oBuffer)
+	defer oBuffer.Unlock()
+	// Buffers that could be swapped out are never stored
 	if err := syscall.Mlock(oBuffer.Bytes); err != nil {
 		return err
 	}
-	oBuffer.Unlock()
+	store.BufferFiles = append(store.BufferFiles, oBuffer)
 	return nil
 }
 
+// NormalizeName strips the slashes around a requested buffer name, so
+// /name/ and name refer to the same buffer.
+func NormalizeName(bufName string) string {
+	return strings.Trim(bufName, "/")
+}
+
+// Get returns the buffer named bufName. Names match exactly first, then
+// by their lowercase form, since silly names are lowercase but short
+// codes are case sensitive.
 func (store *OnionStore) Get(bufName string) *OnionBuffer {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+	return store.get(bufName)
+}
+
+func (store *OnionStore) get(bufName string) *OnionBuffer {
+	bufName = NormalizeName(bufName)
+	lower := strings.ToLower(bufName)
+	var folded *OnionBuffer
 	for _, f := range store.BufferFiles {
 		if f.Name == bufName {
 			return f
 		}
+		if f.Name == lower && folded == nil {
+			folded = f
+		}
 	}
-	return nil
+	return folded
 }
 
-func (store *OnionStore) Delete(of *OnionBuffer) error {
+// Destroy wipes the buffer and removes it from the store. It's safe to
+// call more than once, later calls return ErrNotFound.
+func (store *OnionStore) Destroy(of *OnionBuffer) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
 	for i, f := range store.BufferFiles {
-		if f.Name == of.Name {
+		if f == of {
 			if err := f.Destroy(); err != nil {
 				return err
 			}
 			// Remove from store
-			f.Lock()
 			store.BufferFiles = append(store.BufferFiles[:i], store.BufferFiles[i+1:]...)
-			// Free niled allotted memory for SWAP usage
-			if err := syscall.Munlock(f.Bytes); err != nil {
-				return err
+			if store.FreeOSMemory {
+				debug.FreeOSMemory()
 			}
-			f.Unlock()
+			return nil
 		}
 	}
+	return ErrNotFound
+}
+
+// Rename gives the buffer a new name, tombstoning the old one until the
+// buffer would have expired. Burn-after-read buffers that were downloaded
+// are refused with ErrBurned, checked under the same lock downloads are
+// counted under.
+func (store *OnionStore) Rename(of *OnionBuffer, newName string) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	if store.get(newName) != nil || store.tombstoned(newName) {
+		return fmt.Errorf("buffer name %s is already taken", newName)
+	}
+	of.Lock()
+	defer of.Unlock()
+	if of.DownloadLimit == 1 && of.Downloads > 0 {
+		return ErrBurned
+	}
+	store.Tombstones[of.Name] = of.ExpiresAt
+	of.Name = newName
 	return nil
 }
 
-func (store *OnionStore) Exists(bufName string) bool {
-	for _, f := range store.BufferFiles {
-		if f.Name == bufName {
-			return true
+// Tombstoned reports whether bufName belonged to a buffer that was renamed.
+func (store *OnionStore) Tombstoned(bufName string) bool {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+	return store.tombstoned(bufName)
+}
+
+func (store *OnionStore) tombstoned(bufName string) bool {
+	bufName = NormalizeName(bufName)
+	return store.liveTombstone(bufName) || store.liveTombstone(strings.ToLower(bufName))
+}
+
+func (store *OnionStore) liveTombstone(bufName string) bool {
+	expires, ok := store.Tombstones[bufName]
+	return ok && (expires.IsZero() || expires.After(time.Now()))
+}
+
+// pruneTombstones forgets tombstones whose buffers would have expired.
+func (store *OnionStore) pruneTombstones() {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	for name := range store.Tombstones {
+		if !store.liveTombstone(name) {
+			delete(store.Tombstones, name)
 		}
 	}
-	return false
 }
 
+func (store *OnionStore) Exists(bufName string) bool {
+	return store.Get(bufName) != nil
+}
+
+// DestroyAll destroys every buffer in the store and refuses any added
+// afterwards. In-flight downloads get until destroyTimeout to finish, after
+// which the rest are wiped regardless.
 func (store *OnionStore) DestroyAll() error {
-	for i, f := range store.BufferFiles {
-		if err := f.Destroy(); err != nil {
+	store.mu.Lock()
+	store.closed = true
+	store.mu.Unlock()
+	// Snapshot the buffers so concurrent requests can't change what's destroyed
+	buffers := store.List()
+	deadline := time.Now().Add(destroyTimeout)
+	for _, f := range buffers {
+		f.waitInFlight(deadline)
+		if err := store.Destroy(f); err != nil && err != ErrNotFound {
 			return err
 		}
-		f.Lock()
-		store.BufferFiles = append(store.BufferFiles[:i], store.BufferFiles[i+1:]...)
-		if err := syscall.Munlock(f.Bytes); err != nil {
+	}
+	//runtime.GC()
+	return nil
+}
+
+func (store *OnionStore) DestroyExpiredBuffers() error {
+	store.pruneTombstones()
+	var expired []*OnionBuffer
+	for _, f := range store.List() {
+		if f.IsExpired() {
+			expired = append(expired, f)
+		}
+	}
+	for _, f := range expired {
+		if err := store.Destroy(f); err != nil && err != ErrNotFound {
 			return err
 		}
-		f.Unlock()
 	}
-	//runtime.GC()
 	return nil
 }
 
-func DeleteExpiredBuffers() {
-	// TODO: implement go routine that always checks each onion file
-	//  if its expired. If so, destroy it.
+// List returns a snapshot of all buffers in the store.
+func (store *OnionStore) List() []*OnionBuffer {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+	buffers := make([]*OnionBuffer, len(store.BufferFiles))
+	copy(buffers, store.BufferFiles)
+	return buffers
+}
+
+// TotalBytes returns the number of bytes held by all buffers in the store.
+func (store *OnionStore) TotalBytes() int64 {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+	return store.totalBytes()
+}
+
+func (store *OnionStore) totalBytes() int64 {
+	var total int64
+	for _, f := range store.BufferFiles {
+		// Appends and compression swap the bytes under the buffer's lock
+		f.Lock()
+		total += int64(len(f.Bytes))
+		f.Unlock()
+	}
+	return total
+}
+
+// Reserve sets n bytes aside for a buffer about to be built, reporting
+// false if the stored and reserved bytes would then exceed limit. Checking
+// and reserving happen at once so concurrent uploads can't both fit.
+func (store *OnionStore) Reserve(n, limit int64) bool {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	if store.totalBytes()+store.reserved+n > limit {
+		return false
+	}
+	store.reserved += n
+	return true
+}
+
+// Release gives back n bytes set aside by Reserve.
+func (store *OnionStore) Release(n int64) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	store.reserved -= n
 }
 
 func NewStore() *OnionStore {
 	return &OnionStore{
 		BufferFiles: make([]*OnionBuffer, 0),
+		Tombstones:  make(map[string]time.Time),
 	}
 }
@@ -0,0 +1,300 @@
+package onion_buffer
+
+import (
+	"bytes"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+// slowWriter delays every write so downloads stay in flight.
+type slowWriter struct {
+	bytes.Buffer
+}
+
+func (w *slowWriter) Write(p []byte) (int, error) {
+	time.Sleep(time.Millisecond)
+	return w.Buffer.Write(p)
+}
+
+func TestDestroyAllInFlight(t *testing.T) {
+	store := NewStore()
+	content := bytes.Repeat([]byte("onionbox"), 1024)
+	var buffers []*OnionBuffer
+	for _, name := range []string{"a", "b", "c"} {
+		oBuffer := &OnionBuffer{Name: name, Bytes: append([]byte(nil), content...)}
+		if err := store.Add(oBuffer); err != nil {
+			t.Fatal(err)
+		}
+		buffers = append(buffers, oBuffer)
+	}
+	var wg sync.WaitGroup
+	results := make([]*slowWriter, len(buffers))
+	for i, oBuffer := range buffers {
+		oBuffer.BeginDownload()
+		results[i] = new(slowWriter)
+		wg.Add(1)
+		go func(oBuffer *OnionBuffer, w *slowWriter) {
+			defer wg.Done()
+			defer oBuffer.EndDownload()
+			// Write in small pieces, so the download takes a while
+			for off := 0; off < len(oBuffer.Bytes); off += 512 {
+				w.Write(oBuffer.Bytes[off : off+512])
+			}
+		}(oBuffer, results[i])
+	}
+	if err := store.DestroyAll(); err != nil {
+		t.Fatal(err)
+	}
+	wg.Wait()
+	for i, w := range results {
+		if !bytes.Equal(w.Bytes(), content) {
+			t.Errorf("%s: download got %d bytes, want the %d stored", buffers[i].Name, w.Len(), len(content))
+		}
+		if buffers[i].Bytes != nil {
+			t.Errorf("%s: not wiped", buffers[i].Name)
+		}
+	}
+	if n := len(store.List()); n != 0 {
+		t.Errorf("%d buffers left in the store", n)
+	}
+	if err := store.Add(&OnionBuffer{Name: "late"}); err != ErrClosed {
+		t.Errorf("Add after DestroyAll: got %v, want ErrClosed", err)
+	}
+}
+
+func TestGet(t *testing.T) {
+	store := NewStore()
+	silly := &OnionBuffer{Name: "sillyname"}
+	short := &OnionBuffer{Name: "AbC12"}
+	for _, oBuffer := range []*OnionBuffer{silly, short} {
+		if err := store.Add(oBuffer); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, tc := range []struct {
+		name string
+		want *OnionBuffer
+	}{
+		{"sillyname", silly},
+		{"/sillyname", silly},
+		{"sillyname/", silly},
+		{"/sillyname/", silly},
+		{"/SillyName", silly},
+		{"SILLYNAME/", silly},
+		{"AbC12", short},
+		{"/AbC12/", short},
+		{"abc12", nil},
+		{"silly", nil},
+		{"", nil},
+	} {
+		if got := store.Get(tc.name); got != tc.want {
+			t.Errorf("Get(%q) = %v, want %v", tc.name, got, tc.want)
+		}
+		if got := store.Exists(tc.name); got != (tc.want != nil) {
+			t.Errorf("Exists(%q) = %t", tc.name, got)
+		}
+	}
+}
+
+func TestRename(t *testing.T) {
+	for _, tc := range []struct {
+		name          string
+		buffer        *OnionBuffer
+		wantErr       error
+		wantTombstone bool
+	}{
+		{"never expires", &OnionBuffer{Name: "a"}, nil, true},
+		{"expires later", &OnionBuffer{Name: "a", ExpiresAt: time.Now().Add(time.Hour)}, nil, true},
+		{"expired", &OnionBuffer{Name: "a", ExpiresAt: time.Now().Add(-time.Second)}, nil, false},
+		{"burn after read", &OnionBuffer{Name: "a", DownloadLimit: 1}, nil, true},
+		{"burn after read downloaded", &OnionBuffer{Name: "a", DownloadLimit: 1, Downloads: 1}, ErrBurned, false},
+	} {
+		store := NewStore()
+		if err := store.Add(tc.buffer); err != nil {
+			t.Fatal(err)
+		}
+		if err := store.Rename(tc.buffer, "b"); err != tc.wantErr {
+			t.Errorf("%s: got %v, want %v", tc.name, err, tc.wantErr)
+			continue
+		}
+		if err := store.DestroyExpiredBuffers(); err != nil {
+			t.Fatal(err)
+		}
+		if got := store.Tombstoned("a"); got != tc.wantTombstone {
+			t.Errorf("%s: tombstoned %t, want %t", tc.name, got, tc.wantTombstone)
+		}
+		if _, kept := store.Tombstones["a"]; kept != tc.wantTombstone {
+			t.Errorf("%s: tombstone kept %t, want %t", tc.name, kept, tc.wantTombstone)
+		}
+	}
+}
+
+// TestRenameConcurrent renames a burn-after-read buffer while it's read
+// and downloaded, -race catches unlocked reads of its name.
+func TestRenameConcurrent(t *testing.T) {
+	for i := 0; i < 100; i++ {
+		store := NewStore()
+		oBuffer := &OnionBuffer{Name: "a", DownloadLimit: 1}
+		if err := store.Add(oBuffer); err != nil {
+			t.Fatal(err)
+		}
+		var wg sync.WaitGroup
+		var renameErr error
+		wg.Add(3)
+		go func() {
+			defer wg.Done()
+			renameErr = store.Rename(oBuffer, "b")
+		}()
+		go func() {
+			defer wg.Done()
+			oBuffer.ClaimDownload()
+		}()
+		go func() {
+			defer wg.Done()
+			store.Get(oBuffer.CurrentName())
+		}()
+		wg.Wait()
+		// Renamed before the download, or refused after it
+		renamed := oBuffer.CurrentName() == "b"
+		if renamed != (renameErr == nil) || (renameErr != nil && renameErr != ErrBurned) {
+			t.Fatalf("renamed %t with error %v", renamed, renameErr)
+		}
+	}
+}
+
+func TestStoreConcurrent(t *testing.T) {
+	store := NewStore()
+	const workers, rounds = 8, 200
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < rounds; j++ {
+				name := fmt.Sprintf("buffer-%d-%d", i, j)
+				oBuffer := &OnionBuffer{Name: name, Bytes: []byte(name)}
+				// Every other buffer expires right away for the reaper
+				if j%2 == 0 {
+					oBuffer.ExpiresAt = time.Now().Add(-time.Second)
+				}
+				if err := store.Add(oBuffer); err != nil {
+					t.Error(err)
+					return
+				}
+				store.Get(name)
+				store.Exists("/" + name + "/")
+				store.List()
+				store.TotalBytes()
+				if store.Reserve(10, 1<<30) {
+					store.Release(10)
+				}
+				if err := store.DestroyExpiredBuffers(); err != nil {
+					t.Error(err)
+				}
+				if j%3 == 0 {
+					if err := store.Rename(oBuffer, name+"-renamed"); err != nil {
+						t.Error(err)
+					}
+					store.Tombstoned(name)
+				}
+				if err := store.Destroy(oBuffer); err != nil && err != ErrNotFound {
+					t.Error(err)
+				}
+				if err := store.Destroy(oBuffer); err != ErrNotFound {
+					t.Errorf("second Destroy of %s: got %v, want ErrNotFound", name, err)
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	if n := len(store.List()); n != 0 {
+		t.Errorf("%d buffers left in the store", n)
+	}
+	if store.reserved != 0 {
+		t.Errorf("%d bytes still reserved", store.reserved)
+	}
+	if err := store.DestroyAll(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDestroyConcurrent(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		callers int
+		added   bool
+	}{
+		{"twice", 2, true},
+		{"many callers", 16, true},
+		{"never added", 4, false},
+	} {
+		store := NewStore()
+		oBuffer := &OnionBuffer{Name: "a", Bytes: []byte("destroy me")}
+		if tc.added {
+			if err := store.Add(oBuffer); err != nil {
+				t.Fatal(err)
+			}
+		}
+		// A download and the reaper may destroy the same buffer at once
+		errs := make(chan error, tc.callers)
+		var wg sync.WaitGroup
+		for i := 0; i < tc.callers; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				errs <- store.Destroy(oBuffer)
+			}()
+		}
+		wg.Wait()
+		close(errs)
+		var destroyed int
+		for err := range errs {
+			switch err {
+			case nil:
+				destroyed++
+			case ErrNotFound:
+			default:
+				t.Errorf("%s: %v", tc.name, err)
+			}
+		}
+		want := 0
+		if tc.added {
+			want = 1
+		}
+		if destroyed != want {
+			t.Errorf("%s: destroyed %d times, want %d", tc.name, destroyed, want)
+		}
+		if store.Exists(oBuffer.Name) {
+			t.Errorf("%s: still in the store", tc.name)
+		}
+	}
+}
+
+func TestAddAfterDestroyAll(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		shutdown bool
+		wantErr  error
+	}{
+		{"open", false, nil},
+		{"shutting down", true, ErrClosed},
+	} {
+		store := NewStore()
+		if tc.shutdown {
+			if err := store.DestroyAll(); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := store.Add(&OnionBuffer{Name: "a", Bytes: []byte("plaintext")}); err != tc.wantErr {
+			t.Errorf("%s: got %v, want %v", tc.name, err, tc.wantErr)
+		}
+		if got, want := store.Exists("a"), tc.wantErr == nil; got != want {
+			t.Errorf("%s: stored %t, want %t", tc.name, got, want)
+		}
+		if err := store.DestroyAll(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,52 @@
+package onion_buffer
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"time"
+)
+
+// maxReceipts is the number of most recent receipts kept per buffer.
+const maxReceipts = 32
+
+// Receipt is signed proof that a download of a buffer occurred.
+type Receipt struct {
+	Name      string    `json:"name"`
+	Index     int       `json:"index"`
+	Time      time.Time `json:"time"`
+	Signature string    `json:"signature"`
+}
+
+// NewReceipt signs the download with an HMAC under the server key.
+func NewReceipt(key []byte, name string, index int, t time.Time) Receipt {
+	rc := Receipt{Name: name, Index: index, Time: t.UTC()}
+	rc.Signature = hex.EncodeToString(rc.sign(key))
+	return rc
+}
+
+// Verify reports whether the receipt was signed with the server key.
+func (rc Receipt) Verify(key []byte) bool {
+	sig, err := hex.DecodeString(rc.Signature)
+	if err != nil {
+		return false
+	}
+	return hmac.Equal(sig, rc.sign(key))
+}
+
+func (rc Receipt) sign(key []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	fmt.Fprintf(mac, "%s\n%d\n%d", rc.Name, rc.Time.UnixNano(), rc.Index)
+	return mac.Sum(nil)
+}
+
+// AddReceipt keeps the receipt, dropping the oldest once maxReceipts is reached.
+func (of *OnionBuffer) AddReceipt(rc Receipt) {
+	of.Lock()
+	defer of.Unlock()
+	if len(of.Receipts) >= maxReceipts {
+		of.Receipts = of.Receipts[1:]
+	}
+	of.Receipts = append(of.Receipts, rc)
+}
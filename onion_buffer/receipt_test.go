@@ -0,0 +1,47 @@
+package onion_buffer
+
+import (
+	"testing"
+	"time"
+)
+
+func TestReceiptVerify(t *testing.T) {
+	key := []byte("0123456789abcdef0123456789abcdef")
+	valid := NewReceipt(key, "name", 1, time.Now())
+	otherName, otherIndex, otherTime, malformed := valid, valid, valid, valid
+	otherName.Name = "other"
+	otherIndex.Index = 2
+	otherTime.Time = valid.Time.Add(time.Second)
+	malformed.Signature = "zz"
+	for _, tc := range []struct {
+		name string
+		rc   Receipt
+		key  []byte
+		want bool
+	}{
+		{"valid", valid, key, true},
+		{"other key", valid, []byte("another key"), false},
+		{"other name", otherName, key, false},
+		{"other index", otherIndex, key, false},
+		{"other time", otherTime, key, false},
+		{"malformed signature", malformed, key, false},
+	} {
+		if got := tc.rc.Verify(tc.key); got != tc.want {
+			t.Errorf("%s: got %t, want %t", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestAddReceipt(t *testing.T) {
+	of := &OnionBuffer{}
+	for i := 1; i <= maxReceipts+3; i++ {
+		of.AddReceipt(Receipt{Index: i})
+	}
+	// Only the most recent are kept
+	if len(of.Receipts) != maxReceipts {
+		t.Fatalf("got %d receipts, want %d", len(of.Receipts), maxReceipts)
+	}
+	if first := of.Receipts[0].Index; first != 4 {
+		t.Errorf("oldest kept receipt is %d, want 4", first)
+	}
+}
@@ -0,0 +1,20 @@
+package onion_buffer
+
+// Store is where onionbox keeps its buffers. OnionStore is the in-memory
+// default; alternative backends only need to implement this interface.
+// After DestroyAll, Add must fail with ErrClosed. Reserve must check and
+// set aside bytes atomically.
+type Store interface {
+	Add(oBuffer *OnionBuffer) error
+	Get(bufName string) *OnionBuffer
+	Exists(bufName string) bool
+	Destroy(oBuffer *OnionBuffer) error
+	Rename(oBuffer *OnionBuffer, newName string) error
+	Tombstoned(bufName string) bool
+	DestroyAll() error
+	DestroyExpiredBuffers() error
+	List() []*OnionBuffer
+	TotalBytes() int64
+	Reserve(n, limit int64) bool
+	Release(n int64)
+}
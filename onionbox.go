@@ -5,19 +5,40 @@ import (
 	"bufio"
 	"bytes"
 	"context"
+	"crypto/ed25519"
 	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"html/template"
 	"io"
+	"io/ioutil"
 	"log"
+	"math"
+	"mime"
+	"mime/multipart"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"os/signal"
+	"path"
+	"path/filepath"
 	"regexp"
+	"runtime"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
+	"unicode"
+	"unicode/utf8"
 
 	"github.com/Pallinder/go-randomdata"
 	"github.com/cretz/bine/tor"
@@ -26,432 +47,2359 @@ import (
 	"onionbox/templates"
 )
 
+// maxFormValueSize is the largest non-file form value read from an upload.
+const maxFormValueSize = 1 << 10
+
+// maxFormMemory is how much of a multipart download form is parsed in
+// memory. Past it, files in the form spill to temp files.
+const maxFormMemory = 1 << 20
+
+// maxMemoryMB caps the memory flags so converting them to bytes can't overflow.
+const maxMemoryMB = 1 << 20
+
+// entropySampleSize is how much of each file is sampled to decide whether
+// it's worth deflating. Above maxDeflateEntropy bits per byte it isn't.
+const (
+	entropySampleSize = 8 << 10
+	maxDeflateEntropy = 7.5
+)
+
+// allowedContentTypes are the content types uploaders may serve their files as.
+var allowedContentTypes = map[string]bool{
+	"application/zip":              true,
+	"application/x-zip-compressed": true,
+	"application/octet-stream":     true,
+}
+
+// inlineContentTypes are the content types that may be served inline.
+// Anything a browser could run scripts in, like HTML or SVG, is left out.
+var inlineContentTypes = map[string]bool{
+	"image/png":       true,
+	"image/jpeg":      true,
+	"image/gif":       true,
+	"image/webp":      true,
+	"application/pdf": true,
+	"text/plain":      true,
+}
+
+// maxHintLen is the longest password hint in characters.
+const maxHintLen = 100
+
+// base62 is the alphabet of short link codes.
+const base62 = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+
+// minShortLen is the shortest allowed short link code, short enough to
+// type but still too many to enumerate over Tor.
+const minShortLen = 6
+
+// maxDisplayNameLen is the longest filename shown to recipients.
+const maxDisplayNameLen = 128
+
+// zipEpoch is the earliest time representable in a zip entry, used for
+// normalized modification times.
+var zipEpoch = time.Date(1980, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+// zipUTF8Flag is the general purpose bit marking a zip entry's name as UTF-8.
+const zipUTF8Flag = 0x800
+
 type onionbox struct {
-	debug       bool
-	logger      *log.Logger
-	store       *onion_buffer.OnionStore
+	debug  bool
+	logger *log.Logger
+	// errLogger writes to -error-log-file, or nowhere without it
+	errLogger   *log.Logger
+	store       onion_buffer.Store
 	maxMemory   int64
 	torVersion3 bool
 	onionURL    string
 	chunkSize   int
+	devListen   string
+	memBudget   int64
+	maxAttempts int
+	maxNameLen  int
+	maxEntries  int
+	normMtime   bool
+	defaultLang string
+	receipts    bool
+	receiptKey  []byte
+	allowPlain  bool
+	diskDir     string
+	insecureTmp bool
+	forbidSpill bool
+	quiet       bool
+	maxUploads  int
+	uploadSem   chan struct{}
+	noZipSingle bool
+	torRetries  int
+	maxStreams  int
+	allowV2     bool
+	skipDeflate bool
+	drainTime   time.Duration
+	trustProxy  *net.IPNet
+	publicHost  string
+	noZipExt    bool
+	uploadPass  []byte
+	logFile     string
+	errLogFile  string
+	logFiles    []*os.File
+	shortLen    int
+	// newName generates candidate buffer names, silly names by default
+	newName     func() string
+	signKey     ed25519.PrivateKey
+	idleTime    time.Duration
+	maxPassLen  int
+	uploadField string
+	banner      []string
+	serialize   bool
+	compress    bool
+	maxProcs    int
+	zipManifest bool
+	maxInFlight int
+	bufInFlight int
+	singleHop   bool
+	maxHeader   int
+	port        int
+	seedFiles   fileList
+	warnNonTor  bool
+	noTor       bool
+	cipher      onion_buffer.Cipher
+	publishTime time.Duration
+	verifyTime  time.Duration
+	checkTime   time.Duration
+	adminOnion  bool
+	adminToken  string
+	minTorVer   string
+	seeded      []*onion_buffer.OnionBuffer
+	// lastAdd is when the last buffer was added, in Unix nanoseconds
+	lastAdd int64
+	// inFlight counts the requests being handled
+	inFlight int32
+}
+
+// badUploadError marks an upload rejected because of its content
+// rather than a server fault.
+type badUploadError string
+
+func (e badUploadError) Error() string {
+	return string(e)
 }
 
+// errMemBudget is returned by budgetWriter once an upload would take the
+// store past -mem-budget.
+var errMemBudget = errors.New("memory budget exceeded")
+
 func main() {
 	// Create onionbox instance that stores config
+	store := onion_buffer.NewStore()
 	ob := onionbox{
-		logger: log.New(os.Stdout, "[onionbox] ", log.LstdFlags),
-		store:  onion_buffer.NewStore(),
+		logger:    log.New(os.Stdout, "[onionbox] ", log.LstdFlags),
+		errLogger: log.New(io.Discard, "[onionbox] ", log.LstdFlags),
+		store:     store,
+		newName:   sillyName,
 	}
 	// Init flags
 	flag.BoolVar(&ob.debug, "debug", false, "run in debug mode")
+	flag.BoolVar(&ob.quiet, "quiet", false, "only log errors and warnings")
 	flag.BoolVar(&ob.torVersion3, "torv3", true, "use version 3 of the Tor circuit")
 	flag.Int64Var(&ob.maxMemory, "mem", 128, "max memory allotted for handling file buffers")
 	flag.IntVar(&ob.chunkSize, "chunk", 1024, "size of chunks for buffer I/O")
+	flag.Int64Var(&ob.memBudget, "mem-budget", 0, "max memory in MB allotted to all stored buffers combined (0 for unlimited)")
+	flag.IntVar(&ob.maxAttempts, "max-attempts", 5, "failed password attempts before an encrypted buffer is locked out (0 to disable)")
+	flag.IntVar(&ob.maxNameLen, "max-filename-len", 255, "max length in bytes of an uploaded filename")
+	flag.IntVar(&ob.maxEntries, "max-entries", 1000, "max number of files in a single upload")
+	flag.BoolVar(&ob.normMtime, "normalize-mtime", false, "set the modification time of all zip entries to a fixed epoch and leave the upload time out of the manifest")
+	flag.StringVar(&ob.defaultLang, "default-lang", "en", "language of the web pages when the browser's preference isn't available")
+	flag.BoolVar(&ob.receipts, "receipts", false, "sign a receipt for every download that uploaders can retrieve")
+	flag.BoolVar(&ob.allowPlain, "allow-plaintext", true, "allow uploads that aren't password protected")
+	flag.StringVar(&ob.diskDir, "disk-dir", "", "store unencrypted zips as files in this tmpfs/ramfs directory instead of the heap")
+	flag.BoolVar(&ob.insecureTmp, "allow-insecure-tmp", false, "allow a -disk-dir that is world-writable or owned by another user")
+	flag.BoolVar(&ob.forbidSpill, "forbid-disk-spill", false, "reject multipart download forms too big to parse in memory instead of spilling them to temp files")
+	flag.IntVar(&ob.maxUploads, "max-concurrent-uploads", 0, "max number of uploads processed at once (0 for unlimited)")
+	flag.BoolVar(&ob.noZipSingle, "no-zip-single", false, "serve single unencrypted files as is instead of zipped")
+	flag.BoolVar(&ob.allowV2, "allow-v2-fallback", false, "fall back to a deprecated v2 onion service if v3 fails")
+	flag.IntVar(&ob.torRetries, "tor-start-retries", 3, "times to retry starting Tor and publishing the onion service")
+	flag.IntVar(&ob.maxStreams, "onion-max-streams", 0, "max concurrent streams per circuit, streams past it are dropped (0 for unlimited)")
+	flag.BoolVar(&ob.skipDeflate, "skip-incompressible", false, "store already compressed files (jpg, mp4, zip...) in the zip without deflating them")
+	flag.DurationVar(&ob.drainTime, "drain-timeout", 30*time.Second, "how long in-flight requests may take to finish when shutting down")
+	trustProxy := flag.String("trust-proxy", "", "IP or CIDR of a reverse proxy whose X-Forwarded-* headers are trusted")
+	flag.StringVar(&ob.publicHost, "public-host", "", "host shown in shared links instead of the onion address, e.g. files.example.onion")
+	flag.BoolVar(&ob.noZipExt, "disable-download-zip-extension", false, "don't add .zip to the filenames of downloads")
+	selftest := flag.Bool("selftest", false, "run the self-test without starting Tor and exit")
+	uploadPass := flag.String("upload-password", "", "require this password (HTTP Basic auth) to upload files")
+	flag.StringVar(&ob.logFile, "log-file", "", "append logs to this file instead of stdout, e.g. /var/log/onionbox/onionbox.log")
+	flag.StringVar(&ob.errLogFile, "error-log-file", "", "also append warnings and errors to this file")
+	flag.IntVar(&ob.shortLen, "short-links", 0, "use random base62 codes of this length in links instead of silly names (0 to disable)")
+	signChecksums := flag.Bool("sign-checksums", false, "sign the checksums of unencrypted buffers with a key published at "+signingKeyPath)
+	flag.BoolVar(&store.FreeOSMemory, "free-os-memory", false, "return memory to the OS as soon as a buffer is destroyed, at some CPU cost")
+	flag.DurationVar(&ob.idleTime, "idle-shutdown", 0, "shut down once no buffers have been stored for this long (0 to disable)")
+	flag.IntVar(&ob.maxPassLen, "max-password-len", 256, "max length in bytes of buffer passwords")
+	flag.StringVar(&ob.uploadField, "upload-field", "files", "name of the multipart form field files are uploaded in")
+	banner := flag.String("banner", "", "message shown at the top of the upload and download pages, \\n starts a new line")
+	bannerFile := flag.String("banner-file", "", "file with the message shown at the top of the upload and download pages")
+	flag.BoolVar(&ob.serialize, "serialize-downloads", false, "serve one download of a buffer at a time, others wait for it to finish")
+	flag.BoolVar(&ob.compress, "compress-at-rest", false, "gzip unzipped in-memory buffers (see -no-zip-single) while stored, trading CPU for memory")
+	flag.IntVar(&ob.maxProcs, "max-procs", 0, "max CPUs used at once (GOMAXPROCS), pair with -max-concurrent-uploads on small hosts (0 for all)")
+	flag.BoolVar(&ob.zipManifest, "include-manifest", false, "add a list of the uploaded files with their sizes and SHA-256 to each zip")
+	flag.IntVar(&ob.maxInFlight, "max-inflight", 0, "max requests handled at once, further ones get a 503 until one finishes (0 for unlimited)")
+	flag.IntVar(&ob.bufInFlight, "max-inflight-per-buffer", 0, "max requests handled at once for a single buffer, further ones get a 503 (0 for unlimited)")
+	flag.BoolVar(&ob.singleHop, "single-hop", false, "run a faster single-hop onion service that does NOT hide the server's location, for trusted internal use only")
+	flag.IntVar(&ob.maxHeader, "max-header-bytes", 16<<10, "max size in bytes of a request's headers, larger ones get a 431")
+	flag.IntVar(&ob.port, "port", 80, "virtual port of the onion service, no privileges are needed for ports below 1024")
+	flag.Var(&ob.seedFiles, "seed-file", "serve this file from startup, can be repeated")
+	flag.BoolVar(&ob.warnNonTor, "warn-non-tor", false, "warn visitors who reach the pages through -dev-listen or a Tor2web gateway that they aren't using Tor")
+	flag.BoolVar(&ob.noTor, "no-tor", false, "don't start Tor, only serve on -dev-listen, e.g. behind an onion service run elsewhere")
+	cipherName := flag.String("cipher", "aes-gcm", "cipher password protected buffers are encrypted with, aes-gcm or chacha20-poly1305 (faster without AES instructions, e.g. on ARM)")
+	flag.DurationVar(&ob.publishTime, "publish-timeout", 3*time.Minute, "how long to wait for the onion service to be published before retrying")
+	flag.StringVar(&ob.minTorVer, "min-tor-version", "", "refuse to start if the running Tor is older than this version, e.g. 0.4.8")
+	flag.BoolVar(&ob.adminOnion, "admin-onion", false, "publish a second onion service serving the admin API, authenticated with the token in $"+adminTokenEnv+" or one printed to stderr at startup")
+	flag.DurationVar(&ob.checkTime, "integrity-interval", 0, "validate every buffer's checksum this often and quarantine the ones that fail (0 to disable)")
+	flag.DurationVar(&ob.verifyTime, "verify-publish", 0, "after publishing, connect to the onion service through Tor for up to this long and republish if it isn't reachable, 0 to skip")
+	flag.StringVar(&ob.devListen, "dev-listen", "", "also serve on this local address without Tor, e.g. 127.0.0.1:8080 (insecure)")
 	// Parse flags
 	flag.Parse()
-
-	// Start tor
-	ob.logf("Starting and registering onion service, please wait...")
-	t, err := tor.Start(nil, &tor.StartConf{
-		ProcessCreator: libtor.Creator,
-		DebugWriter:    os.Stderr,
-	})
+	ob.openLogs()
+	if err := ob.validateFlags(); err != nil {
+		ob.fatalf("Invalid flags: %v", err)
+	}
+	ob.applyMaxProcs()
+	c, err := onion_buffer.ParseCipher(*cipherName)
 	if err != nil {
-		ob.logf("Failed to start Tor: %v", err)
-		os.Exit(1)
+		ob.fatalf("Invalid flags: -cipher: %v", err)
 	}
-	defer func() {
-		if err := t.Close(); err != nil {
-			ob.logf("Error closing connection to Tor: %v", err)
+	ob.cipher = c
+	if ob.shortLen > 0 {
+		ob.newName = func() string { return shortCode(ob.shortLen) }
+	}
+	// Spilled form files belong on the secured tmpfs, not in /tmp
+	if ob.diskDir != "" {
+		if err := os.Setenv("TMPDIR", ob.diskDir); err != nil {
+			ob.fatalf("Error setting TMPDIR: %v", err)
+		}
+	}
+	// Only keep a hash of the upload password around
+	if *uploadPass != "" {
+		hash := sha256.Sum256([]byte(*uploadPass))
+		ob.uploadPass = hash[:]
+		*uploadPass = ""
+	}
+	if *trustProxy != "" {
+		ipNet, err := parseIPNet(*trustProxy)
+		if err != nil {
+			ob.fatalf("Invalid flags: -trust-proxy: %v", err)
+		}
+		ob.trustProxy = ipNet
+	}
+	if *bannerFile != "" {
+		b, err := ioutil.ReadFile(*bannerFile)
+		if err != nil {
+			ob.fatalf("Invalid flags: -banner-file: %v", err)
+		}
+		*banner = string(b)
+	}
+	ob.banner = bannerLines(strings.Replace(*banner, `\n`, "\n", -1))
+	if !templates.HasLang(ob.defaultLang) {
+		ob.infof("Unknown default language %q, using en", ob.defaultLang)
+		ob.defaultLang = "en"
+	}
+	if ob.maxUploads > 0 {
+		ob.uploadSem = make(chan struct{}, ob.maxUploads)
+	}
+	// Create key for signing download receipts
+	if ob.receipts {
+		ob.receiptKey = make([]byte, 32)
+		if _, err := rand.Read(ob.receiptKey); err != nil {
+			ob.errorf("Error creating receipt key: %v", err)
 			os.Exit(1)
 		}
-	}()
+	}
+	// Create key for signing checksums
+	if *signChecksums {
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			ob.alertf("Error creating signing key: %v", err)
+			os.Exit(1)
+		}
+		ob.signKey = key
+	}
+
+	// Run the self-test instead of serving
+	if *selftest {
+		if !ob.selftest() {
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
+	// Store the seed files before anyone can connect
+	if err := ob.seed(); err != nil {
+		ob.fatalf("Invalid flags: -seed-file: %v", err)
+	}
+
+	// Stop onionbox on interrupt
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if err := ob.Run(ctx); err != nil {
+		ob.alertf("Error running onionbox: %v", err)
+		stop()
+		os.Exit(1)
+	}
+}
 
-	// Wait at most a few minutes to publish the service
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Minute)
+// Run publishes the onion service and serves it until ctx is done, the
+// server fails or -idle-shutdown triggers, then drains in-flight requests
+// and wipes all buffers. A failed server makes it return an error, so
+// main exits non-zero.
+func (ob *onionbox) Run(ctx context.Context) (err error) {
+	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
 
-	// Create an onion service to listen on any port but show as 80
-	onionSvc, err := t.Listen(ctx, &tor.ListenConf{RemotePorts: []int{80}, Version3: ob.torVersion3})
+	handler := ob.handler()
+
+	// Reopen the log files on SIGHUP after they've been rotated
+	if ob.logFile != "" || ob.errLogFile != "" {
+		hupCh := make(chan os.Signal, 1)
+		signal.Notify(hupCh, syscall.SIGHUP)
+		defer signal.Stop(hupCh)
+		go func() {
+			for {
+				select {
+				case <-hupCh:
+					ob.openLogs()
+					ob.infof("Reopened log files")
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+	}
+
+	// Every server is drained before the buffers are wiped
+	var servers []*http.Server
+	var listener net.Listener
+	if ob.noTor {
+		// Whatever fronts onionbox is trusted to provide the anonymity
+		ob.alertf("WARNING: Tor is disabled, serving on http://%s only. Put it behind your own onion service.", ob.devListen)
+		listener, err = net.Listen("tcp", ob.devListen)
+		if err != nil {
+			return fmt.Errorf("listening on %s: %v", ob.devListen, err)
+		}
+	} else {
+		// Serve the same handlers locally so the UI can be tested without Tor
+		if ob.devListen != "" {
+			ob.alertf("WARNING: serving on http://%s without Tor. This is INSECURE and meant for development only!", ob.devListen)
+			devSrv := ob.newServer(devHandler(handler))
+			devSrv.Addr = ob.devListen
+			go func() {
+				if err := devSrv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+					ob.alertf("Error serving dev listener: %v", err)
+				}
+			}()
+			defer devSrv.Close()
+			servers = append(servers, devSrv)
+		}
+		onionSvc, adminSvc, closeTor, err := ob.publishOnion(ctx)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			if cerr := closeTor(); cerr != nil && err == nil {
+				err = cerr
+			}
+		}()
+		listener = onionSvc
+		ob.onionURL = onionSvc.ID
+		ob.infof("Please open a Tor capable browser and navigate to http://%s\n", ob.onionHost())
+		// The admin API is only served on its own onion service
+		if adminSvc != nil {
+			created, err := ob.loadAdminToken()
+			if err != nil {
+				return err
+			}
+			adminSrv := ob.newServer(ob.adminHandler())
+			go func() {
+				if err := adminSrv.Serve(adminSvc); err != nil && err != http.ErrServerClosed {
+					ob.alertf("Error serving admin onion service: %v", err)
+				}
+			}()
+			defer adminSrv.Close()
+			servers = append(servers, adminSrv)
+			ob.infof("Admin API at http://%s.onion/buffers", adminSvc.ID)
+			// Never logged, log files get rotated and shipped elsewhere
+			if created {
+				fmt.Fprintf(os.Stderr, "Admin API token, send it in the X-Onionbox-Admin-Token header: %s\n", ob.adminToken)
+			}
+		}
+	}
+	for _, oBuffer := range ob.seeded {
+		ob.infof("Serving seeded file %s at %s", oBuffer.DisplayName, ob.shareURL(nil, oBuffer.CurrentName()))
+	}
+
+	if ob.idleTime > 0 {
+		go ob.watchIdle(ctx, cancel)
+	}
+	if ob.checkTime > 0 {
+		go ob.watchIntegrity(ctx)
+	}
+	// Dump the store's state on SIGUSR1 when debugging
+	if ob.debug {
+		dumpCh := make(chan os.Signal, 1)
+		signal.Notify(dumpCh, syscall.SIGUSR1)
+		defer signal.Stop(dumpCh)
+		go func() {
+			for {
+				select {
+				case <-dumpCh:
+					ob.dumpStore()
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+	}
+
+	return ob.serve(ctx, listener, handler, servers...)
+}
+
+// newServer returns a server for handler. Every listener gets the same
+// timeouts, so none of them can be held open by a slow client.
+func (ob *onionbox) newServer(handler http.Handler) *http.Server {
+	return &http.Server{
+		IdleTimeout:    time.Second * 60,
+		ReadTimeout:    time.Second * 60,
+		WriteTimeout:   time.Second * 60,
+		MaxHeaderBytes: ob.maxHeader,
+		Handler:        handler,
+	}
+}
+
+// serve serves handler on listener until ctx is done or serving fails,
+// then drains it along with the other servers and wipes all buffers. It
+// returns the error serving failed with, if any.
+func (ob *onionbox) serve(ctx context.Context, listener net.Listener, handler http.Handler, servers ...*http.Server) error {
+	// Init serving
+	srv := ob.newServer(handler)
+	// Begin serving
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- srv.Serve(listener)
+	}()
+	var err error
+	select {
+	case err = <-errCh:
+	case <-ctx.Done():
+	}
+	// Let in-flight requests finish, then wipe all buffers
+	ob.drain(append(servers, srv)...)
+	if err != nil && err != http.ErrServerClosed {
+		return fmt.Errorf("serving onionbox: %v", err)
+	}
+	return nil
+}
+
+// handler routes the requests of the onion service and -dev-listen.
+func (ob *onionbox) handler() http.Handler {
+	// Static assets are registered before the catch-all
+	mux := http.NewServeMux()
+	mux.HandleFunc("/favicon.ico", ob.favicon)
+	mux.HandleFunc("/static/", ob.static)
+	mux.HandleFunc(signingKeyPath, ob.signingKey)
+	mux.HandleFunc("/", ob.router)
+	return ob.limitInFlight(mux)
+}
+
+// publishOnion starts Tor and publishes the onion service, and with
+// -admin-onion the admin one. closeTor shuts them all down again.
+func (ob *onionbox) publishOnion(ctx context.Context) (onionSvc, adminSvc *tor.OnionService, closeTor func() error, err error) {
+	if ob.singleHop {
+		ob.alertf("WARNING: single-hop mode is enabled. The onion service does NOT hide this server's location or IP address!")
+	}
+	// Start tor
+	ob.infof("Starting and registering onion service, please wait...")
+	var t *tor.Tor
+	err = ob.retry(ctx, "Starting Tor", ob.torRetries, func() (err error) {
+		t, err = tor.Start(ctx, ob.torStartConf())
+		return err
+	})
 	if err != nil {
-		ob.logf("Failed to create onion service: %v", err)
-		os.Exit(1)
+		return nil, nil, nil, fmt.Errorf("starting Tor: %v", err)
+	}
+	closeTor = func() error {
+		if err := t.Close(); err != nil {
+			return fmt.Errorf("closing connection to Tor: %v", err)
+		}
+		return nil
+	}
+	if err := ob.checkTorVersion(t); err != nil {
+		closeTor()
+		return nil, nil, nil, err
+	}
+
+	publish := func() (err error) {
+		err = ob.listenWithTimeout(ctx, func(listenCtx context.Context) (err error) {
+			onionSvc, err = t.Listen(listenCtx, ob.listenConf())
+			return err
+		})
+		if err != nil || ob.verifyTime <= 0 {
+			return err
+		}
+		// A published service whose descriptor never propagated is a dead link
+		if err := ob.verifyOnion(ctx, t, onionSvc); err != nil {
+			onionSvc.Close()
+			return fmt.Errorf("verifying onion service: %v", err)
+		}
+		return nil
+	}
+	if err := ob.publishWithFallback(ctx, publish); err != nil {
+		closeTor()
+		return nil, nil, nil, err
 	}
-	defer func() {
+	if ob.adminOnion {
+		err = ob.retry(ctx, "Publishing admin onion service", ob.torRetries, func() error {
+			return ob.listenWithTimeout(ctx, func(listenCtx context.Context) (err error) {
+				adminSvc, err = t.Listen(listenCtx, &tor.ListenConf{
+					RemotePorts:  []int{80},
+					Version3:     ob.torVersion3,
+					NonAnonymous: ob.singleHop,
+				})
+				return err
+			})
+		})
+		if err != nil {
+			onionSvc.Close()
+			closeTor()
+			return nil, nil, nil, fmt.Errorf("creating admin onion service: %v", err)
+		}
+	}
+	return onionSvc, adminSvc, func() error {
+		// Shutting down the servers already closed the listeners
 		if err := onionSvc.Close(); err != nil {
-			ob.logf("Error closing connection to onion service: %v", err)
-			os.Exit(1)
+			ob.errorf("Error closing connection to onion service: %v", err)
 		}
-	}()
+		if adminSvc != nil {
+			if err := adminSvc.Close(); err != nil {
+				ob.errorf("Error closing connection to admin onion service: %v", err)
+			}
+		}
+		return closeTor()
+	}, nil
+}
 
-	ob.onionURL = onionSvc.ID
-	ob.logf("Please open a Tor capable browser and navigate to http://%v.onion\n", onionSvc.ID)
+// verifyOnion connects to the onion service through Tor until it's
+// reachable, giving up after ob.verifyTime.
+func (ob *onionbox) verifyOnion(ctx context.Context, t *tor.Tor, onionSvc *tor.OnionService) error {
+	ctx, cancel := context.WithTimeout(ctx, ob.verifyTime)
+	defer cancel()
+	dialer, err := t.Dialer(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("creating dialer: %v", err)
+	}
+	return ob.reachOnion(ctx, dialer.DialContext, onionSvc.ID)
+}
 
-	// Init routes
-	http.HandleFunc("/", ob.router)
-	// Init serving
-	srv := &http.Server{
-		IdleTimeout:  time.Second * 60,
-		ReadTimeout:  time.Second * 60,
-		WriteTimeout: time.Second * 60,
-		Handler:      nil,
+// verifyInterval is how long to wait between attempts to reach a freshly
+// published onion service.
+var verifyInterval = 5 * time.Second
+
+// reachOnion dials the onion service id with dial until it connects or
+// ctx is done.
+func (ob *onionbox) reachOnion(ctx context.Context, dial func(ctx context.Context, network, addr string) (net.Conn, error), id string) error {
+	addr := net.JoinHostPort(id+".onion", strconv.Itoa(ob.port))
+	for {
+		conn, err := dial(ctx, "tcp", addr)
+		if err == nil {
+			ob.logf("Reached onion service %s", id)
+			return conn.Close()
+		}
+		ob.logf("Onion service %s not reachable yet: %v", id, err)
+		select {
+		case <-time.After(verifyInterval):
+		case <-ctx.Done():
+			return fmt.Errorf("not reachable within %v: %v", ob.verifyTime, err)
+		}
 	}
-	// Begin serving
-	go ob.logger.Fatal(srv.Serve(onionSvc))
-	// Proper srv shutdown when program ends
-	defer func() {
-		if err := srv.Shutdown(context.Background()); err != nil {
-			ob.logf("Error shutting down onionbox srv: %v", err)
-			os.Exit(1)
+}
+
+// limitInFlight turns requests away with a 503 while -max-inflight requests
+// are being handled, rather than letting them queue up on a saturated server.
+func (ob *onionbox) limitInFlight(next http.Handler) http.Handler {
+	if ob.maxInFlight <= 0 {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&ob.inFlight, 1)
+		defer atomic.AddInt32(&ob.inFlight, -1)
+		if int(n) > ob.maxInFlight {
+			ob.logf("Refusing request, %d requests in flight", n-1)
+			w.Header().Set("Retry-After", "30")
+			ob.httpError(w, r, "The server is busy, please try again shortly.", http.StatusServiceUnavailable)
+			return
 		}
-	}()
+		next.ServeHTTP(w, r)
+	})
+}
+
+// bufferBusy turns a request away with a 503 when it's one of more than
+// -max-inflight-per-buffer requests in flight for the buffer, n being the
+// count BeginDownload returned for it.
+func (ob *onionbox) bufferBusy(w http.ResponseWriter, r *http.Request, oBuffer *onion_buffer.OnionBuffer, n int) bool {
+	if ob.bufInFlight <= 0 || n <= ob.bufInFlight {
+		return false
+	}
+	ob.logf("Refusing request for %s, %d requests for it in flight", oBuffer.CurrentName(), n-1)
+	w.Header().Set("Retry-After", "30")
+	ob.httpError(w, r, "This file is busy, please try again shortly.", http.StatusServiceUnavailable)
+	return true
+}
+
+// ctxKey is the type of the request context keys set by onionbox, so
+// they can't be set or overridden from outside.
+type ctxKey int
+
+const (
+	// bufferNameKey holds the name of the buffer the router resolved
+	bufferNameKey ctxKey = iota
+	// devListenerKey marks requests that came in through -dev-listen
+	devListenerKey
+)
+
+// devHandler serves the requests of -dev-listen with next, marking them
+// as not coming through Tor.
+func devHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), devListenerKey, true)))
+	})
+}
+
+// viaNonTor reports whether the request came in through the dev listener
+// or a Tor2web gateway rather than a Tor client.
+func viaNonTor(r *http.Request) bool {
+	dev, _ := r.Context().Value(devListenerKey).(bool)
+	return dev || r.Header.Get("X-Tor2web") != ""
+}
+
+// bufferName returns the name of the buffer the router resolved for r.
+func bufferName(r *http.Request) string {
+	name, _ := r.Context().Value(bufferNameKey).(string)
+	return name
 }
 
 func (ob *onionbox) router(w http.ResponseWriter, r *http.Request) {
 	// Set download url regex
-	downloadURLreg := regexp.MustCompile(`((?:[a-z][a-z]+))`)
+	downloadURLreg := regexp.MustCompile(`^/[0-9A-Za-z]+/?$`)
 	if r.URL.Path == "/" {
 		ob.upload(w, r)
+	} else if strings.HasPrefix(r.URL.Path, "/api/buffer/") {
+		ob.api(w, r)
 	} else if matches := downloadURLreg.FindStringSubmatch(r.URL.Path); matches != nil {
 		if ob.store != nil {
-			if ob.store.Exists(r.URL.Path[1:]) {
-				r.Header.Set("filename", r.URL.Path[1:])
-				ob.download(w, r)
+			name := onion_buffer.NormalizeName(r.URL.Path)
+			if ob.store.Exists(name) {
+				ob.download(w, r.WithContext(context.WithValue(r.Context(), bufferNameKey, name)))
+			} else if ob.store.Tombstoned(name) {
+				ob.httpError(w, r, "This link has been replaced by the uploader.", http.StatusGone)
+			} else {
+				ob.httpError(w, r, "File not found", http.StatusNotFound)
 			}
 		} else {
-			http.Error(w, "File not found", http.StatusNotFound)
+			ob.httpError(w, r, "File not found", http.StatusNotFound)
 			return
 		}
 	} else {
-		http.Error(w, "404 page not found", http.StatusNotFound)
+		ob.httpError(w, r, "404 page not found", http.StatusNotFound)
 	}
 }
 
 func (ob *onionbox) upload(w http.ResponseWriter, r *http.Request) {
+	// Only show the upload page and accept uploads with the upload password
+	if !ob.uploadAuthorized(r) {
+		w.Header().Set("WWW-Authenticate", `Basic realm="onionbox upload", charset="UTF-8"`)
+		ob.httpError(w, r, "Unauthorized.", http.StatusUnauthorized)
+		return
+	}
 	switch r.Method {
 	case http.MethodGet:
-		csrf, err := createCSRF()
-		if err != nil {
-			ob.logf("Error creating CSRF token: %v", err)
-			http.Error(w, "Error displaying web page, please try refreshing.", http.StatusInternalServerError)
-			return
-		}
-		// Parse template
-		t, err := template.New("upload").Parse(templates.UploadHTML)
-		if err != nil {
-			ob.logf("Error loading template: %v", err)
-			http.Error(w, "Error displaying web page, please try refreshing.", http.StatusInternalServerError)
+		ob.render(w, r, "upload", templates.UploadHTML, templates.Page{UploadField: ob.uploadField})
+	case http.MethodPost:
+		// Limit the number of uploads being processed at once
+		release, ok := ob.acquireUpload(w, r)
+		if !ok {
 			return
 		}
-		// Execute template
-		if err := t.Execute(w, csrf); err != nil {
-			ob.logf("Error executing template: %v", err)
-			http.Error(w, "Error displaying web page, please try refreshing.", http.StatusInternalServerError)
+		defer release()
+		if !isMultipart(r) {
+			ob.httpError(w, r, fmt.Sprintf(multipartRequired, ob.uploadField), http.StatusUnsupportedMediaType)
 			return
 		}
-	case http.MethodPost:
-		// Parse file(s) from form
-		if err := r.ParseMultipartForm(ob.maxMemory << 20); err != nil {
-			ob.logf("Error parsing files from form: %v", err)
-			http.Error(w, "Error parsing files.", http.StatusInternalServerError)
+		// Cap the size of the request body
+		r.Body = http.MaxBytesReader(w, r.Body, ob.maxMemory<<20)
+		// Stream the form instead of parsing it, ParseMultipartForm
+		// would spill large files to temp files on disk.
+		mpReader, err := r.MultipartReader()
+		if err != nil {
+			ob.errorf("Error reading multipart form: %v", err)
+			ob.httpError(w, r, "Malformed upload form.", http.StatusBadRequest)
 			return
 		}
 		// Create buffer for session in-memory zip file
 		zipBuffer := new(bytes.Buffer)
 		// Lock memory allotted to zipBuffer from being used in SWAP
 		if err := syscall.Mlock(zipBuffer.Bytes()); err != nil {
-			ob.logf("Error mlocking allotted memory for zipBuffer: %v", err)
-		}
-		zWriter := zip.NewWriter(zipBuffer)
-		files := r.MultipartForm.File["files"]
-		// Loop through all files in the form
-		for _, fileHeader := range files {
-			// Open uploaded file
-			file, err := fileHeader.Open()
-			if err != nil {
-				ob.logf("Error opening file %s: %v", fileHeader.Filename, err)
-				http.Error(w, "Error uploading files.", http.StatusInternalServerError)
-				return
-			}
-			// Create file in zip with same name
-			bufFile, err := zWriter.Create(fileHeader.Filename)
+			ob.errorf("Error mlocking allotted memory for zipBuffer: %v", err)
+		}
+		// Reserve the memory budget as the zip grows, not once it's whole
+		budget := &budgetWriter{ob: ob, w: zipBuffer}
+		defer budget.release()
+		var zipDst io.Writer = budget
+		// Write the zip to a file on the configured tmpfs instead
+		var zipFile *os.File
+		if ob.diskDir != "" {
+			zipFile, err = ioutil.TempFile(ob.diskDir, "onionbox-")
 			if err != nil {
-				ob.logf("Error creating new file in zip: %v", err)
-				http.Error(w, "Error uploading files.", http.StatusInternalServerError)
+				ob.errorf("Error creating zip file: %v", err)
+				ob.httpError(w, r, "Error uploading files.", http.StatusInternalServerError)
 				return
 			}
-			// Read uploaded file
-			var count int
-			reader := bufio.NewReader(file)
-			chunk := make([]byte, ob.chunkSize)
-			// Lock memory allotted to chunk from being used in SWAP
-			if err := syscall.Mlock(chunk); err != nil {
-				ob.logf("Error mlocking allotted memory for chunk: %v", err)
-			}
-			for {
-				if count, err = reader.Read(chunk); err != nil {
-					break
+			// Wipe the file unless it ends up stored
+			defer func() {
+				if zipFile != nil {
+					zipFile.Close()
+					if err := onion_buffer.WipeFile(zipFile.Name()); err != nil {
+						ob.errorf("Error wiping zip file: %v", err)
+					}
 				}
-				_, err := bufFile.Write(chunk[:count])
-				if err != nil {
-					ob.logf("Error writing file to zip: %v", err)
-					http.Error(w, "Error writing file to zip", http.StatusInternalServerError)
-					return
-				}
-			}
-			if err != io.EOF {
-				ob.logf("Error reading uploaded file: %v", err)
-				http.Error(w, "Error reading uploaded file.", http.StatusInternalServerError)
-				return
-			} else {
-				err = nil
-			}
-			// Flush zipwriter to write compressed bytes to buffer
-			if err := zWriter.Flush(); err != nil {
-				ob.logf("Error flushing zip writer: %v", err)
-			}
+			}()
+			zipDst = zipFile
 		}
-		// Close zipwriter
-		if err := zWriter.Close(); err != nil {
-			ob.logf("Error closing zip writer: %v", err)
-		}
-		// Create random zip name
-		zipBufferName := strings.ToLower(randomdata.SillyName())
-		// Create OnionBuffer object
-		oBuffer := &onion_buffer.OnionBuffer{Name: zipBufferName, CreatedAt: time.Now()}
-		// If password option was enabled
-		if r.FormValue("password_enabled") == "on" {
-			var err error
-			pass := r.FormValue("password")
-			oBuffer.Bytes, err = onion_buffer.Encrypt(zipBuffer.Bytes(), pass)
-			if err != nil {
-				ob.logf("Error encrypting buffer: %v", err)
-				http.Error(w, "Error encrypting buffer.", http.StatusInternalServerError)
-				return
-			}
-			// Lock memory allotted to oBuffer from being used in SWAP
-			if err := syscall.Mlock(oBuffer.Bytes); err != nil {
-				ob.logf("Error mlocking allotted memory for oBuffer: %v", err)
-			}
-			oBuffer.Encrypted = true
-			chksm, err := oBuffer.GetChecksum()
-			if err != nil {
-				ob.logf("Error getting checksum: %v", err)
-				http.Error(w, "Error getting checksum.", http.StatusInternalServerError)
+		zWriter := zip.NewWriter(zipDst)
+		// Write all files in the form to the zip
+		form := make(url.Values)
+		entries, err := ob.writeFilesToBuffers(zWriter, mpReader, form)
+		if err != nil {
+			if e, ok := err.(badUploadError); ok {
+				ob.httpError(w, r, e.Error(), http.StatusBadRequest)
 				return
 			}
-			oBuffer.Checksum = chksm
-		} else {
-			oBuffer.Bytes = zipBuffer.Bytes()
-			// Lock memory allotted to oBuffer from being used in SWAP
-			if err := syscall.Mlock(oBuffer.Bytes); err != nil {
-				ob.logf("Error mlocking allotted memory for oBuffer: %v", err)
-			}
-			// Get checksum
-			chksm, err := oBuffer.GetChecksum()
-			if err != nil {
-				ob.logf("Error getting checksum: %v", err)
-				http.Error(w, "Error getting checksum.", http.StatusInternalServerError)
+			if err == errMemBudget {
+				ob.refuseMemBudget(w, r, budget.reserved)
 				return
 			}
-			oBuffer.Checksum = chksm
+			ob.errorf("Error writing files to zip: %v", err)
+			ob.httpError(w, r, "Error uploading files.", http.StatusInternalServerError)
+			return
 		}
-		// If limit downloads was enabled
-		if r.FormValue("limit_downloads") == "on" {
-			form := r.FormValue("download_limit")
-			limit, err := strconv.Atoi(form)
-			if err != nil {
-				ob.logf("Error converting duration string into time.Duration: %v", err)
-				http.Error(w, "Error getting expiration time.", http.StatusInternalServerError)
+		// Separate links get one file each, a manifest makes no sense there
+		if ob.zipManifest && form.Get("separate_links") != "on" {
+			if err := writeZipManifest(zWriter, entries, form, ob.normMtime); err != nil {
+				if err == errMemBudget {
+					ob.refuseMemBudget(w, r, budget.reserved)
+					return
+				}
+				ob.errorf("Error writing manifest to zip: %v", err)
+				ob.httpError(w, r, "Error uploading files.", http.StatusInternalServerError)
 				return
 			}
-			oBuffer.DownloadLimit = limit
 		}
-		// if expiration was enabled
-		if r.FormValue("expire") == "on" {
-			expiration := fmt.Sprintf("%sm", r.FormValue("expiration_time"))
-			t, err := time.ParseDuration(expiration)
-			if err != nil {
-				ob.logf("Error parsing expiration time: %v", err)
-				http.Error(w, "Error parsing expiration time.", http.StatusInternalServerError)
+		// Close zipwriter, a zip without its central directory is unusable
+		if err := zWriter.Close(); err != nil {
+			if err == errMemBudget {
+				ob.refuseMemBudget(w, r, budget.reserved)
 				return
 			}
-			oBuffer.ExpiresAt = oBuffer.CreatedAt.Add(t)
-		}
-		// Append onion file to filestore
-		if err := ob.store.Add(oBuffer); err != nil {
-			ob.logf("Error adding file to store: %v", err)
-			http.Error(w, "Error adding file to store.", http.StatusInternalServerError)
-			return
-		}
-		// Set temp oBuffer var to nil
-		if err := oBuffer.Destroy(); err != nil {
-			ob.logf("Error destroying temporary var for %s", oBuffer.Name)
-		}
-		// Write the zip's URL to client for sharing
-		_, err := w.Write([]byte(fmt.Sprintf("Files uploaded. Please share this link with your recipients: http://%s.onion/%s",
-			ob.onionURL, oBuffer.Name)))
-		if err != nil {
-			ob.logf("Error writing to client: %v", err)
-			http.Error(w, "Error writing to client.", http.StatusInternalServerError)
+			ob.errorf("Error closing zip writer: %v", err)
+			ob.httpError(w, r, "Error uploading files.", http.StatusInternalServerError)
 			return
 		}
-	default:
-		http.Error(w, "Invalid HTTP Method.", http.StatusMethodNotAllowed)
-	}
-}
-
-func (ob *onionbox) download(w http.ResponseWriter, r *http.Request) {
-	switch r.Method {
-	case http.MethodGet:
-		oBuffer := ob.store.Get(r.Header.Get("filename"))
-		if oBuffer == nil {
-			http.Error(w, "Nil file", http.StatusInternalServerError)
+		// Refuse to store anything unencrypted if plaintext isn't allowed
+		if !ob.allowPlain && form.Get("password_enabled") != "on" {
+			ob.httpError(w, r, "Uploads must be password protected.", http.StatusBadRequest)
 			return
 		}
-		if oBuffer.Encrypted {
-			csrf, err := createCSRF()
-			if err != nil {
-				ob.logf("Error creating CSRF token: %v", err)
-				http.Error(w, "Error displaying web page, please try refreshing.", http.StatusInternalServerError)
-				return
-			}
-			// Parse template
-			t, err := template.New("download_encrypted").Parse(templates.DownloadHTML)
-			if err != nil {
-				ob.logf("Error loading template: %v", err)
-				http.Error(w, "Error displaying web page, please try refreshing.", http.StatusInternalServerError)
-				return
-			}
-			// Execute template
-			if err := t.Execute(w, csrf); err != nil {
-				ob.logf("Error executing template: %v", err)
-				http.Error(w, "Error displaying web page, please try refreshing.", http.StatusInternalServerError)
+		// Encrypted buffers and separate links are kept in memory, read
+		// the zip back from disk
+		separate := form.Get("separate_links") == "on"
+		if zipFile != nil && (form.Get("password_enabled") == "on" || separate) {
+			if _, err := zipFile.Seek(0, io.SeekStart); err != nil {
+				ob.errorf("Error seeking zip file: %v", err)
+				ob.httpError(w, r, "Error uploading files.", http.StatusInternalServerError)
 				return
 			}
-		} else {
-			if oBuffer.DownloadLimit > 0 && oBuffer.Downloads >= oBuffer.DownloadLimit {
-				if err := ob.store.Delete(oBuffer); err != nil {
-					ob.logf("Error deleting onion file from store: %v", err)
+			if _, err := io.Copy(budget, zipFile); err != nil {
+				if err == errMemBudget {
+					ob.refuseMemBudget(w, r, budget.reserved)
+					return
 				}
-				ob.logf("Download limit reached for %s", oBuffer.Name)
-				http.Error(w, "Download limit reached.", http.StatusUnauthorized)
-				return
-			}
-			// Check expiration
-			//if oBuffer.IsExpired() {
-			//	if err := oBuffer.Destroy(); err != nil {
-			//		ob.logf("Error destroying buffer %s: %v", oBuffer.Name, err)
-			//	}
-			//	http.Error(w, "Download link has expired", http.StatusUnauthorized)
-			//	return
-			//}
-			// Validate checksum
-			chksmValid, err := oBuffer.ValidateChecksum()
-			if err != nil {
-				ob.logf("Error validating checksum: %v", err)
-				http.Error(w, "Error validating checksum.", http.StatusInternalServerError)
-				return
-			}
-			if !chksmValid {
-				ob.logf("Invalid checksum for file %s", oBuffer.Name)
-				http.Error(w, "Invalid checksum.", http.StatusInternalServerError)
-				return
-			}
-			// Increment files download count
-			oBuffer.Downloads++
-			// Set headers for browser to initiate download
-			w.Header().Set("Content-Type", "application/zip")
-			w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%s.zip", oBuffer.Name))
-			// Write the zip bytes to the response for download
-			_, err = w.Write(oBuffer.Bytes)
-			if err != nil {
-				ob.logf("Error writing to client: %v", err)
-				http.Error(w, "Error writing to client.", http.StatusInternalServerError)
+				ob.errorf("Error reading zip file: %v", err)
+				ob.httpError(w, r, "Error uploading files.", http.StatusInternalServerError)
 				return
 			}
 		}
-	// If buffer was password protected
-	case http.MethodPost:
-		of := ob.store.Get(r.Header.Get("filename"))
-		if of == nil {
-			http.Error(w, "Nil file", http.StatusInternalServerError)
+		// Encrypting holds both the plaintext and ciphertext copies at once
+		if form.Get("password_enabled") == "on" && !budget.reserve(int64(zipBuffer.Len())) {
+			ob.refuseMemBudget(w, r, budget.reserved+int64(zipBuffer.Len()))
 			return
 		}
-		if of.DownloadLimit > 0 && of.Downloads >= of.DownloadLimit {
-			if err := ob.store.Delete(of); err != nil {
-				ob.logf("Error deleting onion file from store: %v", err)
+		// Give every file its own zip and link if asked to
+		if separate {
+			zips, err := splitZip(zipBuffer.Bytes())
+			if err != nil {
+				ob.errorf("Error splitting zip: %v", err)
+				ob.httpError(w, r, "Error uploading files.", http.StatusInternalServerError)
+				return
+			}
+			var results []uploadResult
+			for _, zb := range zips {
+				oBuffer, err := ob.storeUpload(zb, nil, form)
+				if err != nil {
+					// Don't leave half of a batch behind
+					for _, result := range results {
+						if err := ob.store.Destroy(result.oBuffer); err != nil {
+							ob.errorf("Error destroying buffer %s: %v", result.oBuffer.CurrentName(), err)
+						}
+					}
+					ob.uploadFailed(w, r, err)
+					return
+				}
+				results = append(results, ob.newUploadResult(r, oBuffer, 1))
 			}
-			ob.logf("Download limit reached for %s", of.Name)
-			http.Error(w, "Download limit reached.", http.StatusUnauthorized)
+			ob.writeUploadResults(w, r, results)
 			return
 		}
-		// Check expiration
-		//if of.IsExpired() {
-		//	if err := of.Destroy(); err != nil {
-		//		ob.logf("Error destroying buffer %s: %v", of.Name, err)
-		//	}
-		//	http.Error(w, "Download link has expired", http.StatusUnauthorized)
-		//	return
-		//}
-		// Validate checksum
-		chksmValid, err := of.ValidateChecksum()
+		oBuffer, err := ob.storeUpload(zipBuffer, zipFile, form)
 		if err != nil {
-			ob.logf("Error validating checksum: %v", err)
-			http.Error(w, "Error validating checksum.", http.StatusInternalServerError)
-			return
-		}
-		if !chksmValid {
-			ob.logf("Invalid checksum for file %s", of.Name)
-			http.Error(w, "Invalid checksum.", http.StatusInternalServerError)
+			ob.uploadFailed(w, r, err)
 			return
 		}
-		// Get password and decrypt zip for download
-		pass := r.FormValue("password")
-		decryptedBytes, err := onion_buffer.Decrypt(of.Bytes, pass)
-		if err != nil {
-			ob.logf("Error decrypting buffer: %v", err)
-			http.Error(w, "Error decrypting buffer.", http.StatusInternalServerError)
-			return
+		// The store owns the zip file now
+		if oBuffer.Path != "" {
+			zipFile = nil
 		}
-		// Lock memory allotted to decryptedBytes from being used in SWAP
-		if err := syscall.Mlock(decryptedBytes); err != nil {
-			ob.logf("Error mlocking allotted memory for decryptedBytes: %v", err)
+		result := ob.newUploadResult(r, oBuffer, len(entries))
+		// Write the zip's URL to client for sharing
+		if wantsJSON(r) {
+			w.Header().Set("Content-Type", "application/json")
+			err = json.NewEncoder(w).Encode(result)
+		} else {
+			_, err = w.Write([]byte(fmt.Sprintf("Files uploaded. Please share this link with your recipients: %s\n"+
+				"Keep this token private to manage your upload: %s\n"+
+				"Stored %d files in %d bytes, checksum: %s",
+				result.URL, result.Token, result.Entries, result.Size, result.Checksum)))
 		}
-		// Increment files download count
-		of.Downloads++
-		// Set headers for browser to initiate download
-		w.Header().Set("Content-Type", "application/zip")
-		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%s.zip", of.Name))
-		// Write the zip bytes to the response for download
-		_, err = w.Write(decryptedBytes)
 		if err != nil {
-			ob.logf("Error writing to client: %v", err)
-			http.Error(w, "Error writing to client.", http.StatusInternalServerError)
+			ob.errorf("Error writing to client: %v", err)
+			ob.httpError(w, r, "Error writing to client.", http.StatusInternalServerError)
 			return
 		}
 	default:
-		http.Error(w, "Invalid HTTP Method.", http.StatusMethodNotAllowed)
+		ob.httpError(w, r, "Invalid HTTP Method.", http.StatusMethodNotAllowed)
 	}
 }
 
-func createCSRF() (string, error) {
-	hasher := md5.New()
-	_, err := io.WriteString(hasher, strconv.FormatInt(time.Now().Unix(), 10))
-	if err != nil {
-		return "", err
+// multipartRequired tells clients how to send uploads.
+const multipartRequired = "Files must be uploaded as multipart/form-data with each file in a %q field."
+
+// acquireUpload takes one of the -max-concurrent-uploads slots, replying
+// with a 503 when none is free. release gives the slot back.
+func (ob *onionbox) acquireUpload(w http.ResponseWriter, r *http.Request) (release func(), ok bool) {
+	if ob.uploadSem == nil {
+		return func() {}, true
+	}
+	select {
+	case ob.uploadSem <- struct{}{}:
+		return func() { <-ob.uploadSem }, true
+	default:
+		ob.httpError(w, r, "Too many uploads in progress, please try again later.", http.StatusServiceUnavailable)
+		return nil, false
 	}
-	return fmt.Sprintf("%x", hasher.Sum(nil)), nil
 }
 
-func (ob *onionbox) logf(format string, args ...interface{}) {
-	if ob.debug {
-		ob.logger.Printf(format, args...)
-	}
+// isMultipart reports whether the request body is a multipart form.
+func isMultipart(r *http.Request) bool {
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return err == nil && mediaType == "multipart/form-data"
+}
+
+// parseForm parses the request's form like r.FormValue would. With
+// -forbid-disk-spill, multipart forms that don't fit in memory are rejected
+// instead of spilling to temp files.
+func (ob *onionbox) parseForm(w http.ResponseWriter, r *http.Request) error {
+	if ob.forbidSpill {
+		r.Body = http.MaxBytesReader(w, r.Body, maxFormMemory)
+	}
+	if err := r.ParseMultipartForm(maxFormMemory); err != nil && err != http.ErrNotMultipart {
+		return err
+	}
+	return nil
+}
+
+// removeForm removes the temp files a multipart form spilled to.
+func removeForm(r *http.Request) {
+	if r.MultipartForm != nil {
+		r.MultipartForm.RemoveAll()
+	}
+}
+
+// storeUpload creates a buffer from the uploaded zip, applies the upload
+// options in form to it and adds it to the store. The zip is read from
+// zipFile if given and from zipBuffer otherwise.
+func (ob *onionbox) storeUpload(zipBuffer *bytes.Buffer, zipFile *os.File, form url.Values) (*onion_buffer.OnionBuffer, error) {
+	// Serve a single unencrypted file as is instead of zipped
+	var rawName string
+	if ob.noZipSingle && zipFile == nil && form.Get("password_enabled") != "on" {
+		name, raw, err := ob.unzipSingle(zipBuffer.Bytes())
+		if err != nil {
+			return nil, fmt.Errorf("unzipping single file: %v", err)
+		}
+		if raw != nil {
+			rawName = name
+			zipBuffer = bytes.NewBuffer(raw)
+		}
+	}
+	// Create OnionBuffer object with a random name
+	oBuffer := &onion_buffer.OnionBuffer{Name: ob.newBufferName(), CreatedAt: time.Now()}
+	// Create token the uploader can use to manage the buffer
+	var err error
+	oBuffer.Token, err = createToken()
+	if err != nil {
+		return nil, fmt.Errorf("creating token: %v", err)
+	}
+	// If password option was enabled
+	if form.Get("password_enabled") == "on" {
+		pass := form.Get("password")
+		// Bound the cost of deriving the key
+		if len(pass) > ob.maxPassLen {
+			return nil, badUploadError(fmt.Sprintf("Password too long, at most %d bytes are allowed.", ob.maxPassLen))
+		}
+		oBuffer.PlainSize = int64(zipBuffer.Len())
+		oBuffer.Bytes, err = onion_buffer.Encrypt(zipBuffer.Bytes(), pass, ob.cipher)
+		if err != nil {
+			return nil, fmt.Errorf("encrypting buffer: %v", err)
+		}
+		// Lock memory allotted to oBuffer from being used in SWAP
+		if err := syscall.Mlock(oBuffer.Bytes); err != nil {
+			ob.errorf("Error mlocking allotted memory for oBuffer: %v", err)
+		}
+		oBuffer.Encrypted = true
+		oBuffer.Cipher = ob.cipher
+		oBuffer.PasswordHint = sanitizeHint(form.Get("password_hint"))
+	} else if zipFile != nil {
+		if err := zipFile.Close(); err != nil {
+			return nil, fmt.Errorf("closing zip file: %v", err)
+		}
+		oBuffer.Path = zipFile.Name()
+	} else {
+		oBuffer.Bytes = zipBuffer.Bytes()
+		// Lock memory allotted to oBuffer from being used in SWAP
+		if err := syscall.Mlock(oBuffer.Bytes); err != nil {
+			ob.errorf("Error mlocking allotted memory for oBuffer: %v", err)
+		}
+	}
+	// Get checksum
+	oBuffer.Checksum, err = oBuffer.GetChecksum()
+	if err != nil {
+		return nil, fmt.Errorf("getting checksum: %v", err)
+	}
+	// Use the uploader's filename for downloads if it's usable
+	oBuffer.DisplayName = sanitizeFilename(form.Get("display_name"))
+	if rawName != "" {
+		oBuffer.RawName = rawName
+		oBuffer.ContentType = http.DetectContentType(oBuffer.Bytes)
+	}
+	// Let the uploader override the served filename and content type
+	oBuffer.FileName = sanitizeFilename(form.Get("filename"))
+	if ct := form.Get("content_type"); ct != "" {
+		if !allowedContentTypes[ct] {
+			return nil, badUploadError("Content type not allowed.")
+		}
+		oBuffer.ContentType = ct
+	}
+	// If a bandwidth quota was enabled
+	if form.Get("limit_bandwidth") == "on" {
+		quota, err := strconv.ParseInt(form.Get("bandwidth_limit"), 10, 64)
+		if err != nil || quota <= 0 || quota > maxMemoryMB {
+			return nil, badUploadError("Invalid bandwidth quota.")
+		}
+		oBuffer.ByteQuota = quota << 20
+	}
+	// If download confirmation was enabled
+	if form.Get("confirm_download") == "on" {
+		oBuffer.ConfirmDownload = true
+	}
+	// Only unzipped files of safe types are shown inline
+	if form.Get("inline") == "on" {
+		mediaType, _, err := mime.ParseMediaType(oBuffer.ContentType)
+		if oBuffer.RawName != "" && err == nil && inlineContentTypes[mediaType] {
+			oBuffer.Inline = true
+		} else {
+			ob.logf("Serving %s as an attachment, %q can't be shown inline", oBuffer.CurrentName(), oBuffer.ContentType)
+		}
+	}
+	// If limit downloads was enabled
+	if form.Get("limit_downloads") == "on" {
+		limit, err := strconv.Atoi(form.Get("download_limit"))
+		if err != nil {
+			return nil, badUploadError("Invalid download limit.")
+		}
+		oBuffer.DownloadLimit = limit
+	}
+	// if expiration was enabled
+	if form.Get("expire") == "on" {
+		t, err := time.ParseDuration(fmt.Sprintf("%sm", form.Get("expiration_time")))
+		if err != nil {
+			return nil, badUploadError("Invalid expiration time.")
+		}
+		// Count from the first download instead of the upload if asked
+		if form.Get("expire_after_download") == "on" {
+			oBuffer.ExpireAfter = t
+		} else {
+			oBuffer.ExpiresAt = oBuffer.CreatedAt.Add(t)
+		}
+	}
+	// Hash the served bytes by chunk for resuming clients
+	if !oBuffer.Encrypted {
+		oBuffer.Manifest, err = oBuffer.BuildManifest()
+		if err != nil {
+			return nil, fmt.Errorf("building manifest: %v", err)
+		}
+	}
+	// Zips are compressed already, so only unzipped files are worth it
+	if ob.compress && rawName != "" {
+		if err := oBuffer.Compress(); err != nil {
+			return nil, fmt.Errorf("compressing buffer: %v", err)
+		}
+		if oBuffer.Checksum, err = oBuffer.GetChecksum(); err != nil {
+			return nil, fmt.Errorf("getting checksum: %v", err)
+		}
+	}
+	ob.signChecksum(oBuffer)
+	// Append onion file to filestore
+	if err := ob.store.Add(oBuffer); err != nil {
+		// Don't leave a buffer the store refused behind, it may hold
+		// plaintext and shutdown may already have wiped the store
+		if err := oBuffer.Destroy(); err != nil {
+			ob.errorf("Error destroying rejected buffer: %v", err)
+		}
+		if err == onion_buffer.ErrClosed {
+			return nil, err
+		}
+		return nil, fmt.Errorf("adding file to store: %v", err)
+	}
+	atomic.StoreInt64(&ob.lastAdd, time.Now().UnixNano())
+	return oBuffer, nil
+}
+
+// uploadFailed replies to an upload storeUpload rejected.
+func (ob *onionbox) uploadFailed(w http.ResponseWriter, r *http.Request, err error) {
+	if e, ok := err.(badUploadError); ok {
+		ob.httpError(w, r, e.Error(), http.StatusBadRequest)
+		return
+	}
+	if err == onion_buffer.ErrClosed {
+		ob.logf("Refusing upload, shutting down")
+		ob.httpError(w, r, "The server is shutting down.", http.StatusServiceUnavailable)
+		return
+	}
+	ob.errorf("Error storing upload: %v", err)
+	ob.httpError(w, r, "Error uploading files.", http.StatusInternalServerError)
+}
+
+// uploadResult is what uploaders are told about a stored buffer.
+type uploadResult struct {
+	URL       string `json:"url"`
+	Token     string `json:"token"`
+	Size      int64  `json:"size"`
+	Entries   int    `json:"entries"`
+	Checksum  string `json:"checksum"`
+	Signature string `json:"signature,omitempty"`
+	oBuffer   *onion_buffer.OnionBuffer
+}
+
+// newUploadResult describes a stored buffer of the given number of entries.
+func (ob *onionbox) newUploadResult(r *http.Request, oBuffer *onion_buffer.OnionBuffer, entries int) uploadResult {
+	size, err := oBuffer.Size()
+	if err != nil {
+		ob.errorf("Error getting size of %s: %v", oBuffer.CurrentName(), err)
+	}
+	return uploadResult{
+		URL:       ob.shareURL(r, oBuffer.CurrentName()),
+		Token:     oBuffer.Token,
+		Size:      size,
+		Entries:   entries,
+		Checksum:  oBuffer.Checksum,
+		Signature: oBuffer.Signature,
+		oBuffer:   oBuffer,
+	}
+}
+
+// writeUploadResults writes the links of a batch upload, one per file.
+func (ob *onionbox) writeUploadResults(w http.ResponseWriter, r *http.Request, results []uploadResult) {
+	var err error
+	if wantsJSON(r) {
+		w.Header().Set("Content-Type", "application/json")
+		err = json.NewEncoder(w).Encode(results)
+	} else {
+		var b strings.Builder
+		b.WriteString("Files uploaded. Please share these links with your recipients:\n")
+		for _, result := range results {
+			fmt.Fprintf(&b, "%s (token: %s, %d bytes, checksum: %s)\n", result.URL, result.Token, result.Size, result.Checksum)
+		}
+		_, err = w.Write([]byte(b.String()))
+	}
+	if err != nil {
+		ob.errorf("Error writing to client: %v", err)
+	}
+}
+
+// splitZip returns a zip for every entry of the zip in zipBytes. Entries
+// are copied without being recompressed.
+func splitZip(zipBytes []byte) ([]*bytes.Buffer, error) {
+	zReader, err := zip.NewReader(bytes.NewReader(zipBytes), int64(len(zipBytes)))
+	if err != nil {
+		return nil, err
+	}
+	zips := make([]*bytes.Buffer, 0, len(zReader.File))
+	for _, file := range zReader.File {
+		raw, err := file.OpenRaw()
+		if err != nil {
+			return nil, err
+		}
+		zb := new(bytes.Buffer)
+		zWriter := zip.NewWriter(zb)
+		dst, err := zWriter.CreateRaw(&file.FileHeader)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := io.Copy(dst, raw); err != nil {
+			return nil, err
+		}
+		if err := zWriter.Close(); err != nil {
+			return nil, err
+		}
+		zips = append(zips, zb)
+	}
+	return zips, nil
+}
+
+func (ob *onionbox) download(w http.ResponseWriter, r *http.Request) {
+	// Only the router sets the name, never the client
+	name := bufferName(r)
+	// Neither the pages nor the bytes of a buffer may be cached, least of
+	// all those of burn after read links
+	w.Header().Set("Cache-Control", "no-store, no-cache")
+	w.Header().Set("Pragma", "no-cache")
+	// Refuse expired buffers on access instead of waiting to be reaped
+	if oBuffer := ob.store.Get(name); oBuffer != nil && ob.reapIfExpired(w, r, oBuffer) {
+		return
+	}
+	if oBuffer := ob.store.Get(name); oBuffer != nil && ob.refuseQuarantined(w, r, oBuffer) {
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		oBuffer := ob.store.Get(name)
+		if oBuffer == nil {
+			ob.httpError(w, r, "Nil file", http.StatusInternalServerError)
+			return
+		}
+		// Keep DestroyAll from wiping the buffer mid-download
+		n := oBuffer.BeginDownload()
+		defer oBuffer.EndDownload()
+		if ob.bufferBusy(w, r, oBuffer, n) {
+			return
+		}
+		if oBuffer.Encrypted {
+			ob.render(w, r, "download_encrypted", templates.DownloadHTML, bufferPage(oBuffer))
+		} else if oBuffer.ConfirmDownload {
+			ob.render(w, r, "download_confirm", templates.DownloadConfirmHTML, bufferPage(oBuffer))
+		} else {
+			// Hold the buffer from the limit check until it's written
+			if ob.serialize {
+				oBuffer.LockServing()
+				defer oBuffer.UnlockServing()
+			}
+			if oBuffer.LimitReached() {
+				ob.refuseLimitReached(w, r, oBuffer)
+				return
+			}
+			if oBuffer.QuotaExceeded() {
+				ob.logf("Bandwidth quota reached for %s", oBuffer.CurrentName())
+				ob.httpError(w, r, "Bandwidth quota reached.", http.StatusForbidden)
+				return
+			}
+			// Validate checksum
+			chksmValid, err := oBuffer.ValidateChecksum()
+			if err != nil {
+				ob.errorf("Error validating checksum: %v", err)
+				ob.httpError(w, r, "Error validating checksum.", http.StatusInternalServerError)
+				return
+			}
+			if !chksmValid {
+				ob.errorf("Invalid checksum for file %s", oBuffer.CurrentName())
+				ob.httpError(w, r, "Invalid checksum.", http.StatusInternalServerError)
+				return
+			}
+			// Count the download, unless a concurrent one took the last
+			downloads, ok := oBuffer.ClaimDownload()
+			if !ok {
+				ob.refuseLimitReached(w, r, oBuffer)
+				return
+			}
+			oBuffer.StartExpiry()
+			oBuffer.Touch()
+			ob.addReceipt(oBuffer, downloads)
+			// Set headers for browser to initiate download
+			ob.setDownloadHeaders(w, oBuffer)
+			// Let browsers show real progress over slow circuits
+			if size, err := oBuffer.Size(); err == nil {
+				w.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+			}
+			// Write the zip bytes to the response for download, or a
+			// tarball of them if asked for
+			var served int64
+			if format := tarFormat(r); format != "" && oBuffer.RawName == "" {
+				served, err = ob.writeTarball(w, oBuffer, nil, format)
+			} else {
+				served, err = oBuffer.WriteTo(w)
+			}
+			oBuffer.AddBytesServed(served)
+			if err != nil {
+				ob.errorf("Error writing to client: %v", err)
+				ob.httpError(w, r, "Error writing to client.", http.StatusInternalServerError)
+				return
+			}
+		}
+	// Return headers only so link unfurlers don't consume a download
+	case http.MethodHead:
+		oBuffer := ob.store.Get(name)
+		if oBuffer == nil {
+			ob.httpError(w, r, "Nil file", http.StatusInternalServerError)
+			return
+		}
+		ob.setDownloadHeaders(w, oBuffer)
+		// Encrypted buffers serve the decrypted length
+		if oBuffer.Encrypted {
+			w.Header().Set("Content-Length", strconv.FormatInt(oBuffer.PlainSize, 10))
+		} else if size, err := oBuffer.Size(); err == nil {
+			w.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+		}
+		if expires := oBuffer.Expiry(); !expires.IsZero() {
+			w.Header().Set("Expires", expires.UTC().Format(http.TimeFormat))
+		}
+		w.WriteHeader(http.StatusOK)
+	// If buffer was password protected or requires confirmation
+	case http.MethodPost:
+		of := ob.store.Get(name)
+		if of == nil {
+			ob.httpError(w, r, "Nil file", http.StatusInternalServerError)
+			return
+		}
+		// Keep DestroyAll from wiping the buffer mid-download
+		n := of.BeginDownload()
+		defer of.EndDownload()
+		if ob.bufferBusy(w, r, of, n) {
+			return
+		}
+		// Hold the buffer from the limit check until it's written
+		if ob.serialize {
+			of.LockServing()
+			defer of.UnlockServing()
+		}
+		if of.LimitReached() {
+			ob.refuseLimitReached(w, r, of)
+			return
+		}
+		if of.QuotaExceeded() {
+			ob.logf("Bandwidth quota reached for %s", of.CurrentName())
+			ob.httpError(w, r, "Bandwidth quota reached.", http.StatusForbidden)
+			return
+		}
+		// Validate checksum
+		chksmValid, err := of.ValidateChecksum()
+		if err != nil {
+			ob.errorf("Error validating checksum: %v", err)
+			ob.httpError(w, r, "Error validating checksum.", http.StatusInternalServerError)
+			return
+		}
+		if !chksmValid {
+			ob.errorf("Invalid checksum for file %s", of.CurrentName())
+			ob.httpError(w, r, "Invalid checksum.", http.StatusInternalServerError)
+			return
+		}
+		var pass string
+		if of.Encrypted {
+			// Refuse to decrypt while locked out from failed attempts
+			if of.IsLocked() {
+				ob.errorf("Too many failed password attempts for %s", of.CurrentName())
+				ob.httpError(w, r, "Too many failed attempts, please try again later.", http.StatusTooManyRequests)
+				return
+			}
+			// Check the password before committing to a response
+			if err := ob.parseForm(w, r); err != nil {
+				ob.errorf("Error parsing download form: %v", err)
+				var tooLarge *http.MaxBytesError
+				if errors.As(err, &tooLarge) {
+					ob.httpError(w, r, "Form too large.", http.StatusRequestEntityTooLarge)
+					return
+				}
+				ob.httpError(w, r, "Malformed form.", http.StatusBadRequest)
+				return
+			}
+			defer removeForm(r)
+			pass = r.FormValue("password")
+			if len(pass) > ob.maxPassLen {
+				ob.httpError(w, r, fmt.Sprintf("Password too long, at most %d bytes are allowed.", ob.maxPassLen), http.StatusBadRequest)
+				return
+			}
+			if err := onion_buffer.CheckPassphrase(of.Bytes, pass, of.Cipher); err != nil {
+				of.FailedAttempt(ob.maxAttempts)
+				ob.errorf("Error decrypting buffer: %v", err)
+				ob.httpError(w, r, "Error decrypting buffer.", http.StatusInternalServerError)
+				return
+			}
+			of.ResetAttempts()
+			// Refuse ciphertext that wouldn't decrypt to what was uploaded
+			if !of.ValidPlainSize() {
+				ob.logf("Ciphertext size of %s doesn't match its plaintext size", of.CurrentName())
+				ob.httpError(w, r, "Error decrypting buffer.", http.StatusInternalServerError)
+				return
+			}
+		}
+		// Count the download, unless a concurrent one took the last
+		downloads, ok := of.ClaimDownload()
+		if !ok {
+			ob.refuseLimitReached(w, r, of)
+			return
+		}
+		of.StartExpiry()
+		of.Touch()
+		ob.addReceipt(of, downloads)
+		// Set headers for browser to initiate download
+		ob.setDownloadHeaders(w, of)
+		// Encrypted buffers serve the decrypted length
+		if of.Encrypted {
+			w.Header().Set("Content-Length", strconv.FormatInt(of.PlainSize, 10))
+		} else if size, err := of.Size(); err == nil {
+			w.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+		}
+		// Write the zip bytes to the response for download, decrypting
+		// a segment at a time
+		var served int64
+		format := tarFormat(r)
+		switch {
+		case format != "" && of.RawName == "" && of.Encrypted:
+			// Transcoding seeks around the zip, only the segments it
+			// reads are decrypted
+			var plain *onion_buffer.DecryptReader
+			plain, err = of.NewDecryptReader(pass)
+			if err == nil {
+				served, err = ob.writeTarball(w, of, plain, format)
+				plain.Close()
+			}
+		case format != "" && of.RawName == "":
+			served, err = ob.writeTarball(w, of, nil, format)
+		case of.Encrypted:
+			served, err = of.DecryptTo(w, pass)
+		default:
+			served, err = of.WriteTo(w)
+		}
+		of.AddBytesServed(served)
+		if err != nil {
+			ob.errorf("Error writing to client: %v", err)
+			ob.httpError(w, r, "Error writing to client.", http.StatusInternalServerError)
+			return
+		}
+	default:
+		ob.httpError(w, r, "Invalid HTTP Method.", http.StatusMethodNotAllowed)
+	}
+}
+
+// writeZipEntry streams src into a new entry of the zip called name.
+func (ob *onionbox) writeZipEntry(zWriter *zip.Writer, name string, src io.Reader) (zipEntry, error) {
+	// Create file in zip with same name, flagged as UTF-8 so unzip tools
+	// don't read international names as CP-437
+	header := &zip.FileHeader{Name: name, Method: zip.Deflate}
+	if utf8.ValidString(name) {
+		header.Flags |= zipUTF8Flag
+	} else {
+		header.NonUTF8 = true
+	}
+	if ob.normMtime {
+		header.Modified = zipEpoch
+	}
+	// Deflating high entropy content costs time for next to no gain
+	reader := bufio.NewReaderSize(src, entropySampleSize)
+	if ob.skipDeflate {
+		if sample, _ := reader.Peek(entropySampleSize); entropy(sample) > maxDeflateEntropy {
+			header.Method = zip.Store
+		}
+	}
+	bufFile, err := zWriter.CreateHeader(header)
+	if err != nil {
+		return zipEntry{}, err
+	}
+	// Only hash the files if the manifest lists them
+	counter := &countingWriter{w: bufFile}
+	hash := sha256.New()
+	var dst io.Writer = counter
+	if ob.zipManifest {
+		dst = io.MultiWriter(counter, hash)
+	}
+	// A file that can't be read leaves a broken entry and stream behind,
+	// so the whole upload fails, naming the file
+	if err := writeBytesByChunk(reader, dst, ob.chunkSize); err != nil {
+		if err == errMemBudget {
+			return zipEntry{}, err
+		}
+		ob.errorf("Error reading %s: %v", name, err)
+		return zipEntry{}, badUploadError(fmt.Sprintf("Error reading %s, the upload may be truncated or too large.", name))
+	}
+	// Flush zipwriter to write compressed bytes to buffer
+	if err := zWriter.Flush(); err != nil {
+		return zipEntry{}, err
+	}
+	return zipEntry{Name: name, Size: counter.n, SHA256: hex.EncodeToString(hash.Sum(nil))}, nil
+}
+
+// writeFilesToBuffers streams each file part of the multipart form into
+// its own entry in the zip and returns the entries written.
+// Entries keep the order of the form's file parts, so the same upload
+// always produces the same zip layout. Other form values are collected
+// into form.
+func (ob *onionbox) writeFilesToBuffers(zWriter *zip.Writer, mpReader *multipart.Reader, form url.Values) ([]zipEntry, error) {
+	var entries []zipEntry
+	for {
+		part, err := mpReader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			ob.errorf("Error reading multipart form: %v", err)
+			return entries, badUploadError("Malformed upload form.")
+		}
+		// Regular form values are kept in memory for the upload options
+		if part.FileName() == "" {
+			value, err := ioutil.ReadAll(io.LimitReader(part, maxFormValueSize))
+			if err != nil {
+				return entries, err
+			}
+			form.Add(part.FormName(), string(value))
+			continue
+		}
+		if part.FormName() != ob.uploadField {
+			continue
+		}
+		// Enforce limits on filenames and number of entries
+		if len(part.FileName()) > ob.maxNameLen {
+			return entries, badUploadError(fmt.Sprintf("Filename too long: %s", part.FileName()))
+		}
+		if len(entries) >= ob.maxEntries {
+			return entries, badUploadError(fmt.Sprintf("Too many files, at most %d are allowed.", ob.maxEntries))
+		}
+		entry, err := ob.writeZipEntry(zWriter, part.FileName(), part)
+		if err != nil {
+			return entries, err
+		}
+		entries = append(entries, entry)
+	}
+	if len(entries) == 0 {
+		return entries, badUploadError("No files provided.")
+	}
+	return entries, nil
+}
+
+// entropy returns the Shannon entropy of b in bits per byte.
+func entropy(b []byte) float64 {
+	if len(b) == 0 {
+		return 0
+	}
+	var counts [256]int
+	for _, c := range b {
+		counts[c]++
+	}
+	var e float64
+	for _, count := range counts {
+		if count > 0 {
+			p := float64(count) / float64(len(b))
+			e -= p * math.Log2(p)
+		}
+	}
+	return e
+}
+
+// unzipSingle returns the name and contents of the zip's only entry.
+// raw is nil if the zip holds more than one entry.
+func (ob *onionbox) unzipSingle(zipBytes []byte) (name string, raw []byte, err error) {
+	zReader, err := zip.NewReader(bytes.NewReader(zipBytes), int64(len(zipBytes)))
+	if err != nil {
+		return "", nil, err
+	}
+	if len(zReader.File) != 1 {
+		return "", nil, nil
+	}
+	file, err := zReader.File[0].Open()
+	if err != nil {
+		return "", nil, err
+	}
+	defer file.Close()
+	buffer := new(bytes.Buffer)
+	if err := writeBytesByChunk(file, buffer, ob.chunkSize); err != nil {
+		return "", nil, err
+	}
+	// An empty file is still a single file, not a reason to keep the zip
+	raw = buffer.Bytes()
+	if raw == nil {
+		raw = []byte{}
+	}
+	return zReader.File[0].Name, raw, nil
+}
+
+// setDownloadHeaders makes browsers save the buffer as a file instead of
+// rendering it, whatever its content type.
+func (ob *onionbox) setDownloadHeaders(w http.ResponseWriter, oBuffer *onion_buffer.OnionBuffer) {
+	w.Header().Set("Content-Type", contentType(oBuffer))
+	disposition := "attachment"
+	if oBuffer.Inline {
+		disposition = "inline"
+		// Nothing shown inline gets to run scripts, whatever it turns out to be
+		w.Header().Set("Content-Security-Policy", "sandbox")
+	}
+	w.Header().Set("Content-Disposition", fmt.Sprintf("%s; filename=%q", disposition, ob.downloadFilename(oBuffer)))
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	if oBuffer.Signature != "" {
+		w.Header().Set("X-Onionbox-Checksum", oBuffer.Checksum)
+		w.Header().Set("X-Onionbox-Signature", oBuffer.Signature)
+	}
+}
+
+// contentType is the Content-Type the buffer is served with.
+func contentType(oBuffer *onion_buffer.OnionBuffer) string {
+	if oBuffer.ContentType == "" {
+		return "application/zip"
+	}
+	return oBuffer.ContentType
+}
+
+// wipe overwrites b with zeros, for plaintext that's done with.
+func wipe(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+}
+
+// writeBytesByChunk copies src into dst chunkSize bytes at a time
+// using an mlocked chunk.
+func writeBytesByChunk(src io.Reader, dst io.Writer, chunkSize int) error {
+	var count int
+	var err error
+	reader := bufio.NewReader(src)
+	chunk := make([]byte, chunkSize)
+	// Lock memory allotted to chunk from being used in SWAP
+	if err := syscall.Mlock(chunk); err != nil {
+		return err
+	}
+	defer syscall.Munlock(chunk)
+	for {
+		// Write what was read before looking at the error, a read can
+		// return both. Empty files hit EOF right away and write nothing.
+		count, err = reader.Read(chunk)
+		if count > 0 {
+			if _, err := dst.Write(chunk[:count]); err != nil {
+				return err
+			}
+		}
+		if err != nil {
+			break
+		}
+	}
+	if err != io.EOF {
+		return err
+	}
+	return nil
+}
+
+// validateFlags refuses values that would overflow or make no sense
+// and warns when the memory flags exceed the host's RAM.
+func (ob *onionbox) validateFlags() error {
+	if ob.maxMemory <= 0 || ob.maxMemory > maxMemoryMB {
+		return fmt.Errorf("-mem must be between 1 and %d MB, got %d", maxMemoryMB, ob.maxMemory)
+	}
+	if ob.memBudget < 0 || ob.memBudget > maxMemoryMB {
+		return fmt.Errorf("-mem-budget must be between 0 and %d MB, got %d", maxMemoryMB, ob.memBudget)
+	}
+	if ob.chunkSize <= 0 {
+		return fmt.Errorf("-chunk must be positive, got %d", ob.chunkSize)
+	}
+	if ob.maxAttempts < 0 {
+		return fmt.Errorf("-max-attempts can't be negative, got %d", ob.maxAttempts)
+	}
+	if ob.maxStreams < 0 || ob.maxStreams > 65535 {
+		return fmt.Errorf("-onion-max-streams must be between 0 and 65535, got %d", ob.maxStreams)
+	}
+	if ob.maxProcs < 0 || ob.maxProcs > runtime.NumCPU() {
+		return fmt.Errorf("-max-procs must be between 0 and the %d CPUs available, got %d", runtime.NumCPU(), ob.maxProcs)
+	}
+	if ob.uploadField == "" {
+		return fmt.Errorf("-upload-field can't be empty")
+	}
+	if ob.maxPassLen <= 0 {
+		return fmt.Errorf("-max-password-len must be positive, got %d", ob.maxPassLen)
+	}
+	if ob.idleTime < 0 {
+		return fmt.Errorf("-idle-shutdown can't be negative, got %v", ob.idleTime)
+	}
+	if ob.publishTime <= 0 {
+		return fmt.Errorf("-publish-timeout must be positive, got %v", ob.publishTime)
+	}
+	if ob.minTorVer != "" {
+		if _, err := parseTorVersion(ob.minTorVer); err != nil {
+			return fmt.Errorf("-min-tor-version: %v", err)
+		}
+	}
+	if ob.checkTime < 0 {
+		return fmt.Errorf("-integrity-interval can't be negative, got %v", ob.checkTime)
+	}
+	if ob.verifyTime < 0 {
+		return fmt.Errorf("-verify-publish can't be negative, got %v", ob.verifyTime)
+	}
+	if ob.torRetries < 0 {
+		return fmt.Errorf("-tor-start-retries can't be negative, got %d", ob.torRetries)
+	}
+	// The port only exists inside Tor, so any valid TCP port will do
+	if ob.noTor && ob.devListen == "" {
+		return fmt.Errorf("-no-tor needs -dev-listen to serve on")
+	}
+	if ob.noTor && ob.adminOnion {
+		return fmt.Errorf("-admin-onion can't be used with -no-tor")
+	}
+	// v2 addresses can be harvested from the directories
+	if ob.adminOnion && (!ob.torVersion3 || ob.allowV2) {
+		return fmt.Errorf("-admin-onion needs a v3 onion service, it can't be used with -torv3=false or -allow-v2-fallback")
+	}
+	if ob.port < 1 || ob.port > 65535 {
+		return fmt.Errorf("-port must be between 1 and 65535, got %d", ob.port)
+	}
+	if ob.maxHeader <= 0 {
+		return fmt.Errorf("-max-header-bytes must be positive, got %d", ob.maxHeader)
+	}
+	if ob.maxInFlight < 0 {
+		return fmt.Errorf("-max-inflight can't be negative, got %d", ob.maxInFlight)
+	}
+	if ob.bufInFlight < 0 {
+		return fmt.Errorf("-max-inflight-per-buffer can't be negative, got %d", ob.bufInFlight)
+	}
+	if ob.maxUploads < 0 {
+		return fmt.Errorf("-max-concurrent-uploads can't be negative, got %d", ob.maxUploads)
+	}
+	if ob.shortLen != 0 && (ob.shortLen < minShortLen || ob.shortLen > 64) {
+		return fmt.Errorf("-short-links must be 0 or between %d and 64, got %d", minShortLen, ob.shortLen)
+	}
+	if ob.maxNameLen <= 0 || ob.maxEntries <= 0 {
+		return fmt.Errorf("-max-filename-len and -max-entries must be positive")
+	}
+	if ob.diskDir != "" && !ob.insecureTmp {
+		if err := checkPrivateDir(ob.diskDir); err != nil {
+			return fmt.Errorf("-disk-dir %v (use -allow-insecure-tmp to override)", err)
+		}
+	}
+	if ram := physicalMemory(); ram > 0 {
+		if uint64(ob.maxMemory)<<20 > ram {
+			ob.alertf("WARNING: -mem %d MB is more than the host's %d MB of RAM", ob.maxMemory, ram>>20)
+		}
+		if uint64(ob.memBudget)<<20 > ram {
+			ob.alertf("WARNING: -mem-budget %d MB is more than the host's %d MB of RAM", ob.memBudget, ram>>20)
+		}
+	}
+	return nil
+}
+
+// openLogs points the logger at -log-file and -error-log-file and closes
+// the files it wrote to before, so rotated logs are picked up on SIGHUP.
+func (ob *onionbox) openLogs() {
+	var out io.Writer = os.Stdout
+	var files []*os.File
+	// Fall back to stdout rather than losing logs to an unwritable file
+	if ob.logFile != "" {
+		if f, err := openLogFile(ob.logFile); err != nil {
+			ob.alertf("WARNING: can't write to log file, logging to stdout instead: %v", err)
+		} else {
+			out = f
+			files = append(files, f)
+		}
+	}
+	var errOut io.Writer = io.Discard
+	if ob.errLogFile != "" {
+		if f, err := openLogFile(ob.errLogFile); err != nil {
+			ob.alertf("WARNING: can't write to error log file: %v", err)
+		} else {
+			errOut = f
+			files = append(files, f)
+		}
+	}
+	ob.logger.SetOutput(out)
+	ob.errLogger.SetOutput(errOut)
+	for _, f := range ob.logFiles {
+		f.Close()
+	}
+	ob.logFiles = files
+}
+
+// openLogFile opens path for appending, creating it and its directory if
+// they don't exist.
+func openLogFile(path string) (*os.File, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, err
+	}
+	return os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+}
+
+// checkPrivateDir returns an error unless dir is a directory owned by the
+// current user that other users can't write to.
+func checkPrivateDir(dir string) error {
+	info, err := os.Stat(dir)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("%s is not a directory", dir)
+	}
+	if info.Mode().Perm()&0002 != 0 {
+		return fmt.Errorf("%s is world-writable", dir)
+	}
+	if st, ok := info.Sys().(*syscall.Stat_t); ok && int(st.Uid) != os.Getuid() {
+		return fmt.Errorf("%s is owned by uid %d, not %d", dir, st.Uid, os.Getuid())
+	}
+	return nil
+}
+
+// reapIfExpired destroys the buffer and replies with 410 if it has expired.
+func (ob *onionbox) reapIfExpired(w http.ResponseWriter, r *http.Request, oBuffer *onion_buffer.OnionBuffer) bool {
+	if !oBuffer.IsExpired() {
+		return false
+	}
+	if err := ob.store.Destroy(oBuffer); err != nil && err != onion_buffer.ErrNotFound {
+		ob.errorf("Error destroying buffer %s: %v", oBuffer.CurrentName(), err)
+	}
+	ob.httpError(w, r, "Download link has expired.", http.StatusGone)
+	return true
+}
+
+// reserveMem sets needed bytes of the memory budget aside, reaping expired
+// buffers first if they don't fit. release gives them back and must be
+// called once the buffer is stored or abandoned.
+func (ob *onionbox) reserveMem(needed int64) (release func(), ok bool) {
+	if ob.memBudget <= 0 {
+		return func() {}, true
+	}
+	if !ob.tryReserveMem(needed) {
+		return nil, false
+	}
+	return func() { ob.store.Release(needed) }, true
+}
+
+func (ob *onionbox) tryReserveMem(needed int64) bool {
+	budget := ob.memBudget << 20
+	if ob.store.Reserve(needed, budget) {
+		return true
+	}
+	if err := ob.store.DestroyExpiredBuffers(); err != nil {
+		ob.errorf("Error destroying expired buffers: %v", err)
+	}
+	return ob.store.Reserve(needed, budget)
+}
+
+// budgetWriter reserves the memory budget for every chunk before writing
+// it, failing with errMemBudget as soon as the budget is crossed. release
+// gives back everything reserved through it.
+type budgetWriter struct {
+	ob       *onionbox
+	w        io.Writer
+	reserved int64
+}
+
+func (bw *budgetWriter) Write(p []byte) (int, error) {
+	if !bw.reserve(int64(len(p))) {
+		return 0, errMemBudget
+	}
+	return bw.w.Write(p)
+}
+
+// reserve sets n more bytes aside, reporting false if they don't fit.
+func (bw *budgetWriter) reserve(n int64) bool {
+	if bw.ob.memBudget <= 0 {
+		return true
+	}
+	if !bw.ob.tryReserveMem(n) {
+		return false
+	}
+	bw.reserved += n
+	return true
+}
+
+func (bw *budgetWriter) release() {
+	bw.ob.store.Release(bw.reserved)
+	bw.reserved = 0
+}
+
+// refuseMemBudget replies that an upload of at least needed bytes doesn't
+// fit in the memory budget.
+func (ob *onionbox) refuseMemBudget(w http.ResponseWriter, r *http.Request, needed int64) {
+	ob.logf("Memory budget exceeded, rejecting upload of at least %d bytes", needed)
+	ob.httpError(w, r, "Not enough memory available to store files.", http.StatusInsufficientStorage)
+}
+
+// addReceipt signs a receipt for the buffer's download number n.
+func (ob *onionbox) addReceipt(oBuffer *onion_buffer.OnionBuffer, n int) {
+	if !ob.receipts {
+		return
+	}
+	oBuffer.AddReceipt(onion_buffer.NewReceipt(ob.receiptKey, oBuffer.CurrentName(), n, time.Now()))
+}
+
+// refuseLimitReached replies that the buffer's download limit was reached.
+// The buffer is destroyed unless other downloads of it are still being
+// written.
+func (ob *onionbox) refuseLimitReached(w http.ResponseWriter, r *http.Request, oBuffer *onion_buffer.OnionBuffer) {
+	if oBuffer.InFlight() <= 1 {
+		if err := ob.store.Destroy(oBuffer); err != nil && err != onion_buffer.ErrNotFound {
+			ob.errorf("Error deleting onion file from store: %v", err)
+		}
+	}
+	ob.logf("Download limit reached for %s", oBuffer.CurrentName())
+	ob.httpError(w, r, "Download limit reached.", http.StatusUnauthorized)
+}
+
+// render executes the template with the page data, localized for the request.
+func (ob *onionbox) render(w http.ResponseWriter, r *http.Request, name, text string, page templates.Page) {
+	csrf, err := createCSRF()
+	if err != nil {
+		ob.errorf("Error creating CSRF token: %v", err)
+		ob.httpError(w, r, "Error displaying web page, please try refreshing.", http.StatusInternalServerError)
+		return
+	}
+	page.CSRF = csrf
+	page.Banner = ob.banner
+	page.NonTor = ob.warnNonTor && viaNonTor(r)
+	page.Msg = templates.Lookup(r.Header.Get("Accept-Language"), ob.defaultLang)
+	// Parse template
+	t, err := template.New(name).Parse(text)
+	if err != nil {
+		ob.errorf("Error loading template: %v", err)
+		ob.httpError(w, r, "Error displaying web page, please try refreshing.", http.StatusInternalServerError)
+		return
+	}
+	// Execute template
+	if err := t.Execute(w, page); err != nil {
+		ob.errorf("Error executing template: %v", err)
+		ob.httpError(w, r, "Error displaying web page, please try refreshing.", http.StatusInternalServerError)
+		return
+	}
+}
+
+// bufferPage fills in what recipients are told about a buffer before
+// downloading it.
+func bufferPage(oBuffer *onion_buffer.OnionBuffer) templates.Page {
+	page := templates.Page{Hint: oBuffer.PasswordHint}
+	// Expiry is enforced on access, so the remaining time is exact
+	if expires := oBuffer.Expiry(); !expires.IsZero() {
+		left := time.Until(expires).Round(time.Second)
+		page.ExpiresIn = left.String()
+		// Counting down from the time left copes with skewed client clocks
+		page.ExpiresAt = expires.UTC().Format(time.RFC3339)
+		page.ExpiresInSeconds = int64(left / time.Second)
+	}
+	if oBuffer.DownloadLimit > 0 {
+		page.DownloadsLeft = oBuffer.DownloadLimit - oBuffer.DownloadCount()
+	}
+	return page
+}
+
+// bannerLines splits the banner into lines without control characters,
+// the templates escape any HTML in them.
+func bannerLines(banner string) []string {
+	var lines []string
+	for _, line := range strings.Split(strings.TrimSpace(banner), "\n") {
+		lines = append(lines, strings.Map(func(r rune) rune {
+			if unicode.IsControl(r) {
+				return -1
+			}
+			return r
+		}, line))
+	}
+	if len(lines) == 1 && lines[0] == "" {
+		return nil
+	}
+	return lines
+}
+
+// sanitizeFilename keeps only the base name with safe characters,
+// returning "" if nothing usable is left.
+func sanitizeFilename(name string) string {
+	name = strings.TrimSpace(path.Base(strings.Replace(name, "\\", "/", -1)))
+	name = strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		case r == '.', r == '-', r == '_', r == ' ':
+			return r
+		}
+		return -1
+	}, name)
+	name = strings.Trim(name, ". ")
+	if len(name) > maxDisplayNameLen {
+		name = name[:maxDisplayNameLen]
+	}
+	return name
+}
+
+// sanitizeHint drops control characters and limits the hint's length.
+// The template escapes it, and hints are never logged.
+func sanitizeHint(hint string) string {
+	hint = strings.TrimSpace(strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) {
+			return -1
+		}
+		return r
+	}, hint))
+	if runes := []rune(hint); len(runes) > maxHintLen {
+		hint = string(runes[:maxHintLen])
+	}
+	return hint
+}
+
+// downloadFilename is the filename the buffer is downloaded as.
+func (ob *onionbox) downloadFilename(oBuffer *onion_buffer.OnionBuffer) string {
+	// The uploader's exact filename wins
+	if oBuffer.FileName != "" {
+		return oBuffer.FileName
+	}
+	// Unzipped files keep their own extension
+	if oBuffer.RawName != "" {
+		if oBuffer.DisplayName != "" {
+			return oBuffer.DisplayName
+		}
+		if name := sanitizeFilename(oBuffer.RawName); name != "" {
+			return name
+		}
+		return oBuffer.CurrentName()
+	}
+	if ob.noZipExt {
+		if oBuffer.DisplayName != "" {
+			return oBuffer.DisplayName
+		}
+		return oBuffer.CurrentName()
+	}
+	if oBuffer.DisplayName == "" {
+		return oBuffer.CurrentName() + ".zip"
+	}
+	if !strings.HasSuffix(strings.ToLower(oBuffer.DisplayName), ".zip") {
+		return oBuffer.DisplayName + ".zip"
+	}
+	return oBuffer.DisplayName
+}
+
+func createCSRF() (string, error) {
+	hasher := md5.New()
+	_, err := io.WriteString(hasher, strconv.FormatInt(time.Now().Unix(), 10))
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", hasher.Sum(nil)), nil
+}
+
+// uploadAuthorized reports whether the request may upload. Any username
+// is accepted, the password is compared in constant time.
+func (ob *onionbox) uploadAuthorized(r *http.Request) bool {
+	if ob.uploadPass == nil {
+		return true
+	}
+	_, pass, ok := r.BasicAuth()
+	if !ok {
+		return false
+	}
+	hash := sha256.Sum256([]byte(pass))
+	return subtle.ConstantTimeCompare(hash[:], ob.uploadPass) == 1
+}
+
+// shareURL returns the link to the buffer. --public-host wins, then the
+// X-Forwarded-* headers of a trusted proxy, then the onion address. r is
+// nil for links made outside of a request.
+func (ob *onionbox) shareURL(r *http.Request, name string) string {
+	if ob.publicHost != "" {
+		if strings.Contains(ob.publicHost, "://") {
+			return fmt.Sprintf("%s/%s", strings.TrimSuffix(ob.publicHost, "/"), name)
+		}
+		return fmt.Sprintf("http://%s/%s", ob.publicHost, name)
+	}
+	if r == nil {
+		if ob.noTor {
+			return fmt.Sprintf("http://%s/%s", ob.devListen, name)
+		}
+		return fmt.Sprintf("http://%s/%s", ob.onionHost(), name)
+	}
+	if host := r.Header.Get("X-Forwarded-Host"); host != "" && ob.fromTrustedProxy(r) {
+		proto := r.Header.Get("X-Forwarded-Proto")
+		if proto != "https" {
+			proto = "http"
+		}
+		return fmt.Sprintf("%s://%s/%s", proto, host, name)
+	}
+	// Without Tor the host the client used is all there is
+	if ob.noTor {
+		return fmt.Sprintf("http://%s/%s", r.Host, name)
+	}
+	return fmt.Sprintf("http://%s/%s", ob.onionHost(), name)
+}
+
+// onionHost returns the host of the onion service, with the port unless
+// it's the default 80.
+func (ob *onionbox) onionHost() string {
+	if ob.port == 80 {
+		return ob.onionURL + ".onion"
+	}
+	return fmt.Sprintf("%s.onion:%d", ob.onionURL, ob.port)
+}
+
+// fromTrustedProxy reports whether the request came from the --trust-proxy address.
+func (ob *onionbox) fromTrustedProxy(r *http.Request) bool {
+	if ob.trustProxy == nil {
+		return false
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ob.trustProxy.Contains(ip)
+}
+
+// parseIPNet parses a CIDR or a single IP address.
+func parseIPNet(s string) (*net.IPNet, error) {
+	if strings.Contains(s, "/") {
+		_, ipNet, err := net.ParseCIDR(s)
+		return ipNet, err
+	}
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid IP address %q", s)
+	}
+	bits := 8 * net.IPv6len
+	if ip.To4() != nil {
+		ip = ip.To4()
+		bits = 8 * net.IPv4len
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+}
+
+// sillyNameMu serializes randomdata, whose random source isn't safe for
+// concurrent use.
+var sillyNameMu sync.Mutex
+
+// sillyName returns a random lowercase silly name.
+func sillyName() string {
+	sillyNameMu.Lock()
+	defer sillyNameMu.Unlock()
+	return strings.ToLower(randomdata.SillyName())
+}
+
+// newBufferName returns a name from ob.newName not used by any buffer,
+// past or present.
+func (ob *onionbox) newBufferName() string {
+	for {
+		name := ob.newName()
+		if !ob.store.Exists(name) && !ob.store.Tombstoned(name) {
+			return name
+		}
+	}
+}
+
+// shortCode returns a random base62 code of length n.
+func shortCode(n int) string {
+	code := make([]byte, n)
+	b := make([]byte, 1)
+	for i := 0; i < n; {
+		// crypto/rand only fails if the OS can't provide randomness at all
+		if _, err := rand.Read(b); err != nil {
+			panic(err)
+		}
+		// Reject bytes past the largest multiple of 62 to avoid bias
+		if b[0] >= 248 {
+			continue
+		}
+		code[i] = base62[b[0]%62]
+		i++
+	}
+	return string(code)
+}
+
+// createToken returns a random hex token that can't be guessed.
+func createToken() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func (ob *onionbox) logf(format string, args ...interface{}) {
+	if ob.debug {
+		ob.logger.Printf(format, args...)
+	}
+}
+
+// infof logs messages the operator needs outside of debug mode, unless quiet.
+func (ob *onionbox) infof(format string, args ...interface{}) {
+	if !ob.quiet {
+		ob.logger.Printf(format, args...)
+	}
+}
+
+// errorf logs errors to the main log in debug mode, like logf, and always
+// to -error-log-file.
+func (ob *onionbox) errorf(format string, args ...interface{}) {
+	ob.logf(format, args...)
+	if ob.errLogger != nil {
+		ob.errLogger.Printf(format, args...)
+	}
+}
+
+// alertf logs warnings and errors the operator must always see, to the
+// main log and -error-log-file.
+func (ob *onionbox) alertf(format string, args ...interface{}) {
+	ob.logger.Printf(format, args...)
+	if ob.errLogger != nil {
+		ob.errLogger.Printf(format, args...)
+	}
+}
+
+// fatalf logs like alertf and exits.
+func (ob *onionbox) fatalf(format string, args ...interface{}) {
+	ob.alertf(format, args...)
+	os.Exit(1)
+}
+
+// listenConf builds the config for the onion service, listening on
+// any port but showing as -port.
+func (ob *onionbox) listenConf() *tor.ListenConf {
+	return &tor.ListenConf{
+		RemotePorts:  []int{ob.port},
+		Version3:     ob.torVersion3,
+		MaxStreams:   ob.maxStreams,
+		NonAnonymous: ob.singleHop,
+	}
+}
+
+// listenWithTimeout calls listen, which publishes an onion service, with
+// a context that's done after -publish-timeout.
+func (ob *onionbox) listenWithTimeout(ctx context.Context, listen func(ctx context.Context) error) error {
+	listenCtx, cancel := context.WithTimeout(ctx, ob.publishTime)
+	defer cancel()
+	err := listen(listenCtx)
+	// Descriptors that never get uploaded usually mean no network or a
+	// clock too far off for the Tor network to accept them
+	if err != nil && listenCtx.Err() == context.DeadlineExceeded {
+		return fmt.Errorf("not published within %v, check the network connection and that the system clock is correct: %v", ob.publishTime, err)
+	}
+	return err
+}
+
+// publishWithFallback retries publish, which publishes the onion service
+// of version ob.torVersion3. If v3 isn't supported by the running Tor it
+// falls back to v2 when -allow-v2-fallback is set.
+func (ob *onionbox) publishWithFallback(ctx context.Context, publish func() error) error {
+	if !ob.torVersion3 {
+		ob.alertf("WARNING: v2 onion services are DEPRECATED and insecure, please use v3.")
+	}
+	err := ob.retry(ctx, "Publishing onion service", ob.torRetries, publish)
+	if err != nil && ob.torVersion3 && ob.allowV2 {
+		ob.alertf("WARNING: Failed to create v3 onion service: %v. Falling back to DEPRECATED and insecure v2.", err)
+		ob.torVersion3 = false
+		err = ob.retry(ctx, "Publishing v2 onion service", ob.torRetries, publish)
+	}
+	if err != nil {
+		if ob.torVersion3 {
+			return fmt.Errorf("creating v3 onion service: %v, use -allow-v2-fallback to fall back to v2", err)
+		}
+		return fmt.Errorf("creating onion service: %v", err)
+	}
+	return nil
+}
+
+// applyMaxProcs limits the CPUs used at once to -max-procs, if set.
+func (ob *onionbox) applyMaxProcs() {
+	if ob.maxProcs > 0 {
+		runtime.GOMAXPROCS(ob.maxProcs)
+	}
+}
+
+// retry calls fn until it succeeds or has been retried retries times,
+// doubling the wait between attempts.
+func (ob *onionbox) retry(ctx context.Context, what string, retries int, fn func() error) error {
+	backoff := time.Second
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if err == nil || attempt > retries {
+			return err
+		}
+		ob.infof("%s failed (attempt %d of %d): %v. Retrying in %v...", what, attempt, retries+1, err, backoff)
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		backoff *= 2
+	}
+}
+
+// torStartConf builds the config for starting Tor. Tor's bootstrap
+// output is only passed through in debug mode.
+func (ob *onionbox) torStartConf() *tor.StartConf {
+	conf := &tor.StartConf{ProcessCreator: libtor.Creator}
+	if ob.debug {
+		conf.DebugWriter = os.Stderr
+	}
+	// Tor refuses to run non-anonymous services with a SOCKS port open
+	if ob.singleHop {
+		conf.NoAutoSocksPort = true
+		conf.ExtraArgs = append(conf.ExtraArgs,
+			"--SocksPort", "0",
+			"--HiddenServiceSingleHopMode", "1",
+			"--HiddenServiceNonAnonymousMode", "1")
+	}
+	return conf
 }
 
 func (ob *onionbox) destroy() {
 	if err := ob.store.DestroyAll(); err != nil {
-		ob.logf("Error destroying all buffers from store: %v", err)
+		ob.errorf("Error destroying all buffers from store: %v", err)
+	}
+}
+
+// dumpStore logs the state of every buffer in the store, in debug mode only.
+func (ob *onionbox) dumpStore() {
+	if !ob.debug {
+		return
+	}
+	buffers := ob.store.List()
+	ob.logf("Store holds %d buffers (%d bytes in memory)", len(buffers), ob.store.TotalBytes())
+	for _, oBuffer := range buffers {
+		size, err := oBuffer.Size()
+		if err != nil {
+			ob.errorf("Error getting size of %s: %v", oBuffer.CurrentName(), err)
+		}
+		expires := "never"
+		if t := oBuffer.Expiry(); !t.IsZero() {
+			expires = t.Format(time.RFC3339)
+		}
+		accessed := "never"
+		if t := oBuffer.LastAccess(); !t.IsZero() {
+			accessed = t.Format(time.RFC3339)
+		}
+		ob.logf("  %s: %d bytes, encrypted: %t, downloads: %d/%d, expires: %s, last accessed: %s",
+			oBuffer.CurrentName(), size, oBuffer.Encrypted, oBuffer.DownloadCount(), oBuffer.DownloadLimit, expires, accessed)
+	}
+}
+
+// watchIdle shuts down through stop, the same way as on SIGTERM, once
+// the store has been empty for ob.idleTime.
+func (ob *onionbox) watchIdle(ctx context.Context, stop context.CancelFunc) {
+	interval := ob.idleTime / 10
+	if interval > time.Minute {
+		interval = time.Minute
+	}
+	if interval < 10*time.Millisecond {
+		interval = 10 * time.Millisecond
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	idleSince := time.Now()
+	for {
+		var now time.Time
+		select {
+		case now = <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+		if len(ob.store.List()) > 0 {
+			idleSince = now
+			continue
+		}
+		// Buffers that came and went between ticks still count
+		if added := time.Unix(0, atomic.LoadInt64(&ob.lastAdd)); added.After(idleSince) {
+			idleSince = added
+		}
+		if now.Sub(idleSince) >= ob.idleTime {
+			ob.infof("No buffers stored for %v, shutting down", ob.idleTime)
+			stop()
+			return
+		}
+	}
+}
+
+// watchIntegrity validates the checksum of every buffer each ob.checkTime,
+// quarantining the ones whose bytes changed since they were stored.
+func (ob *onionbox) watchIntegrity(ctx context.Context) {
+	ticker := time.NewTicker(ob.checkTime)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+		for _, oBuffer := range ob.store.List() {
+			if !oBuffer.IsQuarantined() {
+				ob.checkIntegrity(oBuffer)
+			}
+		}
+	}
+}
+
+// refuseQuarantined replies with an error if the buffer was quarantined
+// and reports whether it was.
+func (ob *onionbox) refuseQuarantined(w http.ResponseWriter, r *http.Request, oBuffer *onion_buffer.OnionBuffer) bool {
+	if !oBuffer.IsQuarantined() {
+		return false
+	}
+	ob.httpError(w, r, "This file failed its integrity check and can't be downloaded.", http.StatusInternalServerError)
+	return true
+}
+
+// checkIntegrity quarantines the buffer if it fails checksum validation.
+func (ob *onionbox) checkIntegrity(oBuffer *onion_buffer.OnionBuffer) {
+	// Keep DestroyAll from wiping the buffer mid-check
+	oBuffer.BeginDownload()
+	defer oBuffer.EndDownload()
+	// Buffers destroyed since the listing have nothing left to check
+	if !ob.store.Exists(oBuffer.CurrentName()) {
+		return
+	}
+	valid, err := oBuffer.ValidateChecksum()
+	if err != nil {
+		ob.errorf("Error validating checksum of %s: %v", oBuffer.CurrentName(), err)
+		return
+	}
+	if !valid {
+		oBuffer.Quarantine()
+		ob.alertf("WARNING: %s no longer matches its checksum and was quarantined", oBuffer.CurrentName())
+	}
+}
+
+// drain stops every server accepting new connections and gives in-flight
+// requests until the drain timeout to complete before destroying all
+// buffers, so no request still reads a buffer while it's wiped.
+func (ob *onionbox) drain(servers ...*http.Server) {
+	ob.infof("Shutting down, waiting up to %v for in-flight requests...", ob.drainTime)
+	ctx, cancel := context.WithTimeout(context.Background(), ob.drainTime)
+	defer cancel()
+	var wg sync.WaitGroup
+	for _, srv := range servers {
+		wg.Add(1)
+		go func(srv *http.Server) {
+			defer wg.Done()
+			if err := srv.Shutdown(ctx); err != nil {
+				ob.errorf("Error shutting down onionbox srv: %v", err)
+			}
+		}(srv)
 	}
+	wg.Wait()
+	ob.logf("Destroying all buffers...")
+	ob.destroy()
 }
@@ -0,0 +1,3082 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"onionbox/onion_buffer"
+	"onionbox/templates"
+)
+
+// newTestOnionbox returns an onionbox with the flags' defaults, serving
+// without Tor. Its buffers are destroyed when the test ends.
+func newTestOnionbox(t *testing.T) *onionbox {
+	t.Helper()
+	ob := &onionbox{
+		logger:      log.New(ioutil.Discard, "", 0),
+		store:       onion_buffer.NewStore(),
+		newName:     sillyName,
+		torVersion3: true,
+		maxMemory:   128,
+		chunkSize:   1024,
+		maxAttempts: 5,
+		maxNameLen:  255,
+		maxEntries:  1000,
+		defaultLang: "en",
+		allowPlain:  true,
+		torRetries:  3,
+		drainTime:   30 * time.Second,
+		maxPassLen:  256,
+		uploadField: "files",
+		maxHeader:   16 << 10,
+		port:        80,
+		noTor:       true,
+		devListen:   "127.0.0.1:8080",
+		publishTime: 3 * time.Minute,
+	}
+	t.Cleanup(ob.destroy)
+	return ob
+}
+
+// testFile is a file uploaded by the tests.
+type testFile struct {
+	name    string
+	content string
+}
+
+// newUploadRequest builds a multipart upload of files in field along with
+// the form values, asking for a JSON reply.
+func newUploadRequest(t *testing.T, field string, files []testFile, form map[string]string) *http.Request {
+	t.Helper()
+	body := new(bytes.Buffer)
+	mpWriter := multipart.NewWriter(body)
+	for key, value := range form {
+		if err := mpWriter.WriteField(key, value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, f := range files {
+		w, err := mpWriter.CreateFormFile(field, f.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.WriteString(w, f.content); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := mpWriter.Close(); err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest(http.MethodPost, "/", body)
+	r.Header.Set("Content-Type", mpWriter.FormDataContentType())
+	r.Header.Set("Accept", "application/json")
+	return r
+}
+
+// uploadFiles uploads files with the form values and returns the stored
+// buffer, failing the test if the upload doesn't succeed.
+func uploadFiles(t *testing.T, ob *onionbox, files []testFile, form map[string]string) *onion_buffer.OnionBuffer {
+	t.Helper()
+	w := serve(ob.handler(), newUploadRequest(t, ob.uploadField, files, form))
+	if w.Code != http.StatusOK {
+		t.Fatalf("upload: got %d: %s", w.Code, w.Body)
+	}
+	var result uploadResult
+	if err := json.Unmarshal(w.Body.Bytes(), &result); err != nil {
+		t.Fatalf("upload: %v", err)
+	}
+	oBuffer := ob.store.Get(path.Base(result.URL))
+	if oBuffer == nil {
+		t.Fatalf("upload: %s isn't in the store", result.URL)
+	}
+	return oBuffer
+}
+
+// serve handles r with h and records the response.
+func serve(h http.Handler, r *http.Request) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w
+}
+
+// request handles a request without a body with h.
+func request(h http.Handler, method, target string) *httptest.ResponseRecorder {
+	return serve(h, httptest.NewRequest(method, target, nil))
+}
+
+// randomContent returns n bytes of incompressible content.
+func randomContent(t *testing.T, n int) string {
+	t.Helper()
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+// postPassword submits the password form of the encrypted buffer.
+func postPassword(h http.Handler, name, pass string) *httptest.ResponseRecorder {
+	form := url.Values{"password": {pass}}
+	r := httptest.NewRequest(http.MethodPost, "/"+name, strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return serve(h, r)
+}
+
+// unzip returns the contents of the zip's entries by name.
+func unzip(t *testing.T, b []byte) map[string]string {
+	t.Helper()
+	zReader, err := zip.NewReader(bytes.NewReader(b), int64(len(b)))
+	if err != nil {
+		t.Fatalf("reading zip: %v", err)
+	}
+	files := make(map[string]string, len(zReader.File))
+	for _, f := range zReader.File {
+		rc, err := f.Open()
+		if err != nil {
+			t.Fatalf("opening %s: %v", f.Name, err)
+		}
+		content, err := ioutil.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			t.Fatalf("reading %s: %v", f.Name, err)
+		}
+		files[f.Name] = string(content)
+	}
+	return files
+}
+
+func TestConfirmDownload(t *testing.T) {
+	ob := newTestOnionbox(t)
+	oBuffer := uploadFiles(t, ob, []testFile{{"a.txt", "hello"}}, map[string]string{"confirm_download": "on"})
+	h := ob.handler()
+	// Only the confirmation's POST counts as a download
+	for i, tc := range []struct {
+		method        string
+		wantType      string
+		wantDownloads int
+	}{
+		{http.MethodGet, "text/html", 0},
+		{http.MethodGet, "text/html", 0},
+		{http.MethodPost, "application/zip", 1},
+	} {
+		w := request(h, tc.method, "/"+oBuffer.Name)
+		if w.Code != http.StatusOK {
+			t.Fatalf("%d: %s got %d: %s", i, tc.method, w.Code, w.Body)
+		}
+		if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, tc.wantType) {
+			t.Errorf("%d: %s got Content-Type %q, want %q", i, tc.method, ct, tc.wantType)
+		}
+		if n := oBuffer.DownloadCount(); n != tc.wantDownloads {
+			t.Errorf("%d: %s got %d downloads, want %d", i, tc.method, n, tc.wantDownloads)
+		}
+	}
+}
+
+func TestHead(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		form map[string]string
+	}{
+		{"plain", nil},
+		{"encrypted", map[string]string{"password_enabled": "on", "password": "secret"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ob := newTestOnionbox(t)
+			oBuffer := uploadFiles(t, ob, []testFile{{"a.txt", "hello"}}, tc.form)
+			w := request(ob.handler(), http.MethodHead, "/"+oBuffer.Name)
+			if w.Code != http.StatusOK {
+				t.Fatalf("got %d, want 200", w.Code)
+			}
+			if w.Body.Len() != 0 {
+				t.Errorf("got a %d byte body", w.Body.Len())
+			}
+			if cd := w.Header().Get("Content-Disposition"); !strings.HasPrefix(cd, "attachment") {
+				t.Errorf("got Content-Disposition %q", cd)
+			}
+			// The length of what a download serves, the zip for encrypted buffers too
+			want := oBuffer.PlainSize
+			if !oBuffer.Encrypted {
+				want = int64(len(oBuffer.Bytes))
+			}
+			if cl := w.Header().Get("Content-Length"); cl != strconv.FormatInt(want, 10) {
+				t.Errorf("got Content-Length %q, want %d", cl, want)
+			}
+			if n := oBuffer.DownloadCount(); n != 0 {
+				t.Errorf("got %d downloads, want 0", n)
+			}
+		})
+	}
+}
+
+func TestUploadNoTempFiles(t *testing.T) {
+	tmp := t.TempDir()
+	t.Setenv("TMPDIR", tmp)
+	ob := newTestOnionbox(t)
+	// Far more than maxFormMemory, which ParseMultipartForm would spill
+	content := strings.Repeat("0123456789abcdef", 8*maxFormMemory/16)
+	oBuffer := uploadFiles(t, ob, []testFile{{"large.txt", content}}, nil)
+	files, err := ioutil.ReadDir(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range files {
+		t.Errorf("upload left %s in %s", f.Name(), tmp)
+	}
+	w := request(ob.handler(), http.MethodGet, "/"+oBuffer.Name)
+	if got := unzip(t, w.Body.Bytes())["large.txt"]; got != content {
+		t.Errorf("got %d bytes back, want %d", len(got), len(content))
+	}
+}
+
+func TestDevListener(t *testing.T) {
+	ob := newTestOnionbox(t)
+	h := devHandler(ob.handler())
+	w := request(h, http.MethodGet, "/")
+	if w.Code != http.StatusOK {
+		t.Fatalf("got %d: %s", w.Code, w.Body)
+	}
+	if !strings.Contains(w.Body.String(), `type="file" name="files"`) {
+		t.Errorf("upload form missing from %s", w.Body)
+	}
+	// It serves the same store as the onion service
+	oBuffer := uploadFiles(t, ob, []testFile{{"a.txt", "hello"}}, nil)
+	if w := request(h, http.MethodGet, "/"+oBuffer.Name); unzip(t, w.Body.Bytes())["a.txt"] != "hello" {
+		t.Errorf("dev listener didn't serve %s", oBuffer.Name)
+	}
+}
+
+func TestMemBudget(t *testing.T) {
+	ob := newTestOnionbox(t)
+	ob.memBudget = 1
+	h := ob.handler()
+	first := uploadFiles(t, ob, []testFile{{"a.bin", randomContent(t, 600<<10)}}, map[string]string{"expire": "on", "expiration_time": "60"})
+	second := []testFile{{"b.bin", randomContent(t, 600<<10)}}
+	if w := serve(h, newUploadRequest(t, "files", second, nil)); w.Code != http.StatusInsufficientStorage {
+		t.Fatalf("over budget: got %d, want 507", w.Code)
+	}
+	// Expired buffers are reaped to make room
+	first.Lock()
+	first.ExpiresAt = time.Now().Add(-time.Second)
+	first.Unlock()
+	uploadFiles(t, ob, second, nil)
+	if ob.store.Exists(first.Name) {
+		t.Errorf("expired %s wasn't reaped", first.Name)
+	}
+}
+
+func TestMemBudgetConcurrent(t *testing.T) {
+	ob := newTestOnionbox(t)
+	ob.memBudget = 1
+	h := ob.handler()
+	// Only one of the uploads fits, however they interleave
+	codes := make(chan int, 8)
+	var wg sync.WaitGroup
+	for i := 0; i < cap(codes); i++ {
+		r := newUploadRequest(t, "files", []testFile{{"a.bin", randomContent(t, 600<<10)}}, nil)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			codes <- serve(h, r).Code
+		}()
+	}
+	wg.Wait()
+	close(codes)
+	stored := 0
+	for code := range codes {
+		switch code {
+		case http.StatusOK:
+			stored++
+		case http.StatusInsufficientStorage:
+		default:
+			t.Errorf("got %d, want 200 or 507", code)
+		}
+	}
+	if stored != 1 {
+		t.Errorf("%d uploads were stored, want 1", stored)
+	}
+}
+
+// countingReader counts the bytes read through it.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	atomic.AddInt64(&c.n, int64(n))
+	return n, err
+}
+
+func (c *countingReader) Close() error {
+	return nil
+}
+
+func TestMemBudgetStreaming(t *testing.T) {
+	encrypted := map[string]string{"password_enabled": "on", "password": "secret"}
+	for _, tc := range []struct {
+		name     string
+		disk     bool
+		form     map[string]string
+		size     int
+		wantCode int
+		// wantEarly is set if the upload must be refused before it's read whole
+		wantEarly bool
+	}{
+		{"in memory", false, nil, 4 << 20, http.StatusInsufficientStorage, true},
+		{"in memory fits", false, nil, 256 << 10, http.StatusOK, false},
+		{"encrypted copy", false, encrypted, 600 << 10, http.StatusInsufficientStorage, false},
+		{"disk", true, nil, 4 << 20, http.StatusOK, false},
+		{"disk read back", true, encrypted, 4 << 20, http.StatusInsufficientStorage, false},
+	} {
+		ob := newTestOnionbox(t)
+		ob.memBudget = 1
+		if tc.disk {
+			ob.diskDir = t.TempDir()
+		}
+		r := newUploadRequest(t, "files", []testFile{{"a.bin", randomContent(t, tc.size)}}, tc.form)
+		body := &countingReader{r: r.Body}
+		r.Body = body
+		w := serve(ob.handler(), r)
+		if w.Code != tc.wantCode {
+			t.Errorf("%s: got %d, want %d: %s", tc.name, w.Code, tc.wantCode, w.Body)
+			continue
+		}
+		if read := atomic.LoadInt64(&body.n); tc.wantEarly && read >= r.ContentLength {
+			t.Errorf("%s: read all %d bytes before refusing", tc.name, read)
+		}
+		if n := ob.store.TotalBytes(); tc.wantCode != http.StatusOK && n != 0 {
+			t.Errorf("%s: %d bytes stored", tc.name, n)
+		}
+	}
+}
+
+func TestPasswordLockout(t *testing.T) {
+	encrypted := map[string]string{"password_enabled": "on", "password": "secret"}
+	for _, tc := range []struct {
+		name     string
+		failures int
+		wantCode int
+	}{
+		{"below the limit", 4, http.StatusOK},
+		{"at the limit", 5, http.StatusTooManyRequests},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ob := newTestOnionbox(t)
+			oBuffer := uploadFiles(t, ob, []testFile{{"a.txt", "hello"}}, encrypted)
+			h := ob.handler()
+			for i := 0; i < tc.failures; i++ {
+				if w := postPassword(h, oBuffer.Name, "wrong"); w.Code != http.StatusInternalServerError {
+					t.Fatalf("wrong password %d: got %d, want 500", i+1, w.Code)
+				}
+			}
+			// The right password only works before the lockout
+			w := postPassword(h, oBuffer.Name, "secret")
+			if w.Code != tc.wantCode {
+				t.Fatalf("right password: got %d, want %d", w.Code, tc.wantCode)
+			}
+			if w.Code != http.StatusOK {
+				return
+			}
+			if unzip(t, w.Body.Bytes())["a.txt"] != "hello" {
+				t.Errorf("decrypted zip doesn't hold a.txt")
+			}
+			oBuffer.Lock()
+			failed := oBuffer.FailedAttempts
+			oBuffer.Unlock()
+			if failed != 0 {
+				t.Errorf("got %d failed attempts after decrypting, want 0", failed)
+			}
+		})
+	}
+}
+
+func TestUploadLimits(t *testing.T) {
+	long := strings.Repeat("a", 300) + ".txt"
+	for _, tc := range []struct {
+		name     string
+		files    []testFile
+		wantCode int
+		wantBody string
+	}{
+		{"within limits", []testFile{{"a.txt", "a"}, {"b.txt", "b"}, {"c.txt", "c"}}, http.StatusOK, ""},
+		{"long filename", []testFile{{"a.txt", "a"}, {long, "b"}}, http.StatusBadRequest, "Filename too long: " + long},
+		{"too many files", []testFile{{"a.txt", "a"}, {"b.txt", "b"}, {"c.txt", "c"}, {"d.txt", "d"}}, http.StatusBadRequest, "at most 3 are allowed"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ob := newTestOnionbox(t)
+			ob.maxEntries = 3
+			w := serve(ob.handler(), newUploadRequest(t, "files", tc.files, nil))
+			if w.Code != tc.wantCode {
+				t.Fatalf("got %d, want %d: %s", w.Code, tc.wantCode, w.Body)
+			}
+			if !strings.Contains(w.Body.String(), tc.wantBody) {
+				t.Errorf("got %s, want it to mention %q", w.Body, tc.wantBody)
+			}
+			if w.Code != http.StatusOK && len(ob.store.List()) != 0 {
+				t.Errorf("rejected upload was stored")
+			}
+		})
+	}
+}
+
+// failingReader returns its data, then err.
+type failingReader struct {
+	data []byte
+	err  error
+}
+
+func (f *failingReader) Read(p []byte) (int, error) {
+	if len(f.data) == 0 {
+		return 0, f.err
+	}
+	n := copy(p, f.data)
+	f.data = f.data[n:]
+	return n, nil
+}
+
+func TestUploadReadError(t *testing.T) {
+	ob := newTestOnionbox(t)
+	r := newUploadRequest(t, "files", []testFile{{"a.txt", strings.Repeat("a", 64<<10)}}, nil)
+	// Cut the upload off halfway through the file
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Body = ioutil.NopCloser(&failingReader{body[:len(body)/2], errors.New("connection reset")})
+	// A file that can't be read fails the whole upload once, naming it
+	w := serve(ob.handler(), r)
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("got %d, want 400", w.Code)
+	}
+	var reply struct {
+		Error string `json:"error"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &reply); err != nil {
+		t.Fatalf("got more than one reply: %v: %s", err, w.Body)
+	}
+	if !strings.Contains(reply.Error, "a.txt") {
+		t.Errorf("error %q doesn't name the file", reply.Error)
+	}
+	if n := len(ob.store.List()); n != 0 {
+		t.Errorf("%d buffers stored, want none", n)
+	}
+}
+
+func TestWriteFilesReadError(t *testing.T) {
+	files := []testFile{{"first.txt", strings.Repeat("a", 1024)}, {"second.txt", strings.Repeat("b", 64<<10)}}
+	r := newUploadRequest(t, "files", files, nil)
+	_, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second := bytes.Index(body, []byte("bbbb"))
+	for _, tc := range []struct {
+		name     string
+		cut      int
+		wantName string
+	}{
+		{"first file", bytes.Index(body, []byte("aaaa")) + 512, "first.txt"},
+		{"second file", second + 32<<10, "second.txt"},
+	} {
+		ob := newTestOnionbox(t)
+		mpReader := multipart.NewReader(&failingReader{body[:tc.cut], errors.New("connection reset")}, params["boundary"])
+		_, err := ob.writeFilesToBuffers(zip.NewWriter(ioutil.Discard), mpReader, make(url.Values))
+		if _, ok := err.(badUploadError); !ok {
+			t.Fatalf("%s: got %v, want a badUploadError", tc.name, err)
+		}
+		if !strings.Contains(err.Error(), tc.wantName) {
+			t.Errorf("%s: error %q doesn't name %s", tc.name, err, tc.wantName)
+		}
+	}
+}
+
+func TestNormalizeMtime(t *testing.T) {
+	for _, normalize := range []bool{false, true} {
+		ob := newTestOnionbox(t)
+		ob.normMtime = normalize
+		ob.zipManifest = true
+		oBuffer := uploadFiles(t, ob, []testFile{{"a.txt", "a"}, {"b.txt", "b"}}, map[string]string{"expire": "on", "expiration_time": "60"})
+		zReader, err := zip.NewReader(bytes.NewReader(oBuffer.Bytes), int64(len(oBuffer.Bytes)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, f := range zReader.File {
+			if got := f.Modified.Equal(zipEpoch); got != normalize {
+				t.Errorf("normalize %t: %s modified at %v", normalize, f.Name, f.Modified)
+			}
+		}
+		// The manifest mustn't give the upload time away either
+		manifest := unzip(t, oBuffer.Bytes)["onionbox-manifest.txt"]
+		if got := strings.Contains(manifest, "Uploaded:"); got == normalize {
+			t.Errorf("normalize %t: manifest has an Uploaded line %t", normalize, got)
+		}
+		if got := strings.Contains(manifest, "Expires: 1h0m0s after the upload"); got != normalize {
+			t.Errorf("normalize %t: manifest has a relative expiry %t: %s", normalize, got, manifest)
+		}
+	}
+}
+
+func TestLocalizedPages(t *testing.T) {
+	ob := newTestOnionbox(t)
+	for _, tc := range []struct {
+		acceptLanguage string
+		want           string
+	}{
+		{"", "Please select the file you would like to securely share."},
+		{"es-ES,es;q=0.9", "Seleccione el archivo que desea compartir de forma segura."},
+		{"xx", "Please select the file you would like to securely share."},
+	} {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Set("Accept-Language", tc.acceptLanguage)
+		if w := serve(ob.handler(), r); !strings.Contains(w.Body.String(), tc.want) {
+			t.Errorf("Accept-Language %q: page doesn't contain %q", tc.acceptLanguage, tc.want)
+		}
+	}
+}
+
+func TestAllowPlaintext(t *testing.T) {
+	encrypted := map[string]string{"password_enabled": "on", "password": "secret"}
+	for _, tc := range []struct {
+		allowPlain bool
+		form       map[string]string
+		wantCode   int
+	}{
+		{true, nil, http.StatusOK},
+		{true, encrypted, http.StatusOK},
+		{false, nil, http.StatusBadRequest},
+		{false, encrypted, http.StatusOK},
+	} {
+		ob := newTestOnionbox(t)
+		ob.allowPlain = tc.allowPlain
+		w := serve(ob.handler(), newUploadRequest(t, "files", []testFile{{"a.txt", "a"}}, tc.form))
+		if w.Code != tc.wantCode {
+			t.Errorf("allow plaintext %t, encrypted %t: got %d, want %d", tc.allowPlain, tc.form != nil, w.Code, tc.wantCode)
+		}
+		if w.Code != http.StatusOK && len(ob.store.List()) != 0 {
+			t.Errorf("rejected upload was stored")
+		}
+	}
+}
+
+func TestDisplayName(t *testing.T) {
+	for _, tc := range []struct {
+		displayName string
+		want        string
+	}{
+		{"report", "report.zip"},
+		{"report.ZIP", "report.ZIP"},
+		{"../../etc/passwd", "passwd.zip"},
+		{`C:\Users\me\holiday photos`, "holiday photos.zip"},
+		{`<script>"evil".zip`, "scriptevil.zip"},
+		{"...", ""},
+		{"", ""},
+	} {
+		ob := newTestOnionbox(t)
+		oBuffer := uploadFiles(t, ob, []testFile{{"a.txt", "a"}}, map[string]string{"display_name": tc.displayName})
+		// Unusable names fall back to the buffer's name
+		want := tc.want
+		if want == "" {
+			want = oBuffer.Name + ".zip"
+		}
+		w := request(ob.handler(), http.MethodGet, "/"+oBuffer.Name)
+		if cd := w.Header().Get("Content-Disposition"); cd != fmt.Sprintf("attachment; filename=%q", want) {
+			t.Errorf("display name %q: got Content-Disposition %q, want filename %q", tc.displayName, cd, want)
+		}
+	}
+}
+
+func TestValidateFlags(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		set     func(ob *onionbox)
+		wantErr bool
+	}{
+		{"defaults", func(ob *onionbox) {}, false},
+		{"zero -mem", func(ob *onionbox) { ob.maxMemory = 0 }, true},
+		{"negative -mem", func(ob *onionbox) { ob.maxMemory = -1 }, true},
+		{"overflowing -mem", func(ob *onionbox) { ob.maxMemory = 1 << 50 }, true},
+		{"largest -mem", func(ob *onionbox) { ob.maxMemory = maxMemoryMB }, false},
+		{"negative -mem-budget", func(ob *onionbox) { ob.memBudget = -1 }, true},
+		{"overflowing -mem-budget", func(ob *onionbox) { ob.memBudget = 1 << 50 }, true},
+		{"zero -chunk", func(ob *onionbox) { ob.chunkSize = 0 }, true},
+		{"negative -max-attempts", func(ob *onionbox) { ob.maxAttempts = -1 }, true},
+		{"negative -max-concurrent-uploads", func(ob *onionbox) { ob.maxUploads = -1 }, true},
+		{"largest -onion-max-streams", func(ob *onionbox) { ob.maxStreams = 65535 }, false},
+		{"overflowing -onion-max-streams", func(ob *onionbox) { ob.maxStreams = 65536 }, true},
+		{"short -short-links", func(ob *onionbox) { ob.shortLen = minShortLen - 1 }, true},
+		{"shortest -short-links", func(ob *onionbox) { ob.shortLen = minShortLen }, false},
+		{"zero -max-password-len", func(ob *onionbox) { ob.maxPassLen = 0 }, true},
+		{"negative -max-procs", func(ob *onionbox) { ob.maxProcs = -1 }, true},
+		{"all CPUs -max-procs", func(ob *onionbox) { ob.maxProcs = runtime.NumCPU() }, false},
+		{"too many -max-procs", func(ob *onionbox) { ob.maxProcs = runtime.NumCPU() + 1 }, true},
+		{"zero -publish-timeout", func(ob *onionbox) { ob.publishTime = 0 }, true},
+		{"negative -integrity-interval", func(ob *onionbox) { ob.checkTime = -time.Second }, true},
+		{"-admin-onion with -no-tor", func(ob *onionbox) { ob.adminOnion = true }, true},
+		{"-admin-onion", func(ob *onionbox) { ob.adminOnion, ob.noTor = true, false }, false},
+		{"-min-tor-version", func(ob *onionbox) { ob.minTorVer = "0.4.8" }, false},
+		{"invalid -min-tor-version", func(ob *onionbox) { ob.minTorVer = "latest" }, true},
+		{"zero -port", func(ob *onionbox) { ob.port = 0 }, true},
+		{"negative -port", func(ob *onionbox) { ob.port = -80 }, true},
+		{"overflowing -port", func(ob *onionbox) { ob.port = 65536 }, true},
+		{"privileged -port", func(ob *onionbox) { ob.port = 1 }, false},
+		{"largest -port", func(ob *onionbox) { ob.port = 65535 }, false},
+	} {
+		ob := newTestOnionbox(t)
+		tc.set(ob)
+		if err := ob.validateFlags(); (err != nil) != tc.wantErr {
+			t.Errorf("%s: got %v, want error %t", tc.name, err, tc.wantErr)
+		}
+	}
+}
+
+// fakeStore is a minimal Store keeping buffers in a map.
+type fakeStore struct {
+	sync.Mutex
+	buffers map[string]*onion_buffer.OnionBuffer
+	added   int
+	gets    int
+}
+
+func (s *fakeStore) Add(oBuffer *onion_buffer.OnionBuffer) error {
+	s.Lock()
+	defer s.Unlock()
+	s.buffers[oBuffer.Name] = oBuffer
+	s.added++
+	return nil
+}
+
+func (s *fakeStore) Get(bufName string) *onion_buffer.OnionBuffer {
+	s.Lock()
+	defer s.Unlock()
+	s.gets++
+	return s.buffers[onion_buffer.NormalizeName(bufName)]
+}
+
+func (s *fakeStore) Exists(bufName string) bool {
+	return s.Get(bufName) != nil
+}
+
+func (s *fakeStore) Destroy(oBuffer *onion_buffer.OnionBuffer) error {
+	s.Lock()
+	defer s.Unlock()
+	if s.buffers[oBuffer.Name] != oBuffer {
+		return onion_buffer.ErrNotFound
+	}
+	delete(s.buffers, oBuffer.Name)
+	return oBuffer.Destroy()
+}
+
+func (s *fakeStore) Rename(oBuffer *onion_buffer.OnionBuffer, newName string) error {
+	return errors.New("not supported")
+}
+
+func (s *fakeStore) Tombstoned(bufName string) bool {
+	return false
+}
+
+func (s *fakeStore) DestroyAll() error {
+	for _, oBuffer := range s.List() {
+		if err := s.Destroy(oBuffer); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *fakeStore) DestroyExpiredBuffers() error {
+	return nil
+}
+
+func (s *fakeStore) List() []*onion_buffer.OnionBuffer {
+	s.Lock()
+	defer s.Unlock()
+	var buffers []*onion_buffer.OnionBuffer
+	for _, oBuffer := range s.buffers {
+		buffers = append(buffers, oBuffer)
+	}
+	return buffers
+}
+
+func (s *fakeStore) TotalBytes() int64 {
+	return 0
+}
+
+func (s *fakeStore) Reserve(n, limit int64) bool {
+	return true
+}
+
+func (s *fakeStore) Release(n int64) {}
+
+func TestFakeStore(t *testing.T) {
+	ob := newTestOnionbox(t)
+	store := &fakeStore{buffers: make(map[string]*onion_buffer.OnionBuffer)}
+	ob.store = store
+	oBuffer := uploadFiles(t, ob, []testFile{{"a.txt", "hello"}}, map[string]string{"limit_downloads": "on", "download_limit": "1"})
+	if store.added != 1 {
+		t.Fatalf("fake store got %d buffers, want 1", store.added)
+	}
+	h := ob.handler()
+	if w := request(h, http.MethodGet, "/"+oBuffer.Name); unzip(t, w.Body.Bytes())["a.txt"] != "hello" {
+		t.Errorf("download from the fake store failed: %d", w.Code)
+	}
+	// Reaching the limit destroys the buffer through the store
+	request(h, http.MethodGet, "/"+oBuffer.Name)
+	if w := request(h, http.MethodGet, "/"+oBuffer.Name); w.Code != http.StatusNotFound {
+		t.Errorf("got %d after the download limit, want 404", w.Code)
+	}
+}
+
+func TestDiskDir(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		destroy func(ob *onionbox, oBuffer *onion_buffer.OnionBuffer) error
+	}{
+		{"destroy", func(ob *onionbox, oBuffer *onion_buffer.OnionBuffer) error {
+			return ob.store.Destroy(oBuffer)
+		}},
+		{"shutdown", func(ob *onionbox, oBuffer *onion_buffer.OnionBuffer) error {
+			ob.destroy()
+			return nil
+		}},
+	} {
+		ob := newTestOnionbox(t)
+		ob.diskDir = t.TempDir()
+		oBuffer := uploadFiles(t, ob, []testFile{{"a.txt", "hello"}}, nil)
+		files, err := ioutil.ReadDir(ob.diskDir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(files) != 1 {
+			t.Fatalf("%s: got %d files in the disk dir, want 1", tc.name, len(files))
+		}
+		if w := request(ob.handler(), http.MethodGet, "/"+oBuffer.Name); unzip(t, w.Body.Bytes())["a.txt"] != "hello" {
+			t.Errorf("%s: download from disk failed: %d", tc.name, w.Code)
+		}
+		if err := tc.destroy(ob, oBuffer); err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		if files, _ = ioutil.ReadDir(ob.diskDir); len(files) != 0 {
+			t.Errorf("%s: %d files left in the disk dir", tc.name, len(files))
+		}
+	}
+}
+
+func TestTorStartConf(t *testing.T) {
+	for _, tc := range []struct {
+		name          string
+		debug         bool
+		singleHop     bool
+		wantDebug     bool
+		wantSingleHop bool
+	}{
+		{"default", false, false, false, false},
+		{"debug", true, false, true, false},
+		{"single hop", false, true, false, true},
+	} {
+		ob := newTestOnionbox(t)
+		ob.debug = tc.debug
+		ob.singleHop = tc.singleHop
+		conf := ob.torStartConf()
+		if (conf.DebugWriter != nil) != tc.wantDebug {
+			t.Errorf("%s: got DebugWriter %v", tc.name, conf.DebugWriter)
+		}
+		if conf.NoAutoSocksPort != tc.wantSingleHop {
+			t.Errorf("%s: got NoAutoSocksPort %t, want %t", tc.name, conf.NoAutoSocksPort, tc.wantSingleHop)
+		}
+		args := strings.Join(conf.ExtraArgs, " ")
+		if strings.Contains(args, "--HiddenServiceSingleHopMode 1") != tc.wantSingleHop ||
+			strings.Contains(args, "--HiddenServiceNonAnonymousMode 1") != tc.wantSingleHop {
+			t.Errorf("%s: got ExtraArgs %q", tc.name, args)
+		}
+	}
+}
+
+func TestQuiet(t *testing.T) {
+	for _, tc := range []struct {
+		quiet bool
+		want  string
+	}{
+		{false, "started\n"},
+		{true, ""},
+	} {
+		var buf bytes.Buffer
+		ob := newTestOnionbox(t)
+		ob.logger = log.New(&buf, "", 0)
+		ob.quiet = tc.quiet
+		ob.infof("started")
+		if buf.String() != tc.want {
+			t.Errorf("quiet=%v: got %q, want %q", tc.quiet, buf.String(), tc.want)
+		}
+	}
+}
+
+func TestUploadNoFiles(t *testing.T) {
+	ob := newTestOnionbox(t)
+	h := ob.handler()
+	garbage := httptest.NewRequest(http.MethodPost, "/", strings.NewReader("garbage"))
+	garbage.Header.Set("Content-Type", "multipart/form-data; boundary=xx")
+	notMultipart := httptest.NewRequest(http.MethodPost, "/", strings.NewReader("files=a"))
+	notMultipart.Header.Set("Content-Type", "multipart/form-data")
+	for _, tc := range []struct {
+		name string
+		r    *http.Request
+		want string
+	}{
+		{"missing field", newUploadRequest(t, "other", []testFile{{"a.txt", "hello"}}, nil), "No files provided."},
+		{"empty form", newUploadRequest(t, "files", nil, map[string]string{"expire": "on"}), "No files provided."},
+		{"no boundary", notMultipart, "Malformed upload form."},
+		{"no parts", garbage, "Malformed upload form."},
+	} {
+		w := serve(h, tc.r)
+		if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), tc.want) {
+			t.Errorf("%s: got %d %q, want 400 %q", tc.name, w.Code, w.Body, tc.want)
+		}
+	}
+	if n := len(ob.store.List()); n != 0 {
+		t.Errorf("%d buffers stored", n)
+	}
+}
+
+func TestPasswordHint(t *testing.T) {
+	ob := newTestOnionbox(t)
+	h := ob.handler()
+	for _, tc := range []struct {
+		name string
+		hint string
+		want string
+	}{
+		{"no hint", "", ""},
+		{"hint", "our dog's name", "Password hint: our dog&#39;s name"},
+		{"escaped", "<b>bold</b>", "Password hint: &lt;b&gt;bold&lt;/b&gt;"},
+		{"control characters", "a\x00b\nc", "Password hint: abc"},
+		{"too long", strings.Repeat("x", maxHintLen+10), "Password hint: " + strings.Repeat("x", maxHintLen) + "<"},
+	} {
+		form := map[string]string{"password_enabled": "on", "password": "secret"}
+		if tc.hint != "" {
+			form["password_hint"] = tc.hint
+		}
+		oBuffer := uploadFiles(t, ob, []testFile{{"a.txt", "hello"}}, form)
+		body := request(h, http.MethodGet, "/"+oBuffer.Name).Body.String()
+		if tc.want == "" {
+			if strings.Contains(body, "Password hint:") {
+				t.Errorf("%s: hint shown: %s", tc.name, body)
+			}
+		} else if !strings.Contains(body, tc.want) {
+			t.Errorf("%s: %q not in page: %s", tc.name, tc.want, body)
+		}
+	}
+}
+
+func TestMaxConcurrentUploads(t *testing.T) {
+	const maxUploads = 2
+	ob := newTestOnionbox(t)
+	ob.uploadSem = make(chan struct{}, maxUploads)
+	h := ob.handler()
+	// Keep maxUploads uploads in flight by holding back the end of their bodies
+	codes := make(chan int, maxUploads)
+	var pipes []*io.PipeWriter
+	var tails [][]byte
+	for i := 0; i < maxUploads; i++ {
+		r := newUploadRequest(t, "files", []testFile{{"a.txt", "hello"}}, nil)
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pr, pw := io.Pipe()
+		r.Body = pr
+		pipes = append(pipes, pw)
+		tails = append(tails, body[len(body)-10:])
+		go func() { codes <- serve(h, r).Code }()
+		go pw.Write(body[:len(body)-10])
+	}
+	for deadline := time.Now().Add(5 * time.Second); len(ob.uploadSem) < maxUploads; {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d uploads in flight, want %d", len(ob.uploadSem), maxUploads)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	w := serve(h, newUploadRequest(t, "files", []testFile{{"b.txt", "hello"}}, nil))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("upload %d: got %d, want 503", maxUploads+1, w.Code)
+	}
+	for i, pw := range pipes {
+		pw.Write(tails[i])
+		pw.Close()
+	}
+	for i := 0; i < maxUploads; i++ {
+		if code := <-codes; code != http.StatusOK {
+			t.Errorf("in-flight upload: got %d, want 200", code)
+		}
+	}
+	// Slots are given back on success and on errors
+	if w := serve(h, newUploadRequest(t, "files", nil, nil)); w.Code != http.StatusBadRequest {
+		t.Errorf("empty upload: got %d, want 400", w.Code)
+	}
+	if n := len(ob.uploadSem); n != 0 {
+		t.Errorf("%d upload slots still taken", n)
+	}
+	uploadFiles(t, ob, []testFile{{"c.txt", "hello"}}, nil)
+}
+
+func TestNoZipSingle(t *testing.T) {
+	ob := newTestOnionbox(t)
+	ob.noZipSingle = true
+	h := ob.handler()
+	for _, tc := range []struct {
+		name            string
+		files           []testFile
+		wantRaw         bool
+		wantContentType string
+		wantFilename    string
+	}{
+		{"single file", []testFile{{"notes.txt", "hello"}}, true, "text/plain; charset=utf-8", "notes.txt"},
+		{"multiple files", []testFile{{"a.txt", "hello"}, {"b.txt", "world"}}, false, "application/zip", ".zip"},
+	} {
+		oBuffer := uploadFiles(t, ob, tc.files, nil)
+		w := request(h, http.MethodGet, "/"+oBuffer.Name)
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: got %d", tc.name, w.Code)
+		}
+		if tc.wantRaw {
+			if w.Body.String() != tc.files[0].content {
+				t.Errorf("%s: got %q, want the raw file", tc.name, w.Body)
+			}
+		} else if files := unzip(t, w.Body.Bytes()); len(files) != len(tc.files) {
+			t.Errorf("%s: got %d files in the zip, want %d", tc.name, len(files), len(tc.files))
+		}
+		if ct := w.Header().Get("Content-Type"); ct != tc.wantContentType {
+			t.Errorf("%s: got Content-Type %q, want %q", tc.name, ct, tc.wantContentType)
+		}
+		if cd := w.Header().Get("Content-Disposition"); !strings.Contains(cd, tc.wantFilename) {
+			t.Errorf("%s: got Content-Disposition %q, want %s", tc.name, cd, tc.wantFilename)
+		}
+	}
+	// Encrypted uploads stay zipped
+	oBuffer := uploadFiles(t, ob, []testFile{{"notes.txt", "hello"}}, map[string]string{"password_enabled": "on", "password": "secret"})
+	plain, err := onion_buffer.Decrypt(oBuffer.Bytes, "secret", oBuffer.Cipher)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if unzip(t, plain)["notes.txt"] != "hello" {
+		t.Error("encrypted single file wasn't zipped")
+	}
+}
+
+func TestRetry(t *testing.T) {
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+	for _, tc := range []struct {
+		name      string
+		ctx       context.Context
+		failures  int
+		retries   int
+		wantErr   bool
+		wantCalls int
+	}{
+		{"fails twice", context.Background(), 2, 3, false, 3},
+		{"out of retries", context.Background(), 5, 1, true, 2},
+		{"canceled", canceled, 5, 3, true, 1},
+	} {
+		var buf bytes.Buffer
+		ob := newTestOnionbox(t)
+		ob.logger = log.New(&buf, "", 0)
+		calls := 0
+		err := ob.retry(tc.ctx, "Starting Tor", tc.retries, func() error {
+			calls++
+			if calls <= tc.failures {
+				return errors.New("bootstrap failed")
+			}
+			return nil
+		})
+		if (err != nil) != tc.wantErr {
+			t.Errorf("%s: got %v, want error %t", tc.name, err, tc.wantErr)
+		}
+		if calls != tc.wantCalls {
+			t.Errorf("%s: got %d calls, want %d", tc.name, calls, tc.wantCalls)
+		}
+		if !strings.Contains(buf.String(), "Starting Tor failed (attempt 1 of") {
+			t.Errorf("%s: attempts not logged: %q", tc.name, buf.String())
+		}
+	}
+}
+
+func TestExpiredOnAccess(t *testing.T) {
+	ob := newTestOnionbox(t)
+	h := ob.handler()
+	for _, tc := range []struct {
+		name   string
+		target func(oBuffer *onion_buffer.OnionBuffer) string
+	}{
+		{"download", func(oBuffer *onion_buffer.OnionBuffer) string { return "/" + oBuffer.Name }},
+		{"api", func(oBuffer *onion_buffer.OnionBuffer) string {
+			return "/api/buffer/" + oBuffer.Name + "/receipts?token=" + oBuffer.Token
+		}},
+	} {
+		// The reaper doesn't run, the buffer expires between its ticks
+		oBuffer := uploadFiles(t, ob, []testFile{{"a.txt", "hello"}}, map[string]string{"expire": "on", "expiration_time": "60"})
+		if w := request(h, http.MethodGet, tc.target(oBuffer)); w.Code != http.StatusOK {
+			t.Fatalf("%s: got %d before expiring, want 200", tc.name, w.Code)
+		}
+		oBuffer.Lock()
+		oBuffer.ExpiresAt = time.Now().Add(-time.Second)
+		oBuffer.Unlock()
+		if w := request(h, http.MethodGet, tc.target(oBuffer)); w.Code != http.StatusGone {
+			t.Errorf("%s: got %d after expiring, want 410", tc.name, w.Code)
+		}
+		if ob.store.Exists(oBuffer.Name) {
+			t.Errorf("%s: expired buffer is still stored", tc.name)
+		}
+		if oBuffer.Bytes != nil {
+			t.Errorf("%s: expired buffer wasn't wiped", tc.name)
+		}
+	}
+}
+
+func TestListenConf(t *testing.T) {
+	for _, tc := range []struct {
+		name         string
+		set          func(ob *onionbox)
+		maxStreams   int
+		port         int
+		nonAnonymous bool
+	}{
+		{"defaults", func(ob *onionbox) {}, 0, 80, false},
+		{"max streams", func(ob *onionbox) { ob.maxStreams = 20 }, 20, 80, false},
+		{"port", func(ob *onionbox) { ob.port = 8080 }, 0, 8080, false},
+		{"single hop", func(ob *onionbox) { ob.singleHop = true }, 0, 80, true},
+	} {
+		ob := newTestOnionbox(t)
+		tc.set(ob)
+		conf := ob.listenConf()
+		if conf.MaxStreams != tc.maxStreams {
+			t.Errorf("%s: got MaxStreams %d, want %d", tc.name, conf.MaxStreams, tc.maxStreams)
+		}
+		if len(conf.RemotePorts) != 1 || conf.RemotePorts[0] != tc.port {
+			t.Errorf("%s: got RemotePorts %v, want [%d]", tc.name, conf.RemotePorts, tc.port)
+		}
+		if !conf.Version3 {
+			t.Errorf("%s: not a v3 service", tc.name)
+		}
+		if conf.NonAnonymous != tc.nonAnonymous {
+			t.Errorf("%s: got NonAnonymous %t, want %t", tc.name, conf.NonAnonymous, tc.nonAnonymous)
+		}
+	}
+}
+
+func TestSkipDeflate(t *testing.T) {
+	random := randomContent(t, 64<<10)
+	text := strings.Repeat("the quick brown fox jumps over the lazy dog\n", 1500)
+	for _, tc := range []struct {
+		name        string
+		skipDeflate bool
+		wantRandom  uint16
+		wantText    uint16
+	}{
+		{"skip", true, zip.Store, zip.Deflate},
+		{"always deflate", false, zip.Deflate, zip.Deflate},
+	} {
+		ob := newTestOnionbox(t)
+		ob.skipDeflate = tc.skipDeflate
+		oBuffer := uploadFiles(t, ob, []testFile{{"random.bin", random}, {"text.txt", text}}, nil)
+		zReader, err := zip.NewReader(bytes.NewReader(oBuffer.Bytes), int64(len(oBuffer.Bytes)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		methods := make(map[string]uint16)
+		for _, f := range zReader.File {
+			methods[f.Name] = f.Method
+		}
+		if methods["random.bin"] != tc.wantRandom {
+			t.Errorf("%s: random payload stored with method %d, want %d", tc.name, methods["random.bin"], tc.wantRandom)
+		}
+		if methods["text.txt"] != tc.wantText {
+			t.Errorf("%s: text payload stored with method %d, want %d", tc.name, methods["text.txt"], tc.wantText)
+		}
+		// Both still extract to what was uploaded
+		files := unzip(t, oBuffer.Bytes)
+		if files["random.bin"] != random || files["text.txt"] != text {
+			t.Errorf("%s: zip doesn't round-trip", tc.name)
+		}
+	}
+}
+
+func TestDrain(t *testing.T) {
+	ob := newTestOnionbox(t)
+	ob.noZipSingle = true
+	content := randomContent(t, 16<<20)
+	oBuffer := uploadFiles(t, ob, []testFile{{"a.bin", content}}, nil)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &http.Server{Handler: ob.handler()}
+	go srv.Serve(l)
+	resp, err := http.Get("http://" + l.Addr().String() + "/" + oBuffer.Name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	// Read a little, so the rest of the download is still in flight
+	head := make([]byte, 1024)
+	if _, err := io.ReadFull(resp.Body, head); err != nil {
+		t.Fatal(err)
+	}
+	if oBuffer.InFlight() != 1 {
+		t.Fatalf("got %d downloads in flight, want 1", oBuffer.InFlight())
+	}
+	drained := make(chan struct{})
+	go func() {
+		ob.drain(srv)
+		close(drained)
+	}()
+	rest, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("download cut off: %v", err)
+	}
+	if string(head)+string(rest) != content {
+		t.Errorf("got %d bytes, want the %d uploaded", len(head)+len(rest), len(content))
+	}
+	<-drained
+	if n := len(ob.store.List()); n != 0 {
+		t.Errorf("%d buffers left after draining", n)
+	}
+	if _, err := http.Get("http://" + l.Addr().String() + "/"); err == nil {
+		t.Error("new connections are accepted after draining")
+	}
+}
+
+func TestShareURL(t *testing.T) {
+	mustIPNet := func(s string) *net.IPNet {
+		ipNet, err := parseIPNet(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ipNet
+	}
+	forwarded := map[string]string{"X-Forwarded-Host": "proxy.example.onion", "X-Forwarded-Proto": "https"}
+	for _, tc := range []struct {
+		name    string
+		set     func(ob *onionbox)
+		headers map[string]string
+		want    string
+	}{
+		{"onion", func(ob *onionbox) {}, nil, "http://abc.onion/name"},
+		{"onion port", func(ob *onionbox) { ob.port = 8080 }, nil, "http://abc.onion:8080/name"},
+		{"no tor", func(ob *onionbox) { ob.noTor = true }, nil, "http://example.com/name"},
+		{"public host", func(ob *onionbox) { ob.publicHost = "files.example.onion" }, nil, "http://files.example.onion/name"},
+		{"public host with scheme", func(ob *onionbox) { ob.publicHost = "https://files.example.onion/" }, nil, "https://files.example.onion/name"},
+		{"public host over proxy", func(ob *onionbox) {
+			ob.publicHost = "files.example.onion"
+			ob.trustProxy = mustIPNet("192.0.2.1")
+		}, forwarded, "http://files.example.onion/name"},
+		{"trusted proxy", func(ob *onionbox) { ob.trustProxy = mustIPNet("192.0.2.0/24") }, forwarded, "https://proxy.example.onion/name"},
+		{"untrusted proxy", func(ob *onionbox) { ob.trustProxy = mustIPNet("10.0.0.0/8") }, forwarded, "http://abc.onion/name"},
+		{"no proxy trusted", func(ob *onionbox) {}, forwarded, "http://abc.onion/name"},
+	} {
+		ob := newTestOnionbox(t)
+		ob.noTor = false
+		ob.onionURL = "abc"
+		tc.set(ob)
+		// httptest requests come from 192.0.2.1
+		r := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+		for k, v := range tc.headers {
+			r.Header.Set(k, v)
+		}
+		if got := ob.shareURL(r, "name"); got != tc.want {
+			t.Errorf("%s: got %q, want %q", tc.name, got, tc.want)
+		}
+	}
+	// The link in upload responses follows -public-host
+	ob := newTestOnionbox(t)
+	ob.publicHost = "files.example.onion"
+	w := serve(ob.handler(), newUploadRequest(t, "files", []testFile{{"a.txt", "hello"}}, nil))
+	var result uploadResult
+	if err := json.Unmarshal(w.Body.Bytes(), &result); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(result.URL, "http://files.example.onion/") {
+		t.Errorf("upload response links to %q", result.URL)
+	}
+}
+
+func TestBandwidthQuota(t *testing.T) {
+	content := randomContent(t, 400<<10)
+	quota := map[string]string{"limit_bandwidth": "on", "bandwidth_limit": "1"}
+	encrypted := map[string]string{"limit_bandwidth": "on", "bandwidth_limit": "1", "password_enabled": "on", "password": "secret"}
+	for _, tc := range []struct {
+		name     string
+		form     map[string]string
+		download func(h http.Handler, name string) *httptest.ResponseRecorder
+	}{
+		{"GET", quota, func(h http.Handler, name string) *httptest.ResponseRecorder {
+			return request(h, http.MethodGet, "/"+name)
+		}},
+		{"decrypted POST", encrypted, func(h http.Handler, name string) *httptest.ResponseRecorder {
+			return postPassword(h, name, "secret")
+		}},
+	} {
+		ob := newTestOnionbox(t)
+		h := ob.handler()
+		oBuffer := uploadFiles(t, ob, []testFile{{"a.bin", content}}, tc.form)
+		// Each download serves a bit over 400KB of the 1MB quota, the one
+		// that goes over it still completes
+		for i := 1; i <= 3; i++ {
+			if w := tc.download(h, oBuffer.Name); w.Code != http.StatusOK {
+				t.Fatalf("%s: download %d got %d, want 200", tc.name, i, w.Code)
+			}
+		}
+		if w := tc.download(h, oBuffer.Name); w.Code != http.StatusForbidden {
+			t.Errorf("%s: download past the quota got %d, want 403", tc.name, w.Code)
+		}
+	}
+	ob := newTestOnionbox(t)
+	w := serve(ob.handler(), newUploadRequest(t, "files", []testFile{{"a.txt", "hello"}}, map[string]string{"limit_bandwidth": "on", "bandwidth_limit": "0"}))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("zero quota: got %d, want 400", w.Code)
+	}
+}
+
+func TestDumpStore(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		debug bool
+		want  []string
+	}{
+		{"debug", true, []string{"Store holds 1 buffers", "5 bytes", "downloads: 1/3"}},
+		{"not debug", false, nil},
+	} {
+		var buf bytes.Buffer
+		ob := newTestOnionbox(t)
+		ob.noZipSingle = true
+		oBuffer := uploadFiles(t, ob, []testFile{{"a.txt", "hello"}}, map[string]string{"limit_downloads": "on", "download_limit": "3"})
+		request(ob.handler(), http.MethodGet, "/"+oBuffer.Name)
+		ob.logger = log.New(&buf, "", 0)
+		ob.debug = tc.debug
+		ob.dumpStore()
+		if tc.want == nil {
+			if buf.Len() != 0 {
+				t.Errorf("%s: dumped %q", tc.name, buf.String())
+			}
+			continue
+		}
+		for _, want := range append(tc.want, oBuffer.Name) {
+			if !strings.Contains(buf.String(), want) {
+				t.Errorf("%s: %q not in dump %q", tc.name, want, buf.String())
+			}
+		}
+	}
+}
+
+func TestPublishWithFallback(t *testing.T) {
+	for _, tc := range []struct {
+		name        string
+		torVersion3 bool
+		allowV2     bool
+		v3Fails     bool
+		wantErr     string
+		wantV3      bool
+		wantWarning bool
+	}{
+		{"v3", true, false, false, "", true, false},
+		{"v3 rejected", true, false, true, "-allow-v2-fallback", true, false},
+		{"v3 rejected with fallback", true, true, true, "", false, true},
+		{"fallback unused", true, true, false, "", true, false},
+		{"v2", false, false, false, "", false, true},
+	} {
+		var buf bytes.Buffer
+		ob := newTestOnionbox(t)
+		ob.logger = log.New(&buf, "", 0)
+		ob.torRetries = 0
+		ob.torVersion3 = tc.torVersion3
+		ob.allowV2 = tc.allowV2
+		err := ob.publishWithFallback(context.Background(), func() error {
+			if ob.torVersion3 && tc.v3Fails {
+				return errors.New("invalid key type")
+			}
+			return nil
+		})
+		if tc.wantErr == "" && err != nil || tc.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tc.wantErr)) {
+			t.Errorf("%s: got %v, want error %q", tc.name, err, tc.wantErr)
+		}
+		if ob.torVersion3 != tc.wantV3 {
+			t.Errorf("%s: got v3 %t, want %t", tc.name, ob.torVersion3, tc.wantV3)
+		}
+		if strings.Contains(buf.String(), "DEPRECATED") != tc.wantWarning {
+			t.Errorf("%s: got log %q, want deprecation warning %t", tc.name, buf.String(), tc.wantWarning)
+		}
+	}
+}
+
+func TestUploadResult(t *testing.T) {
+	ob := newTestOnionbox(t)
+	h := ob.handler()
+	for _, tc := range []struct {
+		name  string
+		files []testFile
+	}{
+		{"one file", []testFile{{"a.txt", "hello"}}},
+		{"three files", []testFile{{"a.txt", "hello"}, {"b.txt", "world"}, {"c.txt", ""}}},
+	} {
+		w := serve(h, newUploadRequest(t, "files", tc.files, nil))
+		var result uploadResult
+		if err := json.Unmarshal(w.Body.Bytes(), &result); err != nil {
+			t.Fatalf("%s: %v: %s", tc.name, err, w.Body)
+		}
+		oBuffer := ob.store.Get(path.Base(result.URL))
+		if oBuffer == nil {
+			t.Fatalf("%s: %s not stored", tc.name, result.URL)
+		}
+		if result.Entries != len(tc.files) {
+			t.Errorf("%s: reported %d entries, want %d", tc.name, result.Entries, len(tc.files))
+		}
+		if result.Size != int64(len(oBuffer.Bytes)) {
+			t.Errorf("%s: reported %d bytes, stored %d", tc.name, result.Size, len(oBuffer.Bytes))
+		}
+		if result.Checksum == "" || result.Checksum != oBuffer.Checksum {
+			t.Errorf("%s: reported checksum %q, stored %q", tc.name, result.Checksum, oBuffer.Checksum)
+		}
+		// Clients not asking for JSON get the same numbers as text
+		r := newUploadRequest(t, "files", tc.files, nil)
+		r.Header.Del("Accept")
+		want := fmt.Sprintf("Stored %d files in ", len(tc.files))
+		if body := serve(h, r).Body.String(); !strings.Contains(body, want) {
+			t.Errorf("%s: %q not in %q", tc.name, want, body)
+		}
+	}
+}
+
+func TestDownloadHeaders(t *testing.T) {
+	for _, tc := range []struct {
+		name            string
+		noZipExt        bool
+		form            map[string]string
+		wantContentType string
+		// %s in wantFilename stands for the buffer's name
+		wantFilename string
+	}{
+		{"defaults", false, nil, "application/zip", "%s.zip"},
+		{"no zip extension", true, nil, "application/zip", "%s"},
+		{"filename", false, map[string]string{"filename": "report.bin"}, "application/zip", "report.bin"},
+		{"filename with path", false, map[string]string{"filename": "../../etc/report.bin"}, "application/zip", "report.bin"},
+		{"content type", false, map[string]string{"content_type": "application/octet-stream"}, "application/octet-stream", "%s.zip"},
+		{"both", true, map[string]string{"filename": "data", "content_type": "application/x-zip-compressed"}, "application/x-zip-compressed", "data"},
+	} {
+		ob := newTestOnionbox(t)
+		ob.noZipExt = tc.noZipExt
+		oBuffer := uploadFiles(t, ob, []testFile{{"a.txt", "hello"}}, tc.form)
+		w := request(ob.handler(), http.MethodGet, "/"+oBuffer.Name)
+		if ct := w.Header().Get("Content-Type"); ct != tc.wantContentType {
+			t.Errorf("%s: got Content-Type %q, want %q", tc.name, ct, tc.wantContentType)
+		}
+		want := `attachment; filename="` + strings.Replace(tc.wantFilename, "%s", oBuffer.Name, 1) + `"`
+		if cd := w.Header().Get("Content-Disposition"); cd != want {
+			t.Errorf("%s: got Content-Disposition %q, want %q", tc.name, cd, want)
+		}
+	}
+	ob := newTestOnionbox(t)
+	w := serve(ob.handler(), newUploadRequest(t, "files", []testFile{{"a.txt", "hello"}}, map[string]string{"content_type": "text/html"}))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("disallowed content type: got %d, want 400", w.Code)
+	}
+}
+
+func TestUploadPassword(t *testing.T) {
+	ob := newTestOnionbox(t)
+	hash := sha256.Sum256([]byte("letmein"))
+	ob.uploadPass = hash[:]
+	h := ob.handler()
+	for _, tc := range []struct {
+		name     string
+		method   string
+		pass     string
+		wantCode int
+	}{
+		{"page without credentials", http.MethodGet, "", http.StatusUnauthorized},
+		{"page with wrong password", http.MethodGet, "guess", http.StatusUnauthorized},
+		{"page", http.MethodGet, "letmein", http.StatusOK},
+		{"upload without credentials", http.MethodPost, "", http.StatusUnauthorized},
+		{"upload with wrong password", http.MethodPost, "guess", http.StatusUnauthorized},
+		{"upload", http.MethodPost, "letmein", http.StatusOK},
+	} {
+		r := httptest.NewRequest(tc.method, "/", nil)
+		if tc.method == http.MethodPost {
+			r = newUploadRequest(t, "files", []testFile{{"a.txt", "hello"}}, nil)
+		}
+		if tc.pass != "" {
+			r.SetBasicAuth("anyone", tc.pass)
+		}
+		w := serve(h, r)
+		if w.Code != tc.wantCode {
+			t.Errorf("%s: got %d, want %d", tc.name, w.Code, tc.wantCode)
+		}
+		if w.Code == http.StatusUnauthorized && w.Header().Get("WWW-Authenticate") == "" {
+			t.Errorf("%s: no WWW-Authenticate challenge", tc.name)
+		}
+	}
+	// Only the authorized upload was stored, and anyone may download it
+	buffers := ob.store.List()
+	if len(buffers) != 1 {
+		t.Fatalf("got %d buffers, want 1", len(buffers))
+	}
+	if w := request(h, http.MethodGet, "/"+buffers[0].Name); w.Code != http.StatusOK {
+		t.Errorf("download without credentials: got %d, want 200", w.Code)
+	}
+}
+
+func TestContentLength(t *testing.T) {
+	content := strings.Repeat("onionbox ", 1000)
+	encrypted := map[string]string{"password_enabled": "on", "password": "secret"}
+	get := func(h http.Handler, name string) *httptest.ResponseRecorder {
+		return request(h, http.MethodGet, "/"+name)
+	}
+	post := func(h http.Handler, name string) *httptest.ResponseRecorder {
+		return postPassword(h, name, "secret")
+	}
+	for _, tc := range []struct {
+		name     string
+		set      func(ob *onionbox)
+		form     map[string]string
+		download func(h http.Handler, name string) *httptest.ResponseRecorder
+	}{
+		{"zip", func(ob *onionbox) {}, nil, get},
+		{"raw", func(ob *onionbox) { ob.noZipSingle = true }, nil, get},
+		{"compressed", func(ob *onionbox) { ob.noZipSingle, ob.compress = true, true }, nil, get},
+		{"disk", func(ob *onionbox) { ob.diskDir = t.TempDir() }, nil, get},
+		{"decrypted", func(ob *onionbox) {}, encrypted, post},
+	} {
+		ob := newTestOnionbox(t)
+		tc.set(ob)
+		oBuffer := uploadFiles(t, ob, []testFile{{"a.txt", content}}, tc.form)
+		w := tc.download(ob.handler(), oBuffer.Name)
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: got %d", tc.name, w.Code)
+		}
+		if cl := w.Header().Get("Content-Length"); cl != strconv.Itoa(w.Body.Len()) {
+			t.Errorf("%s: got Content-Length %s, served %d bytes", tc.name, cl, w.Body.Len())
+		}
+	}
+}
+
+func TestCheckPrivateDir(t *testing.T) {
+	dir := t.TempDir()
+	mkdir := func(name string, perm os.FileMode) string {
+		p := filepath.Join(dir, name)
+		if err := os.Mkdir(p, perm); err != nil {
+			t.Fatal(err)
+		}
+		// Mkdir's permissions are subject to the umask
+		if err := os.Chmod(p, perm); err != nil {
+			t.Fatal(err)
+		}
+		return p
+	}
+	file := filepath.Join(dir, "file")
+	if err := ioutil.WriteFile(file, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		name    string
+		dir     string
+		wantErr bool
+	}{
+		{"private", mkdir("private", 0700), false},
+		{"readable", mkdir("readable", 0755), false},
+		{"world-writable", mkdir("world", 0777), true},
+		{"not a directory", file, true},
+		{"missing", filepath.Join(dir, "missing"), true},
+	} {
+		if err := checkPrivateDir(tc.dir); (err != nil) != tc.wantErr {
+			t.Errorf("%s: got %v, want error %t", tc.name, err, tc.wantErr)
+		}
+		// Startup refuses the same directories unless told not to
+		ob := newTestOnionbox(t)
+		ob.diskDir = tc.dir
+		if err := ob.validateFlags(); (err != nil) != tc.wantErr {
+			t.Errorf("%s: validateFlags got %v, want error %t", tc.name, err, tc.wantErr)
+		}
+		if tc.name == "world-writable" {
+			ob.insecureTmp = true
+			if err := ob.validateFlags(); err != nil {
+				t.Errorf("%s with -allow-insecure-tmp: %v", tc.name, err)
+			}
+		}
+	}
+}
+
+func TestNormalizedNames(t *testing.T) {
+	ob := newTestOnionbox(t)
+	oBuffer := uploadFiles(t, ob, []testFile{{"a.txt", "hello"}}, nil)
+	h := ob.handler()
+	for _, target := range []string{
+		"/" + oBuffer.Name,
+		"/" + oBuffer.Name + "/",
+		"/" + strings.ToUpper(oBuffer.Name[:1]) + oBuffer.Name[1:],
+	} {
+		if w := request(h, http.MethodGet, target); w.Code != http.StatusOK {
+			t.Errorf("%s: got %d, want 200", target, w.Code)
+		}
+	}
+}
+
+func TestOpenLogs(t *testing.T) {
+	dir := t.TempDir()
+	// Nothing can be created below a regular file, not even as root
+	blocker := filepath.Join(dir, "file")
+	if err := ioutil.WriteFile(blocker, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		name       string
+		logFile    string
+		wantStdout bool
+	}{
+		{"unwritable", filepath.Join(blocker, "onionbox", "onionbox.log"), true},
+		{"missing directory", filepath.Join(dir, "log", "onionbox", "onionbox.log"), false},
+	} {
+		var buf bytes.Buffer
+		ob := newTestOnionbox(t)
+		ob.logger = log.New(&buf, "", 0)
+		ob.errLogger = log.New(ioutil.Discard, "", 0)
+		ob.logFile = tc.logFile
+		ob.openLogs()
+		defer func() {
+			for _, f := range ob.logFiles {
+				f.Close()
+			}
+		}()
+		if (ob.logger.Writer() == os.Stdout) != tc.wantStdout {
+			t.Errorf("%s: logging to %v, want stdout %t", tc.name, ob.logger.Writer(), tc.wantStdout)
+		}
+		if tc.wantStdout {
+			if !strings.Contains(buf.String(), "logging to stdout instead") {
+				t.Errorf("%s: no warning logged: %q", tc.name, buf.String())
+			}
+			continue
+		}
+		ob.infof("hello")
+		if b, err := ioutil.ReadFile(tc.logFile); err != nil || string(b) != "hello\n" {
+			t.Errorf("%s: log file holds %q, %v", tc.name, b, err)
+		}
+	}
+}
+
+func TestBufferPage(t *testing.T) {
+	for _, tc := range []struct {
+		name          string
+		oBuffer       *onion_buffer.OnionBuffer
+		wantExpiresIn string
+		wantSeconds   int64
+		wantLeft      int
+	}{
+		{"unlimited", &onion_buffer.OnionBuffer{}, "", 0, 0},
+		{"expiring", &onion_buffer.OnionBuffer{ExpiresAt: time.Now().Add(90 * time.Minute)}, "1h30m0s", 5400, 0},
+		{"limited", &onion_buffer.OnionBuffer{DownloadLimit: 3, Downloads: 1}, "", 0, 2},
+	} {
+		page := bufferPage(tc.oBuffer)
+		if page.ExpiresIn != tc.wantExpiresIn || page.ExpiresInSeconds != tc.wantSeconds {
+			t.Errorf("%s: expires in %q (%ds), want %q (%ds)", tc.name, page.ExpiresIn, page.ExpiresInSeconds, tc.wantExpiresIn, tc.wantSeconds)
+		}
+		if page.DownloadsLeft != tc.wantLeft {
+			t.Errorf("%s: %d downloads left, want %d", tc.name, page.DownloadsLeft, tc.wantLeft)
+		}
+	}
+	// The countdown renders on the password and confirmation pages
+	ob := newTestOnionbox(t)
+	h := ob.handler()
+	for _, form := range []map[string]string{
+		{"password_enabled": "on", "password": "secret"},
+		{"confirm_download": "on"},
+	} {
+		form["expire"], form["expiration_time"] = "on", "90"
+		form["limit_downloads"], form["download_limit"] = "on", "3"
+		oBuffer := uploadFiles(t, ob, []testFile{{"a.txt", "hello"}}, form)
+		body := request(h, http.MethodGet, "/"+oBuffer.Name).Body.String()
+		for _, want := range []string{"This link expires in", `data-seconds="5400"`, "Downloads remaining: 3", "/static/expiry.js"} {
+			if !strings.Contains(body, want) {
+				t.Errorf("%v: %q not in page: %s", form, want, body)
+			}
+		}
+	}
+}
+
+func TestShortCode(t *testing.T) {
+	for _, n := range []int{minShortLen, 10, 64} {
+		seen := make(map[string]bool)
+		for i := 0; i < 1000; i++ {
+			code := shortCode(n)
+			if len(code) != n {
+				t.Fatalf("got %q of length %d, want %d", code, len(code), n)
+			}
+			if strings.Trim(code, base62) != "" {
+				t.Fatalf("%q isn't base62", code)
+			}
+			if seen[code] {
+				t.Fatalf("%q generated twice", code)
+			}
+			seen[code] = true
+		}
+	}
+}
+
+func TestShortLinks(t *testing.T) {
+	ob := newTestOnionbox(t)
+	ob.newName = func() string { return shortCode(minShortLen) }
+	h := ob.handler()
+	// Concurrent uploads all get their own code
+	const uploads = 50
+	names := make(chan string, uploads)
+	var wg sync.WaitGroup
+	for i := 0; i < uploads; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			w := serve(h, newUploadRequest(t, "files", []testFile{{"a.txt", strconv.Itoa(i)}}, nil))
+			var result uploadResult
+			if err := json.Unmarshal(w.Body.Bytes(), &result); err != nil {
+				t.Errorf("upload %d: %v", i, err)
+				return
+			}
+			names <- path.Base(result.URL)
+		}(i)
+	}
+	wg.Wait()
+	close(names)
+	seen := make(map[string]bool)
+	for name := range names {
+		if len(name) != minShortLen || seen[name] {
+			t.Errorf("got code %q", name)
+		}
+		seen[name] = true
+		if w := request(h, http.MethodGet, "/"+name); w.Code != http.StatusOK {
+			t.Errorf("%s: got %d, want 200", name, w.Code)
+		}
+	}
+	if len(seen) != uploads {
+		t.Errorf("got %d codes, want %d", len(seen), uploads)
+	}
+	// Taken codes are retried
+	codes := []string{"AAAAAA", "AAAAAA", "BBBBBB"}
+	ob.newName = func() string {
+		code := codes[0]
+		codes = codes[1:]
+		return code
+	}
+	first := uploadFiles(t, ob, []testFile{{"a.txt", "hello"}}, nil)
+	second := uploadFiles(t, ob, []testFile{{"a.txt", "hello"}}, nil)
+	if first.Name != "AAAAAA" || second.Name != "BBBBBB" {
+		t.Errorf("got %s and %s, want AAAAAA and BBBBBB", first.Name, second.Name)
+	}
+}
+
+func TestDownloadNoSniff(t *testing.T) {
+	html := "<html><script>alert(1)</script></html>"
+	for _, tc := range []struct {
+		name  string
+		set   func(ob *onionbox)
+		form  map[string]string
+		files []testFile
+		post  bool
+	}{
+		{"zip", func(ob *onionbox) {}, nil, []testFile{{"a.txt", "hello"}}, false},
+		{"raw html", func(ob *onionbox) { ob.noZipSingle = true }, nil, []testFile{{"index.html", html}}, false},
+		{"raw html inline", func(ob *onionbox) { ob.noZipSingle = true }, map[string]string{"inline": "on"}, []testFile{{"index.html", html}}, false},
+		{"decrypted", func(ob *onionbox) {}, map[string]string{"password_enabled": "on", "password": "secret"}, []testFile{{"index.html", html}}, true},
+	} {
+		ob := newTestOnionbox(t)
+		tc.set(ob)
+		oBuffer := uploadFiles(t, ob, tc.files, tc.form)
+		var w *httptest.ResponseRecorder
+		if tc.post {
+			w = postPassword(ob.handler(), oBuffer.Name, "secret")
+		} else {
+			w = request(ob.handler(), http.MethodGet, "/"+oBuffer.Name)
+		}
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: got %d", tc.name, w.Code)
+		}
+		if got := w.Header().Get("X-Content-Type-Options"); got != "nosniff" {
+			t.Errorf("%s: got X-Content-Type-Options %q, want nosniff", tc.name, got)
+		}
+		if cd := w.Header().Get("Content-Disposition"); !strings.HasPrefix(cd, "attachment;") {
+			t.Errorf("%s: got Content-Disposition %q, want an attachment", tc.name, cd)
+		}
+	}
+}
+
+func TestSeparateLinks(t *testing.T) {
+	ob := newTestOnionbox(t)
+	h := ob.handler()
+	files := []testFile{{"a.txt", "hello"}, {"b.txt", "world"}, {"c.txt", "again"}}
+	form := map[string]string{"separate_links": "on", "limit_downloads": "on", "download_limit": "2"}
+	w := serve(h, newUploadRequest(t, "files", files, form))
+	if w.Code != http.StatusOK {
+		t.Fatalf("got %d: %s", w.Code, w.Body)
+	}
+	var results []uploadResult
+	if err := json.Unmarshal(w.Body.Bytes(), &results); err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != len(files) {
+		t.Fatalf("got %d links, want %d", len(results), len(files))
+	}
+	seen := make(map[string]bool)
+	for i, result := range results {
+		name := path.Base(result.URL)
+		if seen[name] {
+			t.Errorf("link %s given twice", name)
+		}
+		seen[name] = true
+		// Each link serves its own file only, with the upload's options
+		got := unzip(t, request(h, http.MethodGet, "/"+name).Body.Bytes())
+		if len(got) != 1 || got[files[i].name] != files[i].content {
+			t.Errorf("%s: got %v, want only %s", name, got, files[i].name)
+		}
+		if oBuffer := ob.store.Get(name); oBuffer == nil || oBuffer.DownloadLimit != 2 {
+			t.Errorf("%s: download limit not applied", name)
+		}
+	}
+}
+
+func TestErrorLog(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		debug     bool
+		log       func(ob *onionbox)
+		wantMain  bool
+		wantError bool
+	}{
+		{"info", false, func(ob *onionbox) { ob.infof("message") }, true, false},
+		{"debug", true, func(ob *onionbox) { ob.logf("message") }, true, false},
+		{"error", false, func(ob *onionbox) { ob.errorf("message") }, false, true},
+		{"error in debug mode", true, func(ob *onionbox) { ob.errorf("message") }, true, true},
+		{"alert", false, func(ob *onionbox) { ob.alertf("message") }, true, true},
+	} {
+		var main, errs bytes.Buffer
+		ob := newTestOnionbox(t)
+		ob.logger = log.New(&main, "", 0)
+		ob.errLogger = log.New(&errs, "", 0)
+		ob.debug = tc.debug
+		tc.log(ob)
+		if (main.String() == "message\n") != tc.wantMain {
+			t.Errorf("%s: main log holds %q", tc.name, main.String())
+		}
+		if (errs.String() == "message\n") != tc.wantError {
+			t.Errorf("%s: error log holds %q", tc.name, errs.String())
+		}
+	}
+}
+
+func TestWatchIdle(t *testing.T) {
+	ob := newTestOnionbox(t)
+	ob.idleTime = 100 * time.Millisecond
+	// Nothing uploaded, it shuts down
+	ctx, stop := context.WithCancel(context.Background())
+	go ob.watchIdle(ctx, stop)
+	select {
+	case <-ctx.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("not shut down while idle")
+	}
+	// A stored buffer keeps it running until it's destroyed
+	oBuffer := uploadFiles(t, ob, []testFile{{"a.txt", "hello"}}, nil)
+	ctx, stop = context.WithCancel(context.Background())
+	defer stop()
+	go ob.watchIdle(ctx, stop)
+	select {
+	case <-ctx.Done():
+		t.Fatal("shut down with a buffer stored")
+	case <-time.After(3 * ob.idleTime):
+	}
+	if err := ob.store.Destroy(oBuffer); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-ctx.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("not shut down once idle again")
+	}
+}
+
+func TestUploadNotMultipart(t *testing.T) {
+	ob := newTestOnionbox(t)
+	h := ob.handler()
+	for _, tc := range []struct {
+		name        string
+		contentType string
+		body        string
+	}{
+		{"json", "application/json", `{"files": ["a.txt"]}`},
+		{"urlencoded", "application/x-www-form-urlencoded", "files=a.txt"},
+		{"none", "", "hello"},
+	} {
+		r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(tc.body))
+		if tc.contentType != "" {
+			r.Header.Set("Content-Type", tc.contentType)
+		}
+		w := serve(h, r)
+		if w.Code != http.StatusUnsupportedMediaType {
+			t.Errorf("%s: got %d, want 415", tc.name, w.Code)
+		}
+		// The reply says how to upload instead
+		if !strings.Contains(w.Body.String(), "multipart/form-data") {
+			t.Errorf("%s: no guidance in %q", tc.name, w.Body)
+		}
+	}
+}
+
+func TestEntryOrder(t *testing.T) {
+	ob := newTestOnionbox(t)
+	for _, names := range [][]string{
+		{"a.txt", "b.txt", "c.txt", "d.txt"},
+		{"d.txt", "b.txt", "a.txt", "c.txt"},
+		{"c.txt", "a.txt", "d.txt", "b.txt"},
+	} {
+		var files []testFile
+		for _, name := range names {
+			files = append(files, testFile{name, "content of " + name})
+		}
+		// The same upload always gives the same layout, in the form's order
+		for i := 0; i < 3; i++ {
+			oBuffer := uploadFiles(t, ob, files, nil)
+			zReader, err := zip.NewReader(bytes.NewReader(oBuffer.Bytes), int64(len(oBuffer.Bytes)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, f := range zReader.File {
+				got = append(got, f.Name)
+			}
+			if strings.Join(got, ",") != strings.Join(names, ",") {
+				t.Errorf("uploaded %v, zip holds %v", names, got)
+			}
+		}
+	}
+}
+
+func TestMaxPasswordLen(t *testing.T) {
+	ob := newTestOnionbox(t)
+	ob.maxPassLen = 16
+	h := ob.handler()
+	longest, tooLong := strings.Repeat("p", 16), strings.Repeat("p", 17)
+	w := serve(h, newUploadRequest(t, "files", []testFile{{"a.txt", "hello"}}, map[string]string{"password_enabled": "on", "password": tooLong}))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("upload with an over-long password: got %d, want 400", w.Code)
+	}
+	oBuffer := uploadFiles(t, ob, []testFile{{"a.txt", "hello"}}, map[string]string{"password_enabled": "on", "password": longest})
+	// Over-long passwords are refused before a key is derived from them,
+	// so they aren't even counted as failed attempts
+	if w := postPassword(h, oBuffer.Name, tooLong); w.Code != http.StatusBadRequest {
+		t.Errorf("download with an over-long password: got %d, want 400", w.Code)
+	}
+	oBuffer.Lock()
+	failed := oBuffer.FailedAttempts
+	oBuffer.Unlock()
+	if failed != 0 {
+		t.Errorf("over-long password counted as %d failed attempts", failed)
+	}
+	if w := postPassword(h, oBuffer.Name, longest); w.Code != http.StatusOK {
+		t.Errorf("download with the longest password: got %d, want 200", w.Code)
+	}
+}
+
+func TestUploadField(t *testing.T) {
+	ob := newTestOnionbox(t)
+	ob.uploadField = "attachment"
+	h := ob.handler()
+	// Files in the custom field are stored, others ignored
+	oBuffer := uploadFiles(t, ob, []testFile{{"a.txt", "hello"}}, nil)
+	if files := unzip(t, oBuffer.Bytes); files["a.txt"] != "hello" {
+		t.Errorf("got %v", files)
+	}
+	if w := serve(h, newUploadRequest(t, "files", []testFile{{"a.txt", "hello"}}, nil)); w.Code != http.StatusBadRequest {
+		t.Errorf("upload in the default field: got %d, want 400", w.Code)
+	}
+	// The upload page and the 415 guidance name the field
+	if body := request(h, http.MethodGet, "/").Body.String(); !strings.Contains(body, `name="attachment"`) {
+		t.Errorf("upload page doesn't use the field: %s", body)
+	}
+	r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader("{}"))
+	r.Header.Set("Content-Type", "application/json")
+	if body := serve(h, r).Body.String(); !strings.Contains(body, `"attachment"`) {
+		t.Errorf("415 doesn't name the field: %s", body)
+	}
+}
+
+func TestBanner(t *testing.T) {
+	for _, tc := range []struct {
+		banner string
+		want   []string
+	}{
+		{"", nil},
+		{"  \n ", nil},
+		{"Terms of use", []string{"Terms of use"}},
+		{"line one\nline two\n", []string{"line one", "line two"}},
+		{"bell\a and\r return", []string{"bell and return"}},
+	} {
+		if got := bannerLines(tc.banner); strings.Join(got, "|") != strings.Join(tc.want, "|") || len(got) != len(tc.want) {
+			t.Errorf("bannerLines(%q) = %q, want %q", tc.banner, got, tc.want)
+		}
+	}
+	ob := newTestOnionbox(t)
+	ob.banner = bannerLines("<b>Be nice</b>\n<script>alert(1)</script>")
+	h := ob.handler()
+	oBuffer := uploadFiles(t, ob, []testFile{{"a.txt", "hello"}}, map[string]string{"confirm_download": "on"})
+	want := `<p class="banner">&lt;b&gt;Be nice&lt;/b&gt;<br>&lt;script&gt;alert(1)&lt;/script&gt;</p>`
+	for _, target := range []string{"/", "/" + oBuffer.Name} {
+		body := request(h, http.MethodGet, target).Body.String()
+		if !strings.Contains(body, want) {
+			t.Errorf("%s: escaped banner not in page: %s", target, body)
+		}
+		if strings.Contains(body, "<script>alert") {
+			t.Errorf("%s: banner not escaped", target)
+		}
+	}
+}
+
+// overlapRecorder records the most downloads that were being written at once.
+type overlapRecorder struct {
+	*httptest.ResponseRecorder
+	active, max *int32
+}
+
+func (w overlapRecorder) Write(p []byte) (int, error) {
+	n := atomic.AddInt32(w.active, 1)
+	defer atomic.AddInt32(w.active, -1)
+	for {
+		max := atomic.LoadInt32(w.max)
+		if n <= max || atomic.CompareAndSwapInt32(w.max, max, n) {
+			break
+		}
+	}
+	time.Sleep(20 * time.Millisecond)
+	return w.ResponseRecorder.Write(p)
+}
+
+func TestSerializeDownloads(t *testing.T) {
+	for _, tc := range []struct {
+		serialize   bool
+		limit       string
+		wantSuccess int
+	}{
+		{true, "", 5},
+		{false, "", 5},
+		{true, "1", 1},
+		{false, "1", 1},
+	} {
+		ob := newTestOnionbox(t)
+		ob.serialize = tc.serialize
+		form := map[string]string{}
+		if tc.limit != "" {
+			form["limit_downloads"], form["download_limit"] = "on", tc.limit
+		}
+		oBuffer := uploadFiles(t, ob, []testFile{{"a.txt", "hello"}}, form)
+		h := ob.handler()
+		var active, max, success int32
+		var wg sync.WaitGroup
+		for i := 0; i < 5; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				w := overlapRecorder{httptest.NewRecorder(), &active, &max}
+				h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/"+oBuffer.Name, nil))
+				if w.Code == http.StatusOK {
+					atomic.AddInt32(&success, 1)
+				}
+			}()
+		}
+		wg.Wait()
+		// Without -serialize-downloads the downloads overlap
+		if tc.serialize && max != 1 || !tc.serialize && tc.limit == "" && max < 2 {
+			t.Errorf("serialize %t, limit %q: %d downloads written at once", tc.serialize, tc.limit, max)
+		}
+		if success != int32(tc.wantSuccess) {
+			t.Errorf("serialize %t, limit %q: %d downloads succeeded, want %d", tc.serialize, tc.limit, success, tc.wantSuccess)
+		}
+	}
+}
+
+func TestCompressAtRest(t *testing.T) {
+	text := strings.Repeat("the quick brown fox jumps over the lazy dog\n", 1000)
+	for _, tc := range []struct {
+		name           string
+		files          []testFile
+		wantCompressed bool
+	}{
+		{"text", []testFile{{"a.txt", text}}, true},
+		{"zip", []testFile{{"a.txt", text}, {"b.txt", text}}, false},
+	} {
+		ob := newTestOnionbox(t)
+		ob.noZipSingle, ob.compress = true, true
+		oBuffer := uploadFiles(t, ob, tc.files, nil)
+		if oBuffer.Compressed != tc.wantCompressed {
+			t.Errorf("%s: got compressed %t, want %t", tc.name, oBuffer.Compressed, tc.wantCompressed)
+		}
+		w := request(ob.handler(), http.MethodGet, "/"+oBuffer.Name)
+		if tc.wantCompressed && w.Body.String() != text {
+			t.Errorf("%s: download doesn't match the upload", tc.name)
+		}
+		// The checksum covers what's stored
+		if valid, err := oBuffer.ValidateChecksum(); !valid || err != nil {
+			t.Errorf("%s: checksum doesn't validate: %v", tc.name, err)
+		}
+	}
+}
+
+func TestMaxProcs(t *testing.T) {
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(0))
+	before := runtime.GOMAXPROCS(0)
+	for _, tc := range []struct {
+		maxProcs int
+		want     int
+	}{
+		{0, before},
+		{1, 1},
+	} {
+		ob := newTestOnionbox(t)
+		ob.maxProcs = tc.maxProcs
+		ob.applyMaxProcs()
+		if got := runtime.GOMAXPROCS(0); got != tc.want {
+			t.Errorf("-max-procs %d: got GOMAXPROCS %d, want %d", tc.maxProcs, got, tc.want)
+		}
+	}
+}
+
+func TestZipManifest(t *testing.T) {
+	sum := func(s string) string {
+		h := sha256.Sum256([]byte(s))
+		return hex.EncodeToString(h[:])
+	}
+	for _, tc := range []struct {
+		name         string
+		files        []testFile
+		form         map[string]string
+		wantManifest string
+		wantExpires  string
+	}{
+		{"manifest", []testFile{{"a.txt", "hello"}, {"b.txt", "world"}}, nil, "onionbox-manifest.txt", "Expires: never"},
+		{"expiring", []testFile{{"a.txt", "hello"}}, map[string]string{"expire": "on", "expiration_time": "60", "expire_after_download": "on"}, "onionbox-manifest.txt", "Expires: 1h0m0s after the first download"},
+		{"name taken", []testFile{{"onionbox-manifest.txt", "mine"}}, nil, "onionbox-manifest-1.txt", "Expires: never"},
+	} {
+		ob := newTestOnionbox(t)
+		ob.zipManifest = true
+		oBuffer := uploadFiles(t, ob, tc.files, tc.form)
+		got := unzip(t, oBuffer.Bytes)
+		manifest, ok := got[tc.wantManifest]
+		if !ok {
+			t.Fatalf("%s: no %s in %v", tc.name, tc.wantManifest, got)
+		}
+		if !strings.Contains(manifest, tc.wantExpires) {
+			t.Errorf("%s: %q not in manifest %q", tc.name, tc.wantExpires, manifest)
+		}
+		// Every uploaded file is listed with its size and hash, and kept
+		for _, f := range tc.files {
+			line := fmt.Sprintf("%s  %12d  %s\n", sum(f.content), len(f.content), f.name)
+			if !strings.Contains(manifest, line) {
+				t.Errorf("%s: %q not in manifest %q", tc.name, line, manifest)
+			}
+			if got[f.name] != f.content {
+				t.Errorf("%s: %s not kept", tc.name, f.name)
+			}
+		}
+	}
+}
+
+func TestExpireAfterDownload(t *testing.T) {
+	ob := newTestOnionbox(t)
+	h := ob.handler()
+	form := map[string]string{"expire": "on", "expiration_time": "60", "expire_after_download": "on"}
+	oBuffer := uploadFiles(t, ob, []testFile{{"a.txt", "hello"}}, form)
+	if expires := oBuffer.Expiry(); !expires.IsZero() {
+		t.Fatalf("expiry %v set before the first download", expires)
+	}
+	// Opening the confirmation or password page isn't a download
+	request(h, http.MethodHead, "/"+oBuffer.Name)
+	if expires := oBuffer.Expiry(); !expires.IsZero() {
+		t.Fatalf("expiry %v set by a HEAD request", expires)
+	}
+	start := time.Now()
+	if w := request(h, http.MethodGet, "/"+oBuffer.Name); w.Code != http.StatusOK {
+		t.Fatalf("got %d", w.Code)
+	}
+	expires := oBuffer.Expiry()
+	if expires.Before(start.Add(time.Hour)) || expires.After(time.Now().Add(time.Hour)) {
+		t.Errorf("expiry %v isn't an hour after the first download at %v", expires, start)
+	}
+	request(h, http.MethodGet, "/"+oBuffer.Name)
+	if !oBuffer.Expiry().Equal(expires) {
+		t.Errorf("second download moved the expiry to %v", oBuffer.Expiry())
+	}
+}
+
+// freeAddr returns a local address nothing is listening on.
+func freeAddr(t *testing.T) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return l.Addr().String()
+}
+
+// startRun runs ob with -no-tor on a free address until the returned
+// stop is called, which returns Run's error.
+func startRun(t *testing.T, ob *onionbox) (addr string, stop func() error) {
+	t.Helper()
+	ob.devListen = freeAddr(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- ob.Run(ctx)
+	}()
+	stop = func() error {
+		cancel()
+		select {
+		case err := <-errCh:
+			return err
+		case <-time.After(10 * time.Second):
+			t.Fatal("Run didn't return after its context was canceled")
+			return nil
+		}
+	}
+	// Wait for the listener to come up
+	for i := 0; ; i++ {
+		conn, err := net.Dial("tcp", ob.devListen)
+		if err == nil {
+			conn.Close()
+			return ob.devListen, stop
+		}
+		if i == 100 {
+			stop()
+			t.Fatalf("Run isn't serving on %s: %v", ob.devListen, err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestRun(t *testing.T) {
+	ob := newTestOnionbox(t)
+	oBuffer := uploadFiles(t, ob, []testFile{{"a.txt", "hello"}}, nil)
+	addr, stop := startRun(t, ob)
+	resp, err := http.Get("http://" + addr + "/" + oBuffer.Name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("got %d while running", resp.StatusCode)
+	}
+	// Returning at all proves os.Exit wasn't called
+	if err := stop(); err != nil {
+		t.Errorf("Run returned %v", err)
+	}
+	if n := len(ob.store.List()); n != 0 {
+		t.Errorf("%d buffers left after Run returned", n)
+	}
+	if _, err := http.Get("http://" + addr + "/"); err == nil {
+		t.Error("still serving after Run returned")
+	}
+}
+
+func TestRunListenError(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	ob := newTestOnionbox(t)
+	ob.devListen = l.Addr().String()
+	if err := ob.Run(context.Background()); err == nil || !strings.Contains(err.Error(), "listening on") {
+		t.Errorf("got %v, want a listening error", err)
+	}
+}
+
+func TestRunServeError(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		fail    bool
+		wantErr bool
+	}{
+		{"listener closed", true, true},
+		{"canceled", false, false},
+	} {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		ob := newTestOnionbox(t)
+		uploadFiles(t, ob, []testFile{{"a.txt", "hello"}}, nil)
+		ctx, cancel := context.WithCancel(context.Background())
+		errCh := make(chan error, 1)
+		go func() {
+			errCh <- ob.serve(ctx, l, ob.handler())
+		}()
+		// Closing the listener makes serving fail, not shut down cleanly
+		if tc.fail {
+			l.Close()
+		} else {
+			cancel()
+		}
+		select {
+		case err = <-errCh:
+		case <-time.After(10 * time.Second):
+			t.Fatalf("%s: serve didn't return", tc.name)
+		}
+		cancel()
+		l.Close()
+		if (err != nil) != tc.wantErr {
+			t.Errorf("%s: got %v, want error %t", tc.name, err, tc.wantErr)
+		}
+		if n := len(ob.store.List()); n != 0 {
+			t.Errorf("%s: %d buffers left after serve returned", tc.name, n)
+		}
+	}
+}
+
+func TestMaxInFlight(t *testing.T) {
+	ob := newTestOnionbox(t)
+	ob.maxInFlight = 1
+	release := make(chan struct{})
+	h := ob.limitInFlight(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	// Saturate the server with a request that doesn't finish
+	done := make(chan struct{})
+	go func() {
+		request(h, http.MethodGet, "/")
+		close(done)
+	}()
+	for atomic.LoadInt32(&ob.inFlight) != 1 {
+		time.Sleep(time.Millisecond)
+	}
+	for _, tc := range []struct {
+		accept   string
+		wantType string
+		wantBody string
+	}{
+		{"application/json", "application/json", `"status":503`},
+		{"text/html", "text/html", "The server is busy"},
+		{"", "text/plain", "The server is busy"},
+	} {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Set("Accept", tc.accept)
+		w := serve(h, r)
+		if w.Code != http.StatusServiceUnavailable {
+			t.Errorf("%q: got %d, want 503", tc.accept, w.Code)
+		}
+		if got := w.Header().Get("Retry-After"); got == "" {
+			t.Errorf("%q: no Retry-After hint", tc.accept)
+		}
+		if got := w.Header().Get("Content-Type"); !strings.HasPrefix(got, tc.wantType) {
+			t.Errorf("%q: got content type %q, want %s", tc.accept, got, tc.wantType)
+		}
+		if !strings.Contains(w.Body.String(), tc.wantBody) {
+			t.Errorf("%q: body %q doesn't contain %q", tc.accept, w.Body.String(), tc.wantBody)
+		}
+	}
+	close(release)
+	<-done
+	if w := request(h, http.MethodGet, "/"); w.Code != http.StatusOK {
+		t.Errorf("got %d once the server wasn't saturated anymore", w.Code)
+	}
+}
+
+func TestReopenLogs(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		errLog  bool
+		logLine func(ob *onionbox)
+	}{
+		{"log file", false, func(ob *onionbox) { ob.infof("after rotation") }},
+		{"error log file", true, func(ob *onionbox) { ob.errorf("after rotation") }},
+	} {
+		ob := newTestOnionbox(t)
+		ob.errLogger = log.New(ioutil.Discard, "", 0)
+		path := filepath.Join(t.TempDir(), "onionbox.log")
+		if tc.errLog {
+			ob.errLogFile = path
+		} else {
+			ob.logFile = path
+		}
+		ob.openLogs()
+		logger := ob.logger
+		if tc.errLog {
+			logger = ob.errLogger
+		}
+		rotated := logger.Writer()
+		_, stop := startRun(t, ob)
+		// Rotate the log file away like logrotate does
+		if err := os.Rename(path, path+".1"); err != nil {
+			t.Fatal(err)
+		}
+		if err := syscall.Kill(os.Getpid(), syscall.SIGHUP); err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; ; i++ {
+			if logger.Writer() != rotated {
+				break
+			}
+			if i == 100 {
+				t.Fatalf("%s: log file not reopened after SIGHUP", tc.name)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		tc.logLine(ob)
+		if err := stop(); err != nil {
+			t.Fatal(err)
+		}
+		for _, f := range ob.logFiles {
+			f.Close()
+		}
+		if b, err := ioutil.ReadFile(path); err != nil || !strings.Contains(string(b), "after rotation") {
+			t.Errorf("%s: fresh log file holds %q, %v", tc.name, b, err)
+		}
+		if b, err := ioutil.ReadFile(path + ".1"); err != nil || strings.Contains(string(b), "after rotation") {
+			t.Errorf("%s: rotated log file holds %q, %v", tc.name, b, err)
+		}
+	}
+}
+
+func TestSpoofedFilenameHeader(t *testing.T) {
+	ob := newTestOnionbox(t)
+	ob.noZipSingle = true
+	h := ob.handler()
+	a := uploadFiles(t, ob, []testFile{{"a.txt", "file a"}}, nil)
+	b := uploadFiles(t, ob, []testFile{{"b.txt", "file b"}}, nil)
+	for _, tc := range []struct {
+		path     string
+		filename string
+		want     string
+	}{
+		{"/" + a.Name, b.Name, "file a"},
+		{"/" + b.Name, a.Name, "file b"},
+		{"/" + a.Name, "../" + b.Name, "file a"},
+	} {
+		r := httptest.NewRequest(http.MethodGet, tc.path, nil)
+		r.Header.Set("filename", tc.filename)
+		w := serve(h, r)
+		if w.Code != http.StatusOK || w.Body.String() != tc.want {
+			t.Errorf("%s with filename %q: got %d %q, want %q", tc.path, tc.filename, w.Code, w.Body, tc.want)
+		}
+	}
+}
+
+func TestNewServer(t *testing.T) {
+	ob := newTestOnionbox(t)
+	ob.maxHeader = 1 << 10
+	// The dev, admin and onion listeners are all built by newServer
+	srv := ob.newServer(devHandler(ob.handler()))
+	if srv.ReadTimeout <= 0 || srv.WriteTimeout <= 0 || srv.IdleTimeout <= 0 {
+		t.Errorf("got timeouts %v, %v and %v, want all set", srv.ReadTimeout, srv.WriteTimeout, srv.IdleTimeout)
+	}
+	if srv.MaxHeaderBytes != ob.maxHeader {
+		t.Errorf("got MaxHeaderBytes %d, want %d", srv.MaxHeaderBytes, ob.maxHeader)
+	}
+}
+
+func TestMaxHeaderBytes(t *testing.T) {
+	ob := newTestOnionbox(t)
+	ob.maxHeader = 1 << 10
+	addr, stop := startRun(t, ob)
+	defer stop()
+	for _, tc := range []struct {
+		name     string
+		size     int
+		wantCode int
+	}{
+		{"small", 100, http.StatusNotFound},
+		// The server allows some slack over the limit before refusing
+		{"oversized", 64 << 10, http.StatusRequestHeaderFieldsTooLarge},
+	} {
+		r, err := http.NewRequest(http.MethodGet, "http://"+addr+"/missing", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.Header.Set("X-Padding", strings.Repeat("a", tc.size))
+		r.Close = true
+		resp, err := http.DefaultClient.Do(r)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tc.wantCode {
+			t.Errorf("%s: got %d, want %d", tc.name, resp.StatusCode, tc.wantCode)
+		}
+	}
+}
+
+func TestBufferNameContext(t *testing.T) {
+	ob := newTestOnionbox(t)
+	ob.noZipSingle = true
+	a := uploadFiles(t, ob, []testFile{{"a.txt", "file a"}}, nil)
+	b := uploadFiles(t, ob, []testFile{{"b.txt", "file b"}}, nil)
+	for _, tc := range []struct {
+		name     string
+		ctxName  string
+		filename string
+		wantCode int
+		want     string
+	}{
+		{"context wins", b.Name, a.Name, http.StatusOK, "file b"},
+		// Without a name from the router there's no buffer to serve
+		{"header alone", "", a.Name, http.StatusInternalServerError, ""},
+	} {
+		// The path points at a, only the context value may select b
+		r := httptest.NewRequest(http.MethodGet, "/"+a.Name, nil)
+		r.Header.Set("filename", tc.filename)
+		if tc.ctxName != "" {
+			r = r.WithContext(context.WithValue(r.Context(), bufferNameKey, tc.ctxName))
+		}
+		if got := bufferName(r); got != tc.ctxName {
+			t.Errorf("%s: got buffer name %q, want %q", tc.name, got, tc.ctxName)
+		}
+		w := httptest.NewRecorder()
+		ob.download(w, r)
+		if w.Code != tc.wantCode {
+			t.Fatalf("%s: got %d, want %d", tc.name, w.Code, tc.wantCode)
+		}
+		if tc.want != "" && w.Body.String() != tc.want {
+			t.Errorf("%s: got %q, want %q", tc.name, w.Body, tc.want)
+		}
+		if tc.want == "" && strings.Contains(w.Body.String(), "file a") {
+			t.Errorf("%s: served the buffer named in the header", tc.name)
+		}
+	}
+}
+
+func TestUnicodeNames(t *testing.T) {
+	ob := newTestOnionbox(t)
+	h := ob.handler()
+	for _, name := range []string{"café.txt", "日本語のファイル.txt", "Ελληνικά.txt", "emoji 🧅.txt", "plain.txt"} {
+		oBuffer := uploadFiles(t, ob, []testFile{{name, "hello"}, {"other.txt", "world"}}, nil)
+		w := request(h, http.MethodGet, "/"+oBuffer.Name)
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: got %d", name, w.Code)
+		}
+		b := w.Body.Bytes()
+		if got := unzip(t, b)[name]; got != "hello" {
+			t.Errorf("%s: entry holds %q, names in the zip: %v", name, got, unzip(t, b))
+		}
+		zReader, err := zip.NewReader(bytes.NewReader(b), int64(len(b)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, f := range zReader.File {
+			if f.Flags&zipUTF8Flag == 0 || f.NonUTF8 {
+				t.Errorf("%s: entry %s isn't flagged as UTF-8", name, f.Name)
+			}
+		}
+	}
+}
+
+func TestNonTorWarning(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		warn    bool
+		dev     bool
+		tor2web bool
+		want    bool
+	}{
+		{"dev listener", true, true, false, true},
+		{"tor2web gateway", true, false, true, true},
+		{"tor", true, false, false, false},
+		{"dev listener without -warn-non-tor", false, true, false, false},
+	} {
+		ob := newTestOnionbox(t)
+		ob.warnNonTor = tc.warn
+		h := ob.handler()
+		if tc.dev {
+			h = devHandler(h)
+		}
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		if tc.tor2web {
+			r.Header.Set("X-Tor2web", "1")
+		}
+		w := serve(h, r)
+		if got := strings.Contains(w.Body.String(), "You don&#39;t appear to be using Tor"); got != tc.want {
+			t.Errorf("%s: got warning %t, want %t", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestNoTor(t *testing.T) {
+	ob := newTestOnionbox(t)
+	addr, stop := startRun(t, ob)
+	defer stop()
+	for _, tc := range []struct {
+		name  string
+		files []testFile
+		form  map[string]string
+	}{
+		{"one file", []testFile{{"a.txt", "hello"}}, nil},
+		{"two files", []testFile{{"a.txt", "hello"}, {"b.txt", "world"}}, nil},
+		{"encrypted", []testFile{{"a.txt", "secret hello"}}, map[string]string{"password_enabled": "on", "password": "secret"}},
+	} {
+		r := newUploadRequest(t, ob.uploadField, tc.files, tc.form)
+		upload, err := http.NewRequest(http.MethodPost, "http://"+addr+"/", r.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		upload.Header = r.Header
+		resp, err := http.DefaultClient.Do(upload)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var result uploadResult
+		err = json.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil || resp.StatusCode != http.StatusOK {
+			t.Fatalf("%s: upload got %d, %v", tc.name, resp.StatusCode, err)
+		}
+		// The link points at the listener, there's no onion address
+		if !strings.HasPrefix(result.URL, "http://"+addr+"/") {
+			t.Fatalf("%s: got link %s, want one on %s", tc.name, result.URL, addr)
+		}
+		if tc.form != nil {
+			resp, err = http.PostForm(result.URL, url.Values{"password": {tc.form["password"]}})
+		} else {
+			resp, err = http.Get(result.URL)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil || resp.StatusCode != http.StatusOK {
+			t.Fatalf("%s: download got %d, %v", tc.name, resp.StatusCode, err)
+		}
+		files := unzip(t, b)
+		for _, f := range tc.files {
+			if files[f.name] != f.content {
+				t.Errorf("%s: %s holds %q, want %q", tc.name, f.name, files[f.name], f.content)
+			}
+		}
+	}
+}
+
+func TestEmptyFiles(t *testing.T) {
+	ob := newTestOnionbox(t)
+	h := ob.handler()
+	for _, tc := range []struct {
+		name  string
+		files []testFile
+		form  map[string]string
+	}{
+		{"mixed", []testFile{{"empty.txt", ""}, {"a.txt", "hello"}, {"also empty.txt", ""}}, nil},
+		{"only empty", []testFile{{"empty.txt", ""}}, nil},
+		{"encrypted", []testFile{{"empty.txt", ""}, {"a.txt", "hello"}}, map[string]string{"password_enabled": "on", "password": "secret"}},
+	} {
+		w := serve(h, newUploadRequest(t, ob.uploadField, tc.files, tc.form))
+		var result uploadResult
+		if err := json.Unmarshal(w.Body.Bytes(), &result); err != nil || w.Code != http.StatusOK {
+			t.Fatalf("%s: upload got %d, %v", tc.name, w.Code, err)
+		}
+		// Empty files count as entries like any other
+		if result.Entries != len(tc.files) {
+			t.Errorf("%s: got %d entries counted, want %d", tc.name, result.Entries, len(tc.files))
+		}
+		oBuffer := ob.store.Get(path.Base(result.URL))
+		if tc.form != nil {
+			w = postPassword(h, oBuffer.Name, "secret")
+		} else {
+			w = request(h, http.MethodGet, "/"+oBuffer.Name)
+		}
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: got %d: %s", tc.name, w.Code, w.Body)
+		}
+		files := unzip(t, w.Body.Bytes())
+		if len(files) != len(tc.files) {
+			t.Errorf("%s: got %d entries, want %d", tc.name, len(files), len(tc.files))
+		}
+		for _, f := range tc.files {
+			if content, ok := files[f.name]; !ok || content != f.content {
+				t.Errorf("%s: %s holds %q (present %t), want %q", tc.name, f.name, content, ok, f.content)
+			}
+		}
+	}
+}
+
+func TestListenWithTimeout(t *testing.T) {
+	for _, tc := range []struct {
+		name        string
+		publishTime time.Duration
+		listen      func(ctx context.Context) error
+		wantErr     string
+	}{
+		{"published", 3 * time.Minute, func(ctx context.Context) error { return nil }, ""},
+		{"failed", 3 * time.Minute, func(ctx context.Context) error { return errors.New("boom") }, "boom"},
+		{"timed out", 10 * time.Millisecond, func(ctx context.Context) error {
+			<-ctx.Done()
+			return ctx.Err()
+		}, "not published within 10ms, check the network connection and that the system clock is correct"},
+	} {
+		ob := newTestOnionbox(t)
+		ob.publishTime = tc.publishTime
+		start := time.Now()
+		err := ob.listenWithTimeout(context.Background(), func(ctx context.Context) error {
+			// The deadline is -publish-timeout from now
+			deadline, ok := ctx.Deadline()
+			if !ok || deadline.Before(start.Add(tc.publishTime)) || deadline.After(time.Now().Add(tc.publishTime)) {
+				t.Errorf("%s: got deadline %v (set %t), want %v from now", tc.name, deadline, ok, tc.publishTime)
+			}
+			return tc.listen(ctx)
+		})
+		if (err != nil) != (tc.wantErr != "") || err != nil && !strings.Contains(err.Error(), tc.wantErr) {
+			t.Errorf("%s: got %v, want %q", tc.name, err, tc.wantErr)
+		}
+	}
+}
+
+func TestNoStore(t *testing.T) {
+	ob := newTestOnionbox(t)
+	h := ob.handler()
+	plain := uploadFiles(t, ob, []testFile{{"a.txt", "hello"}}, nil)
+	burn := uploadFiles(t, ob, []testFile{{"a.txt", "hello"}}, map[string]string{"limit_downloads": "on", "download_limit": "1"})
+	encrypted := uploadFiles(t, ob, []testFile{{"a.txt", "hello"}}, map[string]string{"password_enabled": "on", "password": "secret"})
+	confirm := uploadFiles(t, ob, []testFile{{"a.txt", "hello"}}, map[string]string{"confirm_download": "on"})
+	for _, tc := range []struct {
+		name     string
+		do       func() *httptest.ResponseRecorder
+		wantCode int
+	}{
+		{"download", func() *httptest.ResponseRecorder { return request(h, http.MethodGet, "/"+plain.Name) }, http.StatusOK},
+		{"burn after read", func() *httptest.ResponseRecorder { return request(h, http.MethodGet, "/"+burn.Name) }, http.StatusOK},
+		{"password form", func() *httptest.ResponseRecorder { return request(h, http.MethodGet, "/"+encrypted.Name) }, http.StatusOK},
+		{"wrong password", func() *httptest.ResponseRecorder { return postPassword(h, encrypted.Name, "wrong") }, http.StatusInternalServerError},
+		{"decrypted download", func() *httptest.ResponseRecorder { return postPassword(h, encrypted.Name, "secret") }, http.StatusOK},
+		{"confirmation form", func() *httptest.ResponseRecorder { return request(h, http.MethodGet, "/"+confirm.Name) }, http.StatusOK},
+	} {
+		w := tc.do()
+		if w.Code != tc.wantCode {
+			t.Errorf("%s: got %d, want %d", tc.name, w.Code, tc.wantCode)
+		}
+		if got := w.Header().Get("Cache-Control"); got != "no-store, no-cache" {
+			t.Errorf("%s: got Cache-Control %q", tc.name, got)
+		}
+		if got := w.Header().Get("Pragma"); got != "no-cache" {
+			t.Errorf("%s: got Pragma %q", tc.name, got)
+		}
+	}
+}
+
+func TestForbidSpill(t *testing.T) {
+	for _, tc := range []struct {
+		name        string
+		forbidSpill bool
+		pass        string
+		padding     int
+		wantCode    int
+	}{
+		{"small form", true, "secret", 10, http.StatusOK},
+		{"spilled", false, "secret", 2 * maxFormMemory, http.StatusOK},
+		{"spilled with wrong password", false, "wrong", 2 * maxFormMemory, http.StatusInternalServerError},
+		{"forbidden", true, "secret", 2 * maxFormMemory, http.StatusRequestEntityTooLarge},
+	} {
+		tmp := t.TempDir()
+		t.Setenv("TMPDIR", tmp)
+		ob := newTestOnionbox(t)
+		ob.forbidSpill = tc.forbidSpill
+		oBuffer := uploadFiles(t, ob, []testFile{{"a.txt", "hello"}}, map[string]string{"password_enabled": "on", "password": "secret"})
+		body := new(bytes.Buffer)
+		mpWriter := multipart.NewWriter(body)
+		mpWriter.WriteField("password", tc.pass)
+		padding, err := mpWriter.CreateFormFile("padding", "padding.bin")
+		if err != nil {
+			t.Fatal(err)
+		}
+		padding.Write(make([]byte, tc.padding))
+		mpWriter.Close()
+		r := httptest.NewRequest(http.MethodPost, "/"+oBuffer.Name, body)
+		r.Header.Set("Content-Type", mpWriter.FormDataContentType())
+		if w := serve(ob.handler(), r); w.Code != tc.wantCode {
+			t.Errorf("%s: got %d, want %d", tc.name, w.Code, tc.wantCode)
+		}
+		// Whatever spilled to disk is gone once the request is handled
+		if files, err := ioutil.ReadDir(tmp); err != nil || len(files) != 0 {
+			t.Errorf("%s: %d temp files left, %v", tc.name, len(files), err)
+		}
+	}
+}
+
+func TestLastAccess(t *testing.T) {
+	ob := newTestOnionbox(t)
+	ob.adminToken = "token"
+	h := ob.handler()
+	encrypted := map[string]string{"password_enabled": "on", "password": "secret"}
+	for _, tc := range []struct {
+		name       string
+		form       map[string]string
+		do         func(name string) *httptest.ResponseRecorder
+		wantAccess bool
+	}{
+		{"download", nil, func(name string) *httptest.ResponseRecorder { return request(h, http.MethodGet, "/"+name) }, true},
+		{"decrypted download", encrypted, func(name string) *httptest.ResponseRecorder { return postPassword(h, name, "secret") }, true},
+		{"password page", encrypted, func(name string) *httptest.ResponseRecorder { return request(h, http.MethodGet, "/"+name) }, false},
+		{"wrong password", encrypted, func(name string) *httptest.ResponseRecorder { return postPassword(h, name, "wrong") }, false},
+	} {
+		oBuffer := uploadFiles(t, ob, []testFile{{"a.txt", "hello"}}, tc.form)
+		if !oBuffer.LastAccess().IsZero() {
+			t.Fatalf("%s: accessed before any download", tc.name)
+		}
+		start := time.Now()
+		tc.do(oBuffer.Name)
+		last := oBuffer.LastAccess()
+		if last.IsZero() == tc.wantAccess || tc.wantAccess && (last.Before(start) || last.After(time.Now())) {
+			t.Errorf("%s: got last access %v, want it updated %t", tc.name, last, tc.wantAccess)
+		}
+		// Listed for operators by the admin API
+		r := httptest.NewRequest(http.MethodGet, "/buffers", nil)
+		r.Header.Set("X-Onionbox-Admin-Token", ob.adminToken)
+		var buffers []adminBuffer
+		if err := json.Unmarshal(serve(ob.adminHandler(), r).Body.Bytes(), &buffers); err != nil {
+			t.Fatal(err)
+		}
+		var listed bool
+		for _, b := range buffers {
+			if b.Name != oBuffer.Name {
+				continue
+			}
+			listed = true
+			if !b.LastAccessedAt.Equal(last) {
+				t.Errorf("%s: admin API lists last access %v, want %v", tc.name, b.LastAccessedAt, last)
+			}
+		}
+		if !listed {
+			t.Errorf("%s: not listed by the admin API", tc.name)
+		}
+	}
+}
+
+func TestInline(t *testing.T) {
+	png := string(templates.Favicon)
+	html := "<html><script>alert(1)</script></html>"
+	for _, tc := range []struct {
+		name            string
+		noZipSingle     bool
+		file            testFile
+		inline          bool
+		wantContentType string
+		wantInline      bool
+	}{
+		{"image", true, testFile{"onion.png", png}, true, "image/png", true},
+		{"text", true, testFile{"notes.txt", "hello"}, true, "text/plain; charset=utf-8", true},
+		{"image as attachment", true, testFile{"onion.png", png}, false, "image/png", false},
+		{"html", true, testFile{"page.html", html}, true, "text/html; charset=utf-8", false},
+		{"zipped image", false, testFile{"onion.png", png}, true, "application/zip", false},
+	} {
+		ob := newTestOnionbox(t)
+		ob.noZipSingle = tc.noZipSingle
+		form := map[string]string{}
+		if tc.inline {
+			form["inline"] = "on"
+		}
+		oBuffer := uploadFiles(t, ob, []testFile{tc.file}, form)
+		w := request(ob.handler(), http.MethodGet, "/"+oBuffer.Name)
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: got %d", tc.name, w.Code)
+		}
+		if got := w.Header().Get("Content-Type"); got != tc.wantContentType {
+			t.Errorf("%s: got Content-Type %q, want %q", tc.name, got, tc.wantContentType)
+		}
+		disposition := w.Header().Get("Content-Disposition")
+		if strings.HasPrefix(disposition, "inline;") != tc.wantInline || strings.HasPrefix(disposition, "attachment;") == tc.wantInline {
+			t.Errorf("%s: got Content-Disposition %q, want inline %t", tc.name, disposition, tc.wantInline)
+		}
+		// Whatever is shown inline can't run scripts
+		if got := w.Header().Get("Content-Security-Policy"); tc.wantInline && got != "sandbox" {
+			t.Errorf("%s: got Content-Security-Policy %q, want sandbox", tc.name, got)
+		}
+	}
+}
+
+// fakeDialer connects to the onion service after failing fails times.
+type fakeDialer struct {
+	fails int
+	dials int
+	addrs []string
+}
+
+func (d *fakeDialer) dial(ctx context.Context, network, addr string) (net.Conn, error) {
+	d.dials++
+	d.addrs = append(d.addrs, addr)
+	if d.dials <= d.fails {
+		return nil, errors.New("descriptor not found")
+	}
+	client, server := net.Pipe()
+	server.Close()
+	return client, nil
+}
+
+func TestReachOnion(t *testing.T) {
+	defer func(interval time.Duration) { verifyInterval = interval }(verifyInterval)
+	verifyInterval = time.Millisecond
+	for _, tc := range []struct {
+		name      string
+		fails     int
+		wantDials int
+		wantErr   bool
+	}{
+		{"reachable", 0, 1, false},
+		{"fails once", 1, 2, false},
+		{"unreachable", 1 << 30, 0, true},
+	} {
+		ob := newTestOnionbox(t)
+		ob.port = 8080
+		ob.verifyTime = 50 * time.Millisecond
+		ctx, cancel := context.WithTimeout(context.Background(), ob.verifyTime)
+		d := &fakeDialer{fails: tc.fails}
+		err := ob.reachOnion(ctx, d.dial, "abc")
+		cancel()
+		if (err != nil) != tc.wantErr {
+			t.Fatalf("%s: got %v, want error %t", tc.name, err, tc.wantErr)
+		}
+		if tc.wantErr && !strings.Contains(err.Error(), "not reachable within 50ms") {
+			t.Errorf("%s: got %v", tc.name, err)
+		}
+		if tc.wantDials > 0 && d.dials != tc.wantDials {
+			t.Errorf("%s: dialed %d times, want %d", tc.name, d.dials, tc.wantDials)
+		}
+		if d.addrs[0] != "abc.onion:8080" {
+			t.Errorf("%s: dialed %s", tc.name, d.addrs[0])
+		}
+	}
+}
+
+func TestRepublishUnreachable(t *testing.T) {
+	defer func(interval time.Duration) { verifyInterval = interval }(verifyInterval)
+	verifyInterval = time.Millisecond
+	ob := newTestOnionbox(t)
+	ob.verifyTime = 50 * time.Millisecond
+	// The first publication's descriptor never propagates, the second's does
+	var published int
+	err := ob.publishWithFallback(context.Background(), func() error {
+		published++
+		d := &fakeDialer{}
+		if published == 1 {
+			d.fails = 1 << 30
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), ob.verifyTime)
+		defer cancel()
+		return ob.reachOnion(ctx, d.dial, "abc")
+	})
+	if err != nil || published != 2 {
+		t.Errorf("got %v after publishing %d times, want success after 2", err, published)
+	}
+}
+
+func TestInFlightDownloads(t *testing.T) {
+	const n = 2
+	for _, tc := range []struct {
+		name          string
+		maxInFlight   int
+		bufInFlight   int
+		wantOtherCode int
+	}{
+		{"global", n, 0, http.StatusServiceUnavailable},
+		{"per buffer", 0, n, http.StatusOK},
+	} {
+		ob := newTestOnionbox(t)
+		ob.noZipSingle = true
+		ob.maxInFlight = tc.maxInFlight
+		ob.bufInFlight = tc.bufInFlight
+		big := uploadFiles(t, ob, []testFile{{"big.bin", randomContent(t, 16<<20)}}, nil)
+		other := uploadFiles(t, ob, []testFile{{"other.txt", "hello"}}, nil)
+		srv := httptest.NewUnstartedServer(ob.handler())
+		// The downloads cut off at the end aren't worth logging
+		srv.Config.ErrorLog = log.New(ioutil.Discard, "", 0)
+		srv.Start()
+		client := &http.Client{Transport: &http.Transport{}}
+		// Keep n downloads of the big buffer writing
+		for i := 0; i < n; i++ {
+			resp, err := client.Get(srv.URL + "/" + big.Name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			if _, err := io.ReadFull(resp.Body, make([]byte, 1024)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if got := big.InFlight(); got != n {
+			t.Fatalf("%s: %d downloads in flight, want %d", tc.name, got, n)
+		}
+		for _, req := range []struct {
+			name     string
+			wantCode int
+		}{
+			{big.Name, http.StatusServiceUnavailable},
+			{other.Name, tc.wantOtherCode},
+		} {
+			resp, err := client.Get(srv.URL + "/" + req.name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != req.wantCode {
+				t.Errorf("%s: %s got %d, want %d", tc.name, req.name, resp.StatusCode, req.wantCode)
+			}
+			if resp.StatusCode == http.StatusServiceUnavailable && resp.Header.Get("Retry-After") == "" {
+				t.Errorf("%s: no Retry-After hint", tc.name)
+			}
+		}
+		srv.CloseClientConnections()
+		srv.Close()
+	}
+}
+
+func TestUploadDuringShutdown(t *testing.T) {
+	ob := newTestOnionbox(t)
+	h := ob.handler()
+	// Uploads racing the wipe are either wiped with it or refused
+	var wg sync.WaitGroup
+	codes := make(chan int, 20)
+	for i := 0; i < cap(codes); i++ {
+		r := newUploadRequest(t, "files", []testFile{{"a.txt", "hello"}}, nil)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			codes <- serve(h, r).Code
+		}()
+	}
+	if err := ob.store.DestroyAll(); err != nil {
+		t.Fatal(err)
+	}
+	wg.Wait()
+	close(codes)
+	for code := range codes {
+		if code != http.StatusOK && code != http.StatusServiceUnavailable {
+			t.Errorf("racing upload got %d", code)
+		}
+	}
+	if n := len(ob.store.List()); n != 0 {
+		t.Errorf("%d buffers left after shutdown", n)
+	}
+	for _, tc := range []struct {
+		accept string
+		want   string
+	}{
+		{"application/json", `"status":503`},
+		{"", "The server is shutting down."},
+	} {
+		r := newUploadRequest(t, "files", []testFile{{"a.txt", "hello"}}, nil)
+		r.Header.Set("Accept", tc.accept)
+		w := serve(h, r)
+		if w.Code != http.StatusServiceUnavailable || !strings.Contains(w.Body.String(), tc.want) {
+			t.Errorf("%q: got %d %q, want 503 with %q", tc.accept, w.Code, w.Body, tc.want)
+		}
+	}
+	if n := len(ob.store.List()); n != 0 {
+		t.Errorf("%d buffers stored after shutdown", n)
+	}
+}
+
+func TestNewName(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		form map[string]string
+	}{
+		{"plain", nil},
+		{"encrypted", map[string]string{"password_enabled": "on", "password": "secret"}},
+		{"expiring", map[string]string{"expire": "on", "expiration_time": "60"}},
+	} {
+		ob := newTestOnionbox(t)
+		ob.newName = func() string { return "knownname" }
+		w := serve(ob.handler(), newUploadRequest(t, ob.uploadField, []testFile{{"a.txt", "hello"}}, tc.form))
+		var result uploadResult
+		if err := json.Unmarshal(w.Body.Bytes(), &result); err != nil {
+			t.Fatalf("%s: got %d, %v", tc.name, w.Code, err)
+		}
+		if result.URL != "http://example.com/knownname" {
+			t.Errorf("%s: got link %s, want one to knownname", tc.name, result.URL)
+		}
+		if !ob.store.Exists("knownname") {
+			t.Errorf("%s: knownname isn't in the store", tc.name)
+		}
+	}
+	// The default generator's names are usable as links
+	for i := 0; i < 100; i++ {
+		if name := sillyName(); name == "" || name != strings.ToLower(name) || onion_buffer.NormalizeName("/"+name) != name {
+			t.Fatalf("got silly name %q", name)
+		}
+	}
+}
+
+func TestWatchIntegrity(t *testing.T) {
+	encrypted := map[string]string{"password_enabled": "on", "password": "secret"}
+	for _, tc := range []struct {
+		name        string
+		noZipSingle bool
+		form        map[string]string
+	}{
+		{"zip", false, nil},
+		{"raw", true, nil},
+		{"encrypted", false, encrypted},
+	} {
+		ob := newTestOnionbox(t)
+		ob.noZipSingle = tc.noZipSingle
+		ob.checkTime = 10 * time.Millisecond
+		h := ob.handler()
+		intact := uploadFiles(t, ob, []testFile{{"a.txt", "hello"}}, tc.form)
+		corrupted := uploadFiles(t, ob, []testFile{{"a.txt", "hello"}}, tc.form)
+		// Flip a bit behind the store's back
+		corrupted.Lock()
+		corrupted.Bytes[len(corrupted.Bytes)/2] ^= 1
+		corrupted.Unlock()
+		ctx, stop := context.WithCancel(context.Background())
+		go ob.watchIntegrity(ctx)
+		for i := 0; !corrupted.IsQuarantined(); i++ {
+			if i == 500 {
+				t.Fatalf("%s: not quarantined by the sweep", tc.name)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		stop()
+		if intact.IsQuarantined() {
+			t.Errorf("%s: intact buffer quarantined", tc.name)
+		}
+		for _, oBuffer := range []*onion_buffer.OnionBuffer{intact, corrupted} {
+			var w *httptest.ResponseRecorder
+			if tc.form != nil {
+				w = postPassword(h, oBuffer.Name, "secret")
+			} else {
+				w = request(h, http.MethodGet, "/"+oBuffer.Name)
+			}
+			quarantined := strings.Contains(w.Body.String(), "failed its integrity check")
+			if quarantined != (oBuffer == corrupted) || quarantined && w.Code != http.StatusInternalServerError {
+				t.Errorf("%s: %s got %d %q", tc.name, oBuffer.Name, w.Code, w.Body)
+			}
+		}
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// fileList collects the values of a repeatable flag.
+type fileList []string
+
+func (l *fileList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *fileList) Set(path string) error {
+	*l = append(*l, path)
+	return nil
+}
+
+// seed stores each -seed-file in a buffer of its own, as if it had been
+// uploaded without any options, before the onion service is published.
+func (ob *onionbox) seed() error {
+	for _, path := range ob.seedFiles {
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		// Name the download after the file
+		form := url.Values{"display_name": {filepath.Base(path)}}
+		zipBuffer := new(bytes.Buffer)
+		zWriter := zip.NewWriter(zipBuffer)
+		entry, err := ob.writeZipEntry(zWriter, filepath.Base(path), f)
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("zipping %s: %v", path, err)
+		}
+		if ob.zipManifest {
+			if err := writeZipManifest(zWriter, []zipEntry{entry}, form, ob.normMtime); err != nil {
+				return fmt.Errorf("writing manifest of %s: %v", path, err)
+			}
+		}
+		if err := zWriter.Close(); err != nil {
+			return fmt.Errorf("zipping %s: %v", path, err)
+		}
+		releaseMem, ok := ob.reserveMem(int64(zipBuffer.Len()))
+		if !ok {
+			return fmt.Errorf("%s doesn't fit in -mem-budget", path)
+		}
+		oBuffer, err := ob.storeUpload(zipBuffer, nil, form)
+		releaseMem()
+		if err != nil {
+			return fmt.Errorf("storing %s: %v", path, err)
+		}
+		ob.logf("Seeded %s as %s", path, oBuffer.CurrentName())
+		ob.seeded = append(ob.seeded, oBuffer)
+	}
+	return nil
+}
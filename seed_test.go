@@ -0,0 +1,59 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"testing"
+)
+
+func TestSeed(t *testing.T) {
+	dir := t.TempDir()
+	for name, content := range map[string]string{"doc.txt": "a document", "notes.txt": "some notes"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, tc := range []struct {
+		name    string
+		files   []testFile
+		wantErr bool
+	}{
+		{"one file", []testFile{{"doc.txt", "a document"}}, false},
+		{"two files", []testFile{{"doc.txt", "a document"}, {"notes.txt", "some notes"}}, false},
+		{"missing file", []testFile{{"missing.txt", ""}}, true},
+	} {
+		ob := newTestOnionbox(t)
+		for _, f := range tc.files {
+			ob.seedFiles.Set(filepath.Join(dir, f.name))
+		}
+		if err := ob.seed(); (err != nil) != tc.wantErr {
+			t.Fatalf("%s: got %v, want error %t", tc.name, err, tc.wantErr)
+		}
+		if tc.wantErr {
+			continue
+		}
+		if len(ob.seeded) != len(tc.files) {
+			t.Fatalf("%s: seeded %d buffers, want %d", tc.name, len(ob.seeded), len(tc.files))
+		}
+		// Downloadable as soon as onionbox is serving
+		addr, stop := startRun(t, ob)
+		for i, f := range tc.files {
+			resp, err := http.Get("http://" + addr + "/" + ob.seeded[i].Name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			b, err := ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+			if err != nil || resp.StatusCode != http.StatusOK {
+				t.Fatalf("%s: got %d, %v", tc.name, resp.StatusCode, err)
+			}
+			if got := unzip(t, b)[f.name]; got != f.content {
+				t.Errorf("%s: %s holds %q, want %q", tc.name, f.name, got, f.content)
+			}
+		}
+		if err := stop(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"onionbox/onion_buffer"
+)
+
+// selftest runs in-process round-trip checks of the crypto, checksum, zip
+// and wipe code paths without starting Tor. It reports whether all passed.
+func (ob *onionbox) selftest() bool {
+	checks := []struct {
+		name string
+		fn   func() error
+	}{
+		{"encrypt/decrypt", selftestCrypto},
+		{"checksum", selftestChecksum},
+		{"zip", ob.selftestZip},
+		{"secure wipe", selftestWipe},
+		{"checksum signature", selftestSignature},
+	}
+	passed := true
+	for _, check := range checks {
+		if err := check.fn(); err != nil {
+			ob.alertf("FAIL %s: %v", check.name, err)
+			passed = false
+			continue
+		}
+		ob.logger.Printf("PASS %s", check.name)
+	}
+	return passed
+}
+
+func selftestCrypto() error {
+	// Span several segments, the last one partial
+	data := make([]byte, 3*onion_buffer.SegmentSize+1)
+	if _, err := rand.Read(data); err != nil {
+		return err
+	}
+	for _, c := range []onion_buffer.Cipher{onion_buffer.AESGCM, onion_buffer.ChaCha20Poly1305} {
+		if err := selftestCipher(data, c); err != nil {
+			return fmt.Errorf("%v: %v", c, err)
+		}
+	}
+	encrypted, err := onion_buffer.Encrypt(data, "selftest", onion_buffer.AESGCM)
+	if err != nil {
+		return err
+	}
+	if _, err := onion_buffer.Decrypt(encrypted, "selftest", onion_buffer.ChaCha20Poly1305); err == nil {
+		return errors.New("decrypted with the wrong cipher")
+	}
+	oBuffer := &onion_buffer.OnionBuffer{Bytes: encrypted, Encrypted: true, PlainSize: int64(len(data)) - 1}
+	if _, err := oBuffer.DecryptTo(ioutil.Discard, "selftest"); err != onion_buffer.ErrSizeMismatch {
+		return errors.New("decrypted a buffer of the wrong size")
+	}
+	return nil
+}
+
+// selftestCipher round-trips data through cipher c.
+func selftestCipher(data []byte, c onion_buffer.Cipher) error {
+	encrypted, err := onion_buffer.Encrypt(data, "selftest", c)
+	if err != nil {
+		return err
+	}
+	decrypted, err := onion_buffer.Decrypt(encrypted, "selftest", c)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(data, decrypted) {
+		return errors.New("decrypted bytes don't match")
+	}
+	var streamed bytes.Buffer
+	if _, err := onion_buffer.DecryptTo(&streamed, encrypted, "selftest", c); err != nil {
+		return err
+	}
+	if !bytes.Equal(data, streamed.Bytes()) {
+		return errors.New("streamed bytes don't match")
+	}
+	if onion_buffer.PlainSize(len(encrypted)) != len(data) {
+		return errors.New("plaintext size doesn't match")
+	}
+	if _, err := onion_buffer.Decrypt(encrypted[:len(encrypted)-onion_buffer.SegmentSize], "selftest", c); err == nil {
+		return errors.New("decrypted a truncated buffer")
+	}
+	if _, err := onion_buffer.Decrypt(encrypted, "wrong", c); err == nil {
+		return errors.New("decrypted with the wrong password")
+	}
+	return nil
+}
+
+func selftestChecksum() error {
+	oBuffer := &onion_buffer.OnionBuffer{Bytes: []byte("onionbox selftest")}
+	chksm, err := oBuffer.GetChecksum()
+	if err != nil {
+		return err
+	}
+	oBuffer.Checksum = chksm
+	if valid, err := oBuffer.ValidateChecksum(); err != nil || !valid {
+		return errors.New("valid checksum was rejected")
+	}
+	oBuffer.Bytes[0] ^= 0xff
+	if valid, err := oBuffer.ValidateChecksum(); err != nil || valid {
+		return errors.New("tampered bytes passed validation")
+	}
+	return nil
+}
+
+func (ob *onionbox) selftestZip() error {
+	data := []byte("onionbox selftest")
+	zipBuffer := new(bytes.Buffer)
+	zWriter := zip.NewWriter(zipBuffer)
+	bufFile, err := zWriter.Create("selftest.txt")
+	if err != nil {
+		return err
+	}
+	if err := writeBytesByChunk(bytes.NewReader(data), bufFile, ob.chunkSize); err != nil {
+		return err
+	}
+	if err := zWriter.Close(); err != nil {
+		return err
+	}
+	name, raw, err := ob.unzipSingle(zipBuffer.Bytes())
+	if err != nil {
+		return err
+	}
+	if name != "selftest.txt" || !bytes.Equal(raw, data) {
+		return errors.New("reopened zip doesn't match")
+	}
+	// Empty files are entries like any other
+	zipBuffer.Reset()
+	zWriter = zip.NewWriter(zipBuffer)
+	if _, err := ob.writeZipEntry(zWriter, "empty.txt", bytes.NewReader(nil)); err != nil {
+		return err
+	}
+	if err := zWriter.Close(); err != nil {
+		return err
+	}
+	name, raw, err = ob.unzipSingle(zipBuffer.Bytes())
+	if err != nil {
+		return err
+	}
+	if name != "empty.txt" || raw == nil || len(raw) != 0 {
+		return errors.New("reopened zip of an empty file doesn't match")
+	}
+	return nil
+}
+
+func selftestWipe() error {
+	f, err := ioutil.TempFile("", "onionbox-selftest-")
+	if err != nil {
+		return err
+	}
+	_, err = f.Write([]byte("onionbox selftest"))
+	f.Close()
+	if err != nil {
+		return err
+	}
+	if err := onion_buffer.WipeFile(f.Name()); err != nil {
+		return err
+	}
+	if _, err := os.Stat(f.Name()); !os.IsNotExist(err) {
+		os.Remove(f.Name())
+		return errors.New("wiped file still exists")
+	}
+	// Destroyed buffers must zero and drop their bytes
+	data := []byte("onionbox selftest")
+	oBuffer := &onion_buffer.OnionBuffer{Bytes: data}
+	if err := oBuffer.Destroy(); err != nil {
+		return err
+	}
+	if oBuffer.Bytes != nil || !bytes.Equal(data, make([]byte, len(data))) {
+		return errors.New("destroyed buffer wasn't wiped")
+	}
+	return nil
+}
+
+func selftestSignature() error {
+	pub, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return err
+	}
+	ob := &onionbox{signKey: key}
+	oBuffer := &onion_buffer.OnionBuffer{Checksum: "0123456789abcdef0123456789abcdef"}
+	ob.signChecksum(oBuffer)
+	if !verifyChecksum(pub, oBuffer.Checksum, oBuffer.Signature) {
+		return errors.New("signature doesn't verify")
+	}
+	if verifyChecksum(pub, "fedcba9876543210fedcba9876543210", oBuffer.Signature) {
+		return errors.New("signature verifies a different checksum")
+	}
+	return nil
+}
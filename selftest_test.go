@@ -0,0 +1,34 @@
+package main
+
+import (
+	"bytes"
+	"log"
+	"strings"
+	"testing"
+)
+
+func TestSelftest(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		fn   func() error
+	}{
+		{"encrypt/decrypt", selftestCrypto},
+		{"checksum", selftestChecksum},
+		{"zip", newTestOnionbox(t).selftestZip},
+		{"secure wipe", selftestWipe},
+		{"checksum signature", selftestSignature},
+	} {
+		if err := tc.fn(); err != nil {
+			t.Errorf("%s: %v", tc.name, err)
+		}
+	}
+	var buf bytes.Buffer
+	ob := newTestOnionbox(t)
+	ob.logger = log.New(&buf, "", 0)
+	if !ob.selftest() {
+		t.Fatalf("selftest failed: %s", buf.String())
+	}
+	if n := strings.Count(buf.String(), "PASS "); n != 5 {
+		t.Errorf("got %d passing checks, want 5: %s", n, buf.String())
+	}
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"encoding/hex"
+	"net/http"
+
+	"onionbox/onion_buffer"
+)
+
+// signingKeyPath is where the public key checksums are signed with is
+// published.
+const signingKeyPath = "/.well-known/onionbox-signing-key"
+
+// signChecksum signs the buffer's checksum with the server key, so
+// recipients can check their download against the published public key.
+// Encrypted and compressed buffers aren't signed since their checksum
+// covers the stored bytes, not what recipients download.
+func (ob *onionbox) signChecksum(oBuffer *onion_buffer.OnionBuffer) {
+	if ob.signKey == nil || oBuffer.Encrypted || oBuffer.Compressed {
+		return
+	}
+	oBuffer.Signature = hex.EncodeToString(ed25519.Sign(ob.signKey, []byte(oBuffer.Checksum)))
+}
+
+// signingKey serves the hex encoded public key checksums are signed with.
+func (ob *onionbox) signingKey(w http.ResponseWriter, r *http.Request) {
+	if ob.signKey == nil {
+		ob.httpError(w, r, "404 page not found", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	pub := ob.signKey.Public().(ed25519.PublicKey)
+	if _, err := w.Write([]byte(hex.EncodeToString(pub) + "\n")); err != nil {
+		ob.errorf("Error writing to client: %v", err)
+	}
+}
+
+// verifyChecksum reports whether sig is a valid hex encoded signature of
+// checksum by pub.
+func verifyChecksum(pub ed25519.PublicKey, checksum, sig string) bool {
+	rawSig, err := hex.DecodeString(sig)
+	if err != nil || len(rawSig) != ed25519.SignatureSize {
+		return false
+	}
+	return ed25519.Verify(pub, []byte(checksum), rawSig)
+}
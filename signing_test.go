@@ -0,0 +1,85 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestVerifyChecksum(t *testing.T) {
+	pub, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherPub, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sig := hex.EncodeToString(ed25519.Sign(key, []byte("checksum")))
+	tampered := []byte(sig)
+	tampered[0] ^= 1
+	for _, tc := range []struct {
+		name     string
+		pub      ed25519.PublicKey
+		checksum string
+		sig      string
+		want     bool
+	}{
+		{"valid", pub, "checksum", sig, true},
+		{"other checksum", pub, "checksun", sig, false},
+		{"other key", otherPub, "checksum", sig, false},
+		{"tampered signature", pub, "checksum", string(tampered), false},
+		{"short signature", pub, "checksum", sig[:len(sig)-2], false},
+		{"not hex", pub, "checksum", "zz" + sig[2:], false},
+		{"empty", pub, "checksum", "", false},
+	} {
+		if got := verifyChecksum(tc.pub, tc.checksum, tc.sig); got != tc.want {
+			t.Errorf("%s: got %t, want %t", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestSignedDownload(t *testing.T) {
+	ob := newTestOnionbox(t)
+	h := ob.handler()
+	if w := request(h, http.MethodGet, signingKeyPath); w.Code != http.StatusNotFound {
+		t.Errorf("key without -sign-checksums: got %d, want 404", w.Code)
+	}
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ob.signKey = key
+	w := request(h, http.MethodGet, signingKeyPath)
+	pub, err := hex.DecodeString(strings.TrimSpace(w.Body.String()))
+	if err != nil || len(pub) != ed25519.PublicKeySize {
+		t.Fatalf("published key %q: %v", w.Body, err)
+	}
+	for _, tc := range []struct {
+		name       string
+		form       map[string]string
+		wantSigned bool
+	}{
+		{"plain", nil, true},
+		{"encrypted", map[string]string{"password_enabled": "on", "password": "secret"}, false},
+	} {
+		oBuffer := uploadFiles(t, ob, []testFile{{"a.txt", "hello"}}, tc.form)
+		if (oBuffer.Signature != "") != tc.wantSigned {
+			t.Errorf("%s: got signature %q, want signed %t", tc.name, oBuffer.Signature, tc.wantSigned)
+		}
+		if !tc.wantSigned {
+			continue
+		}
+		w := request(h, http.MethodGet, "/"+oBuffer.Name)
+		checksum, sig := w.Header().Get("X-Onionbox-Checksum"), w.Header().Get("X-Onionbox-Signature")
+		if checksum != oBuffer.Checksum {
+			t.Errorf("%s: served checksum %q, want %q", tc.name, checksum, oBuffer.Checksum)
+		}
+		if !verifyChecksum(pub, checksum, sig) {
+			t.Errorf("%s: served signature doesn't verify with the published key", tc.name)
+		}
+	}
+}
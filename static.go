@@ -0,0 +1,36 @@
+package main
+
+import (
+	"net/http"
+
+	"onionbox/templates"
+)
+
+// favicon serves the icon so browsers' requests don't reach the store lookup.
+func (ob *onionbox) favicon(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "image/png")
+	w.Header().Set("Cache-Control", "public, max-age=86400")
+	if _, err := w.Write(templates.Favicon); err != nil {
+		ob.errorf("Error writing to client: %v", err)
+	}
+}
+
+// static serves the assets shared by the templates.
+func (ob *onionbox) static(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case "/static/style.css":
+		w.Header().Set("Content-Type", "text/css; charset=utf-8")
+		w.Header().Set("Cache-Control", "public, max-age=86400")
+		if _, err := w.Write([]byte(templates.StyleCSS)); err != nil {
+			ob.errorf("Error writing to client: %v", err)
+		}
+	case "/static/expiry.js":
+		w.Header().Set("Content-Type", "application/javascript; charset=utf-8")
+		w.Header().Set("Cache-Control", "public, max-age=86400")
+		if _, err := w.Write([]byte(templates.ExpiryJS)); err != nil {
+			ob.errorf("Error writing to client: %v", err)
+		}
+	default:
+		ob.httpError(w, r, "404 page not found", http.StatusNotFound)
+	}
+}
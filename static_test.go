@@ -0,0 +1,38 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"onionbox/onion_buffer"
+)
+
+func TestStatic(t *testing.T) {
+	ob := newTestOnionbox(t)
+	store := &fakeStore{buffers: make(map[string]*onion_buffer.OnionBuffer)}
+	ob.store = store
+	h := ob.handler()
+	for _, tc := range []struct {
+		path        string
+		code        int
+		contentType string
+	}{
+		{"/favicon.ico", http.StatusOK, "image/png"},
+		{"/static/style.css", http.StatusOK, "text/css"},
+		{"/static/expiry.js", http.StatusOK, "application/javascript"},
+		{"/static/missing.js", http.StatusNotFound, ""},
+	} {
+		w := request(h, http.MethodGet, tc.path)
+		if w.Code != tc.code {
+			t.Errorf("%s: got %d, want %d", tc.path, w.Code, tc.code)
+			continue
+		}
+		if tc.code == http.StatusOK && !strings.HasPrefix(w.Header().Get("Content-Type"), tc.contentType) {
+			t.Errorf("%s: got Content-Type %q, want %s", tc.path, w.Header().Get("Content-Type"), tc.contentType)
+		}
+	}
+	if store.gets != 0 {
+		t.Errorf("static assets looked up the store %d times", store.gets)
+	}
+}
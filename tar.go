@@ -0,0 +1,139 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+
+	"onionbox/onion_buffer"
+)
+
+// tarFormat returns "tar" or "tar.gz" if the request asks for the buffer
+// as a tarball, through the format query parameter or the Accept header,
+// and "" for the stored zip.
+func tarFormat(r *http.Request) string {
+	switch r.URL.Query().Get("format") {
+	case "tar":
+		return "tar"
+	case "tar.gz", "tgz":
+		return "tar.gz"
+	}
+	accept := r.Header.Get("Accept")
+	if strings.Contains(accept, "application/x-tar") {
+		return "tar"
+	}
+	if strings.Contains(accept, "application/gzip") {
+		return "tar.gz"
+	}
+	return ""
+}
+
+// openZip opens the buffer's zip for reading, from plain if given and
+// from the buffer otherwise. closeZip must be called when done.
+func openZip(oBuffer *onion_buffer.OnionBuffer, plain *onion_buffer.DecryptReader) (zReader *zip.Reader, closeZip func(), err error) {
+	var src io.ReaderAt
+	var size int64
+	closeZip = func() {}
+	switch {
+	case plain != nil:
+		src, size = plain, plain.Size()
+	case oBuffer.Path != "":
+		f, err := os.Open(oBuffer.Path)
+		if err != nil {
+			return nil, nil, err
+		}
+		info, err := f.Stat()
+		if err != nil {
+			f.Close()
+			return nil, nil, err
+		}
+		src, size = f, info.Size()
+		closeZip = func() { f.Close() }
+	default:
+		src, size = bytes.NewReader(oBuffer.Bytes), int64(len(oBuffer.Bytes))
+	}
+	zReader, err = zip.NewReader(src, size)
+	if err != nil {
+		closeZip()
+		return nil, nil, err
+	}
+	return zReader, closeZip, nil
+}
+
+// writeTarball transcodes the buffer's zip to a tarball on the fly. The
+// zip is read from plain if given, which is how encrypted buffers are
+// decrypted a segment at a time, and from the buffer otherwise.
+func (ob *onionbox) writeTarball(w http.ResponseWriter, oBuffer *onion_buffer.OnionBuffer, plain *onion_buffer.DecryptReader, format string) (int64, error) {
+	zReader, closeZip, err := openZip(oBuffer, plain)
+	if err != nil {
+		return 0, err
+	}
+	defer closeZip()
+	// The tarball's size isn't known until it's written
+	name := strings.TrimSuffix(ob.downloadFilename(oBuffer), ".zip") + "." + format
+	w.Header().Del("Content-Length")
+	// Signatures only cover the stored zip
+	w.Header().Del("X-Onionbox-Checksum")
+	w.Header().Del("X-Onionbox-Signature")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name))
+	counter := &countingWriter{w: w}
+	var dst io.Writer = counter
+	var gzWriter *gzip.Writer
+	if format == "tar.gz" {
+		w.Header().Set("Content-Type", "application/gzip")
+		gzWriter = gzip.NewWriter(counter)
+		dst = gzWriter
+	} else {
+		w.Header().Set("Content-Type", "application/x-tar")
+	}
+	tWriter := tar.NewWriter(dst)
+	for _, file := range zReader.File {
+		modTime := file.Modified
+		if modTime.Before(zipEpoch) {
+			modTime = zipEpoch
+		}
+		err := tWriter.WriteHeader(&tar.Header{
+			Name:    file.Name,
+			Mode:    0644,
+			Size:    int64(file.UncompressedSize64),
+			ModTime: modTime,
+		})
+		if err != nil {
+			return counter.n, err
+		}
+		rc, err := file.Open()
+		if err != nil {
+			return counter.n, err
+		}
+		_, err = io.Copy(tWriter, rc)
+		rc.Close()
+		if err != nil {
+			return counter.n, err
+		}
+	}
+	if err := tWriter.Close(); err != nil {
+		return counter.n, err
+	}
+	if gzWriter != nil {
+		err = gzWriter.Close()
+	}
+	return counter.n, err
+}
+
+// countingWriter counts the bytes written through it.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
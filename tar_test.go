@@ -0,0 +1,116 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// untar returns the contents of the tarball in b by file name.
+func untar(t *testing.T, b []byte, gzipped bool) map[string]string {
+	t.Helper()
+	var src io.Reader = bytes.NewReader(b)
+	if gzipped {
+		gzReader, err := gzip.NewReader(src)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer gzReader.Close()
+		src = gzReader
+	}
+	files := make(map[string]string)
+	tReader := tar.NewReader(src)
+	for {
+		header, err := tReader.Next()
+		if err == io.EOF {
+			return files
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		content, err := ioutil.ReadAll(tReader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		files[header.Name] = string(content)
+	}
+}
+
+func TestTar(t *testing.T) {
+	ob := newTestOnionbox(t)
+	files := []testFile{{"a.txt", "hello"}, {"b.txt", "world"}, {"dir/c.bin", randomContent(t, 4096)}}
+	oBuffer := uploadFiles(t, ob, files, nil)
+	h := ob.handler()
+	zipped := unzip(t, request(h, http.MethodGet, "/"+oBuffer.Name).Body.Bytes())
+	if len(zipped) != len(files) {
+		t.Fatalf("got %d files in the zip, want %d", len(zipped), len(files))
+	}
+	for _, tc := range []struct {
+		name            string
+		query           string
+		accept          string
+		wantContentType string
+	}{
+		{"format tar", "?format=tar", "", "application/x-tar"},
+		{"format tar.gz", "?format=tar.gz", "", "application/gzip"},
+		{"format tgz", "?format=tgz", "", "application/gzip"},
+		{"accept tar", "", "application/x-tar", "application/x-tar"},
+		{"accept gzip", "", "application/gzip", "application/gzip"},
+	} {
+		r := httptest.NewRequest(http.MethodGet, "/"+oBuffer.Name+tc.query, nil)
+		if tc.accept != "" {
+			r.Header.Set("Accept", tc.accept)
+		}
+		w := serve(h, r)
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: got %d", tc.name, w.Code)
+		}
+		if ct := w.Header().Get("Content-Type"); ct != tc.wantContentType {
+			t.Errorf("%s: got Content-Type %q, want %q", tc.name, ct, tc.wantContentType)
+		}
+		tarred := untar(t, w.Body.Bytes(), tc.wantContentType == "application/gzip")
+		if len(tarred) != len(zipped) {
+			t.Errorf("%s: got %d entries, the zip has %d", tc.name, len(tarred), len(zipped))
+		}
+		for name, content := range zipped {
+			if tarred[name] != content {
+				t.Errorf("%s: %s differs from the zip", tc.name, name)
+			}
+		}
+	}
+}
+
+func TestTarEncrypted(t *testing.T) {
+	ob := newTestOnionbox(t)
+	// Large enough for the zip to span several encrypted segments
+	files := []testFile{{"a.txt", "hello"}, {"b.bin", randomContent(t, 300<<10)}}
+	oBuffer := uploadFiles(t, ob, files, map[string]string{"password_enabled": "on", "password": "secret"})
+	h := ob.handler()
+	for _, tc := range []struct {
+		name     string
+		pass     string
+		wantCode int
+	}{
+		{"password", "secret", http.StatusOK},
+		{"wrong password", "wrong", http.StatusInternalServerError},
+	} {
+		w := postPassword(h, oBuffer.Name+"?format=tar", tc.pass)
+		if w.Code != tc.wantCode {
+			t.Fatalf("%s: got %d, want %d", tc.name, w.Code, tc.wantCode)
+		}
+		if w.Code != http.StatusOK {
+			continue
+		}
+		tarred := untar(t, w.Body.Bytes(), false)
+		for _, f := range files {
+			if tarred[f.name] != f.content {
+				t.Errorf("%s: %s differs from the upload", tc.name, f.name)
+			}
+		}
+	}
+}
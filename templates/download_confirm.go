@@ -0,0 +1,25 @@
+package templates
+
+// Too avoid needing HTML files with the static binary
+const DownloadConfirmHTML = `<!DOCTYPE html>
+<html lang="{{.Msg.Lang}}">
+    <head>
+        <title>onionbox - {{.Msg.DownloadTitle}}</title>
+        <meta charset="UTF-8">
+        <link rel="stylesheet" type="text/css" href="/static/style.css">
+    </head>
+    <body>
+        <center>
+        {{if .Banner}}<p class="banner">{{range $i, $line := .Banner}}{{if $i}}<br>{{end}}{{$line}}{{end}}</p>{{end}}
+        {{if .NonTor}}<p class="banner">{{.Msg.NonTorWarning}}</p>{{end}}
+        <h2>{{.Msg.DownloadHeading}}</h2>
+        {{if .ExpiresIn}}<p>{{.Msg.ExpiresIn}} <time id="expires-in" datetime="{{.ExpiresAt}}" data-seconds="{{.ExpiresInSeconds}}" data-expired="{{.Msg.Expired}}">{{.ExpiresIn}}</time></p>{{end}}
+        {{if .DownloadsLeft}}<p>{{.Msg.DownloadsLeft}} {{.DownloadsLeft}}</p>{{end}}
+        <form method="post">
+            <input type="hidden" name="token" value="{{.CSRF}}" required/>
+            <input type="submit" class="button" value="{{.Msg.DownloadNowButton}}">
+        </form>
+		</center>
+        {{if .ExpiresIn}}<script src="/static/expiry.js"></script>{{end}}
+    </body>
+</html>`
@@ -2,25 +2,27 @@ package templates
 
 // Too avoid needing HTML files with the static binary
 const DownloadHTML = `<!DOCTYPE html>
-<html lang="en">
+<html lang="{{.Msg.Lang}}">
     <head>
-        <title>onionbox - Download Encrypted</title>
+        <title>onionbox - {{.Msg.DownloadEncryptedTitle}}</title>
         <meta charset="UTF-8">
+        <link rel="stylesheet" type="text/css" href="/static/style.css">
     </head>
     <body>
         <center>
-        <h2>Click below to download your files securely.</h2>
+        {{if .Banner}}<p class="banner">{{range $i, $line := .Banner}}{{if $i}}<br>{{end}}{{$line}}{{end}}</p>{{end}}
+        {{if .NonTor}}<p class="banner">{{.Msg.NonTorWarning}}</p>{{end}}
+        <h2>{{.Msg.DownloadHeading}}</h2>
+        {{if .ExpiresIn}}<p>{{.Msg.ExpiresIn}} <time id="expires-in" datetime="{{.ExpiresAt}}" data-seconds="{{.ExpiresInSeconds}}" data-expired="{{.Msg.Expired}}">{{.ExpiresIn}}</time></p>{{end}}
+        {{if .DownloadsLeft}}<p>{{.Msg.DownloadsLeft}} {{.DownloadsLeft}}</p>{{end}}
         <form method="post">
-            <input type="hidden" name="token" value="{{.}}" required/>
-            <h4>Enter Password:</h4>
+            <input type="hidden" name="token" value="{{.CSRF}}" required/>
+            <h4>{{.Msg.EnterPassword}}</h4>
+            {{if .Hint}}<p>{{.Msg.PasswordHint}} {{.Hint}}</p>{{end}}
             <input type="password" name="password" required><br>
-            <input type="submit" class="button" value="Download">
+            <input type="submit" class="button" value="{{.Msg.DownloadButton}}">
         </form>
 		</center>
+        {{if .ExpiresIn}}<script src="/static/expiry.js"></script>{{end}}
     </body>
-</html>
-<style type="text/css">
-*{
- font-family: "Courier New", Courier, monospace;
-}
-</style>`
+</html>`
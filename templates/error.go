@@ -0,0 +1,18 @@
+package templates
+
+// Too avoid needing HTML files with the static binary
+const ErrorHTML = `<!DOCTYPE html>
+<html lang="{{.Msg.Lang}}">
+    <head>
+        <title>onionbox - {{.Msg.ErrorTitle}} {{.Status}}</title>
+        <meta charset="UTF-8">
+        <link rel="stylesheet" type="text/css" href="/static/style.css">
+    </head>
+    <body>
+        <center>
+        <h2>{{.Msg.ErrorTitle}} {{.Status}}</h2>
+        <p>{{.Error}}</p>
+        <a href="/">{{.Msg.BackToUpload}}</a>
+		</center>
+    </body>
+</html>`
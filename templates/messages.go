@@ -0,0 +1,145 @@
+package templates
+
+import (
+	"strings"
+)
+
+// Page is the data templates are executed with.
+type Page struct {
+	CSRF string
+	Msg  Messages
+	Hint string
+	// UploadField is the name of the form field files are uploaded in
+	UploadField string
+	// Banner is the operator's message, one entry per line
+	Banner []string
+	// NonTor is set when the page seems to be viewed without Tor
+	NonTor bool
+	// ExpiresIn and DownloadsLeft are empty/zero when unlimited
+	ExpiresIn     string
+	DownloadsLeft int
+	// ExpiresAt and ExpiresInSeconds drive the page's countdown
+	ExpiresAt        string
+	ExpiresInSeconds int64
+	// Status and Error describe a failed request
+	Status int
+	Error  string
+}
+
+// Messages holds the user-facing strings of the templates in one language.
+type Messages struct {
+	Lang                   string
+	UploadTitle            string
+	UploadHeading          string
+	AdvancedOptions        string
+	PasswordOption         string
+	LimitOption            string
+	BandwidthOption        string
+	ExpireOption           string
+	ExpireOnAccessOption   string
+	ConfirmOption          string
+	InlineOption           string
+	SeparateOption         string
+	DisplayNameOption      string
+	HintOption             string
+	PasswordHint           string
+	UploadButton           string
+	DownloadTitle          string
+	DownloadEncryptedTitle string
+	DownloadHeading        string
+	EnterPassword          string
+	DownloadButton         string
+	DownloadNowButton      string
+	ExpiresIn              string
+	DownloadsLeft          string
+	ErrorTitle             string
+	BackToUpload           string
+	NonTorWarning          string
+	Expired                string
+}
+
+var catalog = map[string]Messages{
+	"en": {
+		Lang:                   "en",
+		UploadTitle:            "Upload",
+		UploadHeading:          "Please select the file you would like to securely share.",
+		AdvancedOptions:        "Advanced Options",
+		PasswordOption:         "Protect with password?",
+		LimitOption:            "Limit downloads?",
+		BandwidthOption:        "Limit total bytes served? (in MB)",
+		ExpireOption:           "Automatically expire download link? (in minutes)",
+		ExpireOnAccessOption:   "Start the expiration at the first download?",
+		ConfirmOption:          "Require recipients to confirm before downloading?",
+		InlineOption:           "Let browsers show single images, PDFs and text files instead of downloading them?",
+		SeparateOption:         "Give each file its own link?",
+		DisplayNameOption:      "Filename shown to recipients (optional):",
+		HintOption:             "Password hint shown to recipients (optional, not secret):",
+		PasswordHint:           "Password hint:",
+		UploadButton:           "Upload",
+		DownloadTitle:          "Download",
+		DownloadEncryptedTitle: "Download Encrypted",
+		DownloadHeading:        "Click below to download your files securely.",
+		EnterPassword:          "Enter Password:",
+		DownloadButton:         "Download",
+		DownloadNowButton:      "Download now",
+		ExpiresIn:              "This link expires in",
+		DownloadsLeft:          "Downloads remaining:",
+		ErrorTitle:             "Error",
+		BackToUpload:           "Back to upload",
+		Expired:                "expired",
+		NonTorWarning:          "You don't appear to be using Tor. Your connection to this site may not be private, please use Tor Browser.",
+	},
+	"es": {
+		Lang:                   "es",
+		UploadTitle:            "Subir",
+		UploadHeading:          "Seleccione el archivo que desea compartir de forma segura.",
+		AdvancedOptions:        "Opciones avanzadas",
+		PasswordOption:         "¿Proteger con contraseña?",
+		LimitOption:            "¿Limitar descargas?",
+		BandwidthOption:        "¿Limitar el total de bytes servidos? (en MB)",
+		ExpireOption:           "¿Caducar automáticamente el enlace de descarga? (en minutos)",
+		ExpireOnAccessOption:   "¿Empezar la caducidad en la primera descarga?",
+		ConfirmOption:          "¿Exigir a los destinatarios que confirmen antes de descargar?",
+		InlineOption:           "¿Dejar que los navegadores muestren imágenes, PDF y archivos de texto sueltos en vez de descargarlos?",
+		SeparateOption:         "¿Dar a cada archivo su propio enlace?",
+		DisplayNameOption:      "Nombre de archivo mostrado a los destinatarios (opcional):",
+		HintOption:             "Pista de contraseña para los destinatarios (opcional, no secreta):",
+		PasswordHint:           "Pista de contraseña:",
+		UploadButton:           "Subir",
+		DownloadTitle:          "Descargar",
+		DownloadEncryptedTitle: "Descarga cifrada",
+		DownloadHeading:        "Haga clic abajo para descargar sus archivos de forma segura.",
+		EnterPassword:          "Introduzca la contraseña:",
+		DownloadButton:         "Descargar",
+		DownloadNowButton:      "Descargar ahora",
+		ExpiresIn:              "Este enlace caduca en",
+		DownloadsLeft:          "Descargas restantes:",
+		ErrorTitle:             "Error",
+		BackToUpload:           "Volver a subir",
+		Expired:                "caducado",
+		NonTorWarning:          "Parece que no estás usando Tor. Es posible que tu conexión con este sitio no sea privada, usa Tor Browser.",
+	},
+}
+
+// HasLang reports whether messages exist for lang.
+func HasLang(lang string) bool {
+	_, ok := catalog[lang]
+	return ok
+}
+
+// Lookup returns the messages for the first language in the Accept-Language
+// header that has a catalog, falling back to defaultLang and then English.
+func Lookup(acceptLanguage, defaultLang string) Messages {
+	for _, tag := range strings.Split(acceptLanguage, ",") {
+		// Drop the quality value and region, e.g. es-MX;q=0.8
+		tag = strings.TrimSpace(strings.SplitN(tag, ";", 2)[0])
+		tag = strings.ToLower(strings.SplitN(tag, "-", 2)[0])
+		if msgs, ok := catalog[tag]; ok {
+			return msgs
+		}
+	}
+	if msgs, ok := catalog[defaultLang]; ok {
+		return msgs
+	}
+	return catalog["en"]
+}
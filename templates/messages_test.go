@@ -0,0 +1,37 @@
+package templates
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestLookup(t *testing.T) {
+	for _, tc := range []struct {
+		acceptLanguage string
+		defaultLang    string
+		want           string
+	}{
+		{"", "en", "en"},
+		{"es", "en", "es"},
+		{"es-MX,es;q=0.9,en;q=0.8", "en", "es"},
+		{"fr-FR, ES;q=0.5", "en", "es"},
+		{"fr", "es", "es"},
+		{"fr", "de", "en"},
+	} {
+		if got := Lookup(tc.acceptLanguage, tc.defaultLang).Lang; got != tc.want {
+			t.Errorf("Lookup(%q, %q) got %s, want %s", tc.acceptLanguage, tc.defaultLang, got, tc.want)
+		}
+	}
+}
+
+func TestCatalogComplete(t *testing.T) {
+	// A missing string would render as an empty element
+	for lang, msgs := range catalog {
+		v := reflect.ValueOf(msgs)
+		for i := 0; i < v.NumField(); i++ {
+			if v.Field(i).String() == "" {
+				t.Errorf("%s has no %s", lang, v.Type().Field(i).Name)
+			}
+		}
+	}
+}
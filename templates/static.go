@@ -0,0 +1,59 @@
+package templates
+
+// Too avoid needing asset files with the static binary
+
+// StyleCSS is the stylesheet shared by all templates.
+const StyleCSS = `*{
+ font-family: "Courier New", Courier, monospace;
+}
+`
+
+// ExpiryJS counts down the time left on download pages and disables the
+// download button once the link has expired. The server still refuses
+// expired downloads, this only spares recipients a pointless request.
+const ExpiryJS = `(function () {
+  var el = document.getElementById("expires-in");
+  if (!el) {
+    return;
+  }
+  var end = Date.now() + parseInt(el.getAttribute("data-seconds"), 10) * 1000;
+  function format(s) {
+    var h = Math.floor(s / 3600), m = Math.floor(s / 60) % 60, out = "";
+    if (h > 0) {
+      out += h + "h";
+    }
+    if (h > 0 || m > 0) {
+      out += m + "m";
+    }
+    return out + (s % 60) + "s";
+  }
+  function tick() {
+    var left = Math.round((end - Date.now()) / 1000);
+    if (left <= 0) {
+      el.textContent = el.getAttribute("data-expired");
+      var buttons = document.querySelectorAll("input[type=submit]");
+      for (var i = 0; i < buttons.length; i++) {
+        buttons[i].disabled = true;
+      }
+      return;
+    }
+    el.textContent = format(left);
+    setTimeout(tick, 1000);
+  }
+  tick();
+})();
+`
+
+// Favicon is a 16x16 PNG onion served as /favicon.ico.
+var Favicon = []byte{
+	0x89, 0x50, 0x4e, 0x47, 0x0d, 0x0a, 0x1a, 0x0a, 0x00, 0x00, 0x00, 0x0d,
+	0x49, 0x48, 0x44, 0x52, 0x00, 0x00, 0x00, 0x10, 0x00, 0x00, 0x00, 0x10,
+	0x08, 0x06, 0x00, 0x00, 0x00, 0x1f, 0xf3, 0xff, 0x61, 0x00, 0x00, 0x00,
+	0x38, 0x49, 0x44, 0x41, 0x54, 0x78, 0xda, 0x63, 0x60, 0xc0, 0x03, 0x6a,
+	0xfd, 0x66, 0xfc, 0x07, 0x61, 0x06, 0x72, 0xc1, 0xc0, 0x19, 0x00, 0xd3,
+	0x88, 0x8e, 0x29, 0xd2, 0x4c, 0x94, 0x21, 0x84, 0x34, 0xe3, 0x35, 0x84,
+	0x58, 0xcd, 0x38, 0x0d, 0x19, 0x35, 0x80, 0x0a, 0x06, 0x50, 0x1c, 0x8d,
+	0x54, 0x49, 0x48, 0x54, 0x49, 0xca, 0xa4, 0x02, 0x00, 0x8b, 0x0e, 0x2c,
+	0x4c, 0x04, 0x47, 0xa8, 0x29, 0x00, 0x00, 0x00, 0x00, 0x49, 0x45, 0x4e,
+	0x44, 0xae, 0x42, 0x60, 0x82,
+}
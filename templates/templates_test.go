@@ -0,0 +1,52 @@
+package templates
+
+import (
+	"bytes"
+	"html/template"
+	"strings"
+	"testing"
+)
+
+func TestExpiryEmbedded(t *testing.T) {
+	expiring := Page{
+		Msg:              Lookup("", "en"),
+		ExpiresIn:        "1h30m0s",
+		ExpiresAt:        "2026-10-16T12:30:00Z",
+		ExpiresInSeconds: 5400,
+	}
+	for _, tc := range []struct {
+		name     string
+		tmpl     string
+		page     Page
+		wantTime bool
+	}{
+		{"encrypted", DownloadHTML, expiring, true},
+		{"confirm", DownloadConfirmHTML, expiring, true},
+		{"encrypted not expiring", DownloadHTML, Page{Msg: Lookup("", "en")}, false},
+		{"confirm not expiring", DownloadConfirmHTML, Page{Msg: Lookup("", "en")}, false},
+	} {
+		tmpl, err := template.New(tc.name).Parse(tc.tmpl)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var buf bytes.Buffer
+		if err := tmpl.Execute(&buf, tc.page); err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		body := buf.String()
+		for _, want := range []string{
+			`datetime="2026-10-16T12:30:00Z"`,
+			`data-seconds="5400"`,
+			`data-expired="` + tc.page.Msg.Expired + `"`,
+			`<script src="/static/expiry.js"></script>`,
+		} {
+			if strings.Contains(body, want) != tc.wantTime {
+				t.Errorf("%s: %q in page is %t, want %t", tc.name, want, !tc.wantTime, tc.wantTime)
+			}
+		}
+		// Scripts are served as static files so a CSP can forbid inline ones
+		if strings.Contains(body, "<script>") {
+			t.Errorf("%s: inline script in page", tc.name)
+		}
+	}
+}
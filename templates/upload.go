@@ -2,31 +2,39 @@ package templates
 
 // Too avoid needing HTML files with the static binary
 const UploadHTML = `<!DOCTYPE html>
-<html lang="en">
+<html lang="{{.Msg.Lang}}">
     <head>
-        <title>onionbox - Upload</title>
+        <title>onionbox - {{.Msg.UploadTitle}}</title>
         <meta charset="UTF-8">
+        <link rel="stylesheet" type="text/css" href="/static/style.css">
     </head>
     <body>
 		<center>
-        <h2>Please select the file you would like to securely share.</h2>
+        {{if .Banner}}<p class="banner">{{range $i, $line := .Banner}}{{if $i}}<br>{{end}}{{$line}}{{end}}</p>{{end}}
+        {{if .NonTor}}<p class="banner">{{.Msg.NonTorWarning}}</p>{{end}}
+        <h2>{{.Msg.UploadHeading}}</h2>
         <form method="post" enctype="multipart/form-data" action="/">
-            <input type="file" name="files" required multiple><br>
-            <input type="hidden" name="token" value="{{.}}" required/>
-            <h4>Advanced Options</h4>
-            <input type="checkbox" name="password_enabled">Protect with password?<br>
+            <input type="file" name="{{.UploadField}}" required multiple><br>
+            <input type="hidden" name="token" value="{{.CSRF}}" required/>
+            <h4>{{.Msg.AdvancedOptions}}</h4>
+            <input type="checkbox" name="password_enabled">{{.Msg.PasswordOption}}<br>
             <input type="password" name="password"><br>
-            <input type="checkbox" name="limit_downloads">Limit downloads?<br>
+            {{.Msg.HintOption}}<br>
+            <input type="text" name="password_hint" maxlength="100"><br>
+            <input type="checkbox" name="limit_downloads">{{.Msg.LimitOption}}<br>
             <input type="number" name="download_limit"><br>
-            <input type="checkbox" name="expire">Automatically expire download link? (in minutes)<br>
-            <input type="number" name="expiration_time"><br><br>
-            <input type="submit" class="button" value="Upload">
+            <input type="checkbox" name="limit_bandwidth">{{.Msg.BandwidthOption}}<br>
+            <input type="number" name="bandwidth_limit"><br>
+            <input type="checkbox" name="expire">{{.Msg.ExpireOption}}<br>
+            <input type="number" name="expiration_time"><br>
+            <input type="checkbox" name="expire_after_download">{{.Msg.ExpireOnAccessOption}}<br>
+            <input type="checkbox" name="confirm_download">{{.Msg.ConfirmOption}}<br>
+            <input type="checkbox" name="inline">{{.Msg.InlineOption}}<br>
+            <input type="checkbox" name="separate_links">{{.Msg.SeparateOption}}<br>
+            {{.Msg.DisplayNameOption}}<br>
+            <input type="text" name="display_name"><br><br>
+            <input type="submit" class="button" value="{{.Msg.UploadButton}}">
         </form>
 		</center>
     </body>
-</html>
-<style type="text/css">
-*{
- font-family: "Courier New", Courier, monospace;
-}
-</style>`
+</html>`
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/cretz/bine/tor"
+)
+
+// torVersion is the numeric part of a Tor version, like 0.4.8.10.
+type torVersion []int
+
+// parseTorVersion parses a version the way Tor reports it, ignoring status
+// tags and build info as in "0.4.9.1-alpha (git-0123456789abcdef)".
+func parseTorVersion(s string) (torVersion, error) {
+	fields := strings.Fields(s)
+	if len(fields) == 0 {
+		return nil, errors.New("empty version")
+	}
+	var v torVersion
+	for _, part := range strings.Split(strings.SplitN(fields[0], "-", 2)[0], ".") {
+		n, err := strconv.Atoi(part)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("invalid version %q", s)
+		}
+		v = append(v, n)
+	}
+	return v, nil
+}
+
+// olderThan reports whether v is an older version than other.
+func (v torVersion) olderThan(other torVersion) bool {
+	for i := 0; i < len(v) || i < len(other); i++ {
+		var a, b int
+		if i < len(v) {
+			a = v[i]
+		}
+		if i < len(other) {
+			b = other[i]
+		}
+		if a != b {
+			return a < b
+		}
+	}
+	return false
+}
+
+// checkTorVersion logs the version of the running Tor and fails if it's
+// older than -min-tor-version. Without a minimum, not getting the version
+// is only logged.
+func (ob *onionbox) checkTorVersion(t *tor.Tor) error {
+	info, err := t.Control.GetInfo("version")
+	if err == nil && len(info) == 0 {
+		err = errors.New("empty response")
+	}
+	if err != nil {
+		if ob.minTorVer == "" {
+			ob.errorf("Error getting Tor version: %v", err)
+			return nil
+		}
+		return fmt.Errorf("getting Tor version: %v", err)
+	}
+	version := info[0].Val
+	ob.infof("Running Tor %s", version)
+	if ob.minTorVer == "" {
+		return nil
+	}
+	v, err := parseTorVersion(version)
+	if err != nil {
+		return fmt.Errorf("parsing Tor version: %v", err)
+	}
+	// validateFlags already parsed it
+	min, _ := parseTorVersion(ob.minTorVer)
+	if v.olderThan(min) {
+		return fmt.Errorf("Tor %s is older than -min-tor-version %s, please upgrade Tor", version, ob.minTorVer)
+	}
+	return nil
+}
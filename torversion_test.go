@@ -0,0 +1,105 @@
+package main
+
+import (
+	"net"
+	"net/textproto"
+	"strings"
+	"testing"
+
+	"github.com/cretz/bine/control"
+	"github.com/cretz/bine/tor"
+)
+
+func TestParseTorVersion(t *testing.T) {
+	for _, tc := range []struct {
+		s       string
+		want    torVersion
+		wantErr bool
+	}{
+		{"0.4.8.10", torVersion{0, 4, 8, 10}, false},
+		{"0.4.9.1-alpha (git-0123456789abcdef)", torVersion{0, 4, 9, 1}, false},
+		{"0.3.5", torVersion{0, 3, 5}, false},
+		{"", nil, true},
+		{"0.4.x", nil, true},
+		{"0.-4.8", nil, true},
+	} {
+		v, err := parseTorVersion(tc.s)
+		if (err != nil) != tc.wantErr {
+			t.Errorf("%q: got %v, want error %t", tc.s, err, tc.wantErr)
+		}
+		if len(v) != len(tc.want) {
+			t.Errorf("%q: got %v, want %v", tc.s, v, tc.want)
+			continue
+		}
+		for i := range v {
+			if v[i] != tc.want[i] {
+				t.Errorf("%q: got %v, want %v", tc.s, v, tc.want)
+			}
+		}
+	}
+}
+
+func TestOlderThan(t *testing.T) {
+	for _, tc := range []struct {
+		v, other torVersion
+		want     bool
+	}{
+		{torVersion{0, 4, 7, 16}, torVersion{0, 4, 8}, true},
+		{torVersion{0, 4, 8}, torVersion{0, 4, 8, 0}, false},
+		{torVersion{0, 4, 8, 0}, torVersion{0, 4, 8}, false},
+		{torVersion{0, 4, 8}, torVersion{0, 4, 8, 1}, true},
+		{torVersion{0, 4, 10}, torVersion{0, 4, 9, 99}, false},
+		{torVersion{1}, torVersion{0, 9, 9, 9}, false},
+	} {
+		if got := tc.v.olderThan(tc.other); got != tc.want {
+			t.Errorf("%v older than %v: got %t, want %t", tc.v, tc.other, got, tc.want)
+		}
+	}
+}
+
+// fakeTor returns a Tor whose control port answers every command with
+// reply, a complete control protocol response.
+func fakeTor(t *testing.T, reply string) *tor.Tor {
+	t.Helper()
+	client, server := net.Pipe()
+	t.Cleanup(func() { client.Close() })
+	go func() {
+		defer server.Close()
+		conn := textproto.NewConn(server)
+		for {
+			if _, err := conn.ReadLine(); err != nil {
+				return
+			}
+			if _, err := server.Write([]byte(reply)); err != nil {
+				return
+			}
+		}
+	}()
+	return &tor.Tor{Control: control.NewConn(textproto.NewConn(client))}
+}
+
+func TestCheckTorVersion(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		reply   string
+		min     string
+		wantErr string
+	}{
+		{"new enough", "250-version=0.4.8.10\r\n250 OK\r\n", "0.4.8", ""},
+		{"same", "250-version=0.4.8.0 (git-abc)\r\n250 OK\r\n", "0.4.8", ""},
+		{"no minimum", "250-version=0.2.9.1\r\n250 OK\r\n", "", ""},
+		{"too old", "250-version=0.4.7.16\r\n250 OK\r\n", "0.4.8", "Tor 0.4.7.16 is older than -min-tor-version 0.4.8"},
+		{"unparsable", "250-version=unknown\r\n250 OK\r\n", "0.4.8", "parsing Tor version"},
+		{"control error", "551 Internal error\r\n", "0.4.8", "getting Tor version"},
+		{"control error without minimum", "551 Internal error\r\n", "", ""},
+		{"empty", "250 OK\r\n", "0.4.8", "getting Tor version: empty response"},
+		{"empty without minimum", "250 OK\r\n", "", ""},
+	} {
+		ob := newTestOnionbox(t)
+		ob.minTorVer = tc.min
+		err := ob.checkTorVersion(fakeTor(t, tc.reply))
+		if (err != nil) != (tc.wantErr != "") || err != nil && !strings.Contains(err.Error(), tc.wantErr) {
+			t.Errorf("%s: got %v, want %q", tc.name, err, tc.wantErr)
+		}
+	}
+}